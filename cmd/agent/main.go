@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/buffer"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/collector"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/metrics"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/push"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/selfstats"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/upstream"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/appinit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
 	"github.com/go-resty/resty/v2"
 )
 
 func main() {
-	var pollCount int64
-	var randomValue float64
-
 	client := resty.New()
 	cfg, sugar, syncFunc, err := appinit.InitAgentApp()
 	if err != nil {
@@ -20,16 +24,51 @@ func main() {
 	}
 	defer syncFunc()
 
-	go func() {
-		for {
-			metrics.ReportMetrics(sugar, cfg, client, randomValue, pollCount)
-			time.Sleep(cfg.ReportInterval)
+	if cfg.Token != "" {
+		client.SetAuthToken(cfg.Token)
+	}
+
+	ctx := context.Background()
+	tlsConfig, err := appinit.InitAgentTLS(ctx, cfg, sugar)
+	if err != nil {
+		sugar.Fatalf("Failed to initialize TLS: %v", err)
+	}
+	if tlsConfig != nil {
+		client.SetTLSClientConfig(tlsConfig)
+	}
+
+	latencyBounds, err := models.ParseBounds(cfg.HistogramBounds)
+	if err != nil {
+		sugar.Fatalf("Failed to parse histogram buckets: %v", err)
+	}
 
+	stats := selfstats.New(latencyBounds)
+	pool, err := upstream.NewPool(cfg, sugar, metrics.NewSender(client, stats, tlsConfig != nil), stats)
+	if err != nil {
+		sugar.Fatalf("Failed to initialize upstream servers: %v", err)
+	}
+
+	collectors, err := collector.Build(collector.Env{
+		Cfg:        cfg,
+		Sugar:      sugar,
+		Stats:      stats,
+		SpoolDepth: pool.SpoolDepth,
+	})
+	if err != nil {
+		sugar.Fatalf("Failed to initialize collectors: %v", err)
+	}
+
+	buf := buffer.New()
+	collector.Run(ctx, sugar, collectors, buf)
+
+	if cfg.PushAddr != "" {
+		if err := push.Start(ctx, cfg, sugar, buf); err != nil {
+			sugar.Fatalf("Failed to start push endpoint: %v", err)
 		}
-	}()
+	}
 
 	for {
-		metrics.UpdateMetrics(&pollCount, &randomValue)
-		time.Sleep(cfg.PollInterval)
+		time.Sleep(cfg.ReportInterval)
+		metrics.ReportMetrics(sugar, pool, buf)
 	}
 }
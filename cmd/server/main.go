@@ -8,6 +8,7 @@ import (
 	_ "github.com/lib/pq"
 
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/appinit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/health"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/router"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/signalhandlers"
@@ -28,22 +29,54 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	reg := appinit.InitDebug(ctx, cfg, sugar)
+	// the checker is not ready until the storage has restored its metrics
+	checker := health.NewChecker()
+
 	if cfg.DBDSN != "" {
 		wg.Add(1)
-		store, errInit = appinit.InitDBStorage(ctx, cfg, sugar, &wg)
+		store, errInit = appinit.InitDBStorage(ctx, cfg, sugar, &wg, checker)
 	} else {
-		store, errInit = appinit.InitInMemoryStorage(cfg, sugar)
+		store, errInit = appinit.InitInMemoryStorage(cfg, sugar, reg, checker)
 	}
 
 	if errInit != nil {
 		sugar.Fatalf("Failed to initialize storage: %v", errInit)
 	}
 
-	srv := appinit.InitServer(cfg, router.SetupRouter(ctx, sugar, store, cfg.StoreInterval == 0))
+	appinit.InitHistoryCompaction(ctx, cfg, sugar, store)
+
+	appinit.InitHealth(checker, store)
+
+	tokens, err := appinit.InitTokens(cfg, sugar)
+	if err != nil {
+		sugar.Fatalf("Failed to initialize tenants: %v", err)
+	}
+
+	limiter, quota := appinit.InitLimits(cfg, sugar, store)
+
+	auditLog, err := appinit.InitAudit(ctx, cfg, sugar, store)
+	if err != nil {
+		sugar.Fatalf("Failed to initialize audit log: %v", err)
+	}
+
+	pub, err := appinit.InitEvents(ctx, cfg, sugar)
+	if err != nil {
+		sugar.Fatalf("Failed to initialize events: %v", err)
+	}
+
+	appinit.InitComponentMetrics(reg, store, limiter, quota, auditLog, pub)
+
+	tlsConfig, err := appinit.InitServerTLS(ctx, cfg, sugar)
+	if err != nil {
+		sugar.Fatalf("Failed to initialize TLS: %v", err)
+	}
+
+	srv := appinit.InitServer(cfg, router.SetupRouter(ctx, cfg, sugar, store, tokens, limiter, quota, auditLog, pub, checker, reg, cfg.StoreInterval == 0), tlsConfig)
 
 	quitChan, signalChan := appinit.InitSignalHandling()
 
-	go signalhandlers.HandleSignals(signalChan, quitChan, store, cfg, sugar)
+	go signalhandlers.HandleSignals(signalChan, quitChan)
 
 	errChan := make(chan error)
 	appinit.StartServer(srv, errChan)
@@ -54,8 +87,10 @@ func main() {
 
 	wg.Add(1)
 	go func() {
-		signalhandlers.HandleShutdownServer(ctx, quitChan, srv, sugar, &wg, cancel)
+		signalhandlers.HandleShutdownServer(quitChan, srv, store, checker, cfg, sugar, &wg, cancel)
 
 	}()
 	wg.Wait()
+	// events still queued are delivered before the process exits
+	pub.Wait()
 }
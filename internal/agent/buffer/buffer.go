@@ -0,0 +1,151 @@
+package buffer
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
+)
+
+// Buffer aggregates metrics between two reports
+// gauges keep the last value, counter deltas are summed, histograms and summaries are merged
+// and set members are added to a fixed size sketch per set;
+// it is safe for concurrent use
+type Buffer struct {
+	gauges     map[string]float64
+	counters   map[string]int64
+	histograms map[string]models.Histogram
+	summaries  map[string]sketch.Sketch
+	sets       map[string]hll.Sketch
+	mu         sync.Mutex
+}
+
+// New creates an empty Buffer
+func New() *Buffer {
+	return &Buffer{
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+		histograms: make(map[string]models.Histogram),
+		summaries:  make(map[string]sketch.Sketch),
+		sets:       make(map[string]hll.Sketch),
+	}
+}
+
+// Add merges metrics into the buffer, metrics of unknown types or without a value are ignored
+func (b *Buffer) Add(metrics []models.Metrics) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, metric := range metrics {
+		switch {
+		case metric.MType == constants.MetricTypeGauge && metric.Value != nil:
+			b.gauges[metric.ID] = *metric.Value
+		case metric.MType == constants.MetricTypeCounter && metric.Delta != nil:
+			b.counters[metric.ID] += *metric.Delta
+		case metric.MType == constants.MetricTypeHistogram && metric.Validate() == nil:
+			b.histograms[metric.ID] = b.histograms[metric.ID].Merge(metric.Histogram())
+		case metric.MType == constants.MetricTypeSummary && metric.Validate() == nil:
+			b.summaries[metric.ID] = b.summaries[metric.ID].Merge(*metric.Sketch)
+		case metric.MType == constants.MetricTypeSet && metric.Validate() == nil:
+			b.addSet(metric)
+		}
+	}
+}
+
+// addSet merges the registers and members of a set metric into the sketch of the set, the caller must hold the lock;
+// the sketch is owned by the buffer, so members are added to it in place
+func (b *Buffer) addSet(metric models.Metrics) {
+	set := b.sets[metric.ID]
+	if len(metric.Registers) > 0 {
+		set = set.Merge(hll.Sketch{Registers: metric.Registers})
+	}
+	for _, member := range metric.Members {
+		set.Add(member)
+	}
+	b.sets[metric.ID] = set
+}
+
+// Drain returns the aggregated metrics sorted by type and name and empties the buffer
+func (b *Buffer) Drain() []models.Metrics {
+	b.mu.Lock()
+	gauges, counters, histograms, summaries, sets := b.gauges, b.counters, b.histograms, b.summaries, b.sets
+	b.gauges = make(map[string]float64)
+	b.counters = make(map[string]int64)
+	b.histograms = make(map[string]models.Histogram)
+	b.summaries = make(map[string]sketch.Sketch)
+	b.sets = make(map[string]hll.Sketch)
+	b.mu.Unlock()
+
+	result := make([]models.Metrics, 0, len(gauges)+len(counters)+len(histograms)+len(summaries)+len(sets))
+	for name, value := range gauges {
+		localValue := value
+		result = append(result, models.Metrics{ID: name, MType: constants.MetricTypeGauge, Value: &localValue})
+	}
+	for name, delta := range counters {
+		localDelta := delta
+		result = append(result, models.Metrics{ID: name, MType: constants.MetricTypeCounter, Delta: &localDelta})
+	}
+	for name, h := range histograms {
+		result = append(result, models.NewHistogramMetric(name, h))
+	}
+	for name, s := range summaries {
+		result = append(result, models.NewSummaryMetric(name, s))
+	}
+	for name, set := range sets {
+		result = append(result, models.Metrics{ID: name, MType: constants.MetricTypeSet, Registers: set.Registers})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MType != result[j].MType {
+			return result[i].MType < result[j].MType
+		}
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// Restore puts a drained batch that could not be delivered back into the buffer
+// counter deltas, histograms, summaries and sets are added again, gauges are restored only if no newer value arrived in the meantime
+func (b *Buffer) Restore(metrics []models.Metrics) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, metric := range metrics {
+		switch {
+		case metric.MType == constants.MetricTypeGauge && metric.Value != nil:
+			if _, ok := b.gauges[metric.ID]; !ok {
+				b.gauges[metric.ID] = *metric.Value
+			}
+		case metric.MType == constants.MetricTypeCounter && metric.Delta != nil:
+			b.counters[metric.ID] += *metric.Delta
+		case metric.MType == constants.MetricTypeHistogram && metric.Validate() == nil:
+			// observations made since the drain are newer and win if the bounds changed in the meantime
+			if newer, ok := b.histograms[metric.ID]; ok {
+				b.histograms[metric.ID] = metric.Histogram().Merge(newer)
+			} else {
+				b.histograms[metric.ID] = metric.Histogram()
+			}
+		case metric.MType == constants.MetricTypeSummary && metric.Validate() == nil:
+			// likewise the values added since the drain win if the accuracy changed in the meantime
+			if newer, ok := b.summaries[metric.ID]; ok {
+				b.summaries[metric.ID] = metric.Sketch.Merge(newer)
+			} else {
+				b.summaries[metric.ID] = metric.Sketch.Clone()
+			}
+		case metric.MType == constants.MetricTypeSet && metric.Validate() == nil:
+			b.addSet(metric)
+		}
+	}
+}
+
+// Len returns the number of distinct metrics in the buffer
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.gauges) + len(b.counters) + len(b.histograms) + len(b.summaries) + len(b.sets)
+}
@@ -0,0 +1,128 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
+)
+
+func gauge(name string, value float64) models.Metrics {
+	return models.Metrics{ID: name, MType: constants.MetricTypeGauge, Value: &value}
+}
+
+func counter(name string, delta int64) models.Metrics {
+	return models.Metrics{ID: name, MType: constants.MetricTypeCounter, Delta: &delta}
+}
+
+func TestAddAndDrain(t *testing.T) {
+	b := New()
+	b.Add([]models.Metrics{gauge("Alloc", 1), counter("PollCount", 1)})
+	b.Add([]models.Metrics{gauge("Alloc", 2), counter("PollCount", 1), {ID: "broken", MType: constants.MetricTypeGauge}})
+	assert.Equal(t, 2, b.Len())
+
+	assert.Equal(t, []models.Metrics{counter("PollCount", 2), gauge("Alloc", 2)}, b.Drain())
+	assert.Equal(t, 0, b.Len())
+	assert.Empty(t, b.Drain())
+}
+
+func TestRestore(t *testing.T) {
+	b := New()
+	b.Add([]models.Metrics{gauge("Alloc", 1), gauge("HeapSys", 1), counter("PollCount", 3)})
+	batch := b.Drain()
+
+	b.Add([]models.Metrics{gauge("Alloc", 5), counter("PollCount", 1)})
+	b.Restore(batch)
+
+	// the newer gauge wins and the undelivered counter delta is kept
+	assert.Equal(t, []models.Metrics{
+		counter("PollCount", 4),
+		gauge("Alloc", 5),
+		gauge("HeapSys", 1),
+	}, b.Drain())
+}
+
+func histogram(name string, bounds []float64, values ...float64) models.Metrics {
+	h := models.NewHistogram(bounds)
+	for _, v := range values {
+		h.Observe(v)
+	}
+	return models.NewHistogramMetric(name, h)
+}
+
+func TestHistograms(t *testing.T) {
+	bounds := []float64{0.1, 1}
+
+	b := New()
+	b.Add([]models.Metrics{histogram("Latency", bounds, 0.05, 2)})
+	b.Add([]models.Metrics{histogram("Latency", bounds, 0.5), {ID: "broken", MType: constants.MetricTypeHistogram}})
+	assert.Equal(t, 1, b.Len())
+
+	batch := b.Drain()
+	assert.Equal(t, []models.Metrics{histogram("Latency", bounds, 0.05, 2, 0.5)}, batch)
+
+	// a restored histogram is merged with the observations made since the drain
+	b.Add([]models.Metrics{histogram("Latency", bounds, 0.01)})
+	b.Restore(batch)
+	assert.Equal(t, []models.Metrics{histogram("Latency", bounds, 0.05, 2, 0.5, 0.01)}, b.Drain())
+
+	b.Restore(batch)
+	assert.Equal(t, batch, b.Drain())
+}
+
+func summary(name string, alpha float64, values ...float64) models.Metrics {
+	s := sketch.New(alpha)
+	for _, v := range values {
+		s.Add(v)
+	}
+	return models.NewSummaryMetric(name, s)
+}
+
+func TestSummaries(t *testing.T) {
+	b := New()
+	b.Add([]models.Metrics{summary("Latency", 0.01, 1, 2)})
+	b.Add([]models.Metrics{summary("Latency", 0.01, -3), {ID: "broken", MType: constants.MetricTypeSummary}})
+	assert.Equal(t, 1, b.Len())
+
+	batch := b.Drain()
+	assert.Equal(t, []models.Metrics{summary("Latency", 0.01, 1, 2, -3)}, batch)
+
+	// a restored summary is merged with the values added since the drain
+	b.Add([]models.Metrics{summary("Latency", 0.01, 4)})
+	b.Restore(batch)
+	assert.Equal(t, []models.Metrics{summary("Latency", 0.01, 1, 2, -3, 4)}, b.Drain())
+
+	// values added with a different accuracy since the drain replace the restored ones
+	b.Add([]models.Metrics{summary("Latency", 0.05, 4)})
+	b.Restore(batch)
+	assert.Equal(t, []models.Metrics{summary("Latency", 0.05, 4)}, b.Drain())
+}
+
+func TestSets(t *testing.T) {
+	set := func(name string, members ...string) models.Metrics {
+		return models.Metrics{ID: name, MType: constants.MetricTypeSet, Members: members}
+	}
+
+	// sets are buffered as sketches, whose size does not grow with the number of members
+	sketched := func(name string, members ...string) models.Metrics {
+		return models.Metrics{ID: name, MType: constants.MetricTypeSet, Registers: set(name, members...).Set().Registers}
+	}
+
+	b := New()
+	b.Add([]models.Metrics{set("Users", "bob", "alice")})
+	b.Add([]models.Metrics{set("Users", "alice", "carol"), set("Empty")})
+	assert.Equal(t, 1, b.Len())
+
+	batch := b.Drain()
+	assert.Equal(t, []models.Metrics{sketched("Users", "alice", "bob", "carol")}, batch)
+
+	b.Add([]models.Metrics{set("Users", "dave")})
+	b.Restore(batch)
+	assert.Equal(t, []models.Metrics{sketched("Users", "alice", "bob", "carol", "dave")}, b.Drain())
+
+	b.Add([]models.Metrics{sketched("Users", "erin"), set("Users", "frank")})
+	assert.Equal(t, []models.Metrics{sketched("Users", "erin", "frank")}, b.Drain(), "pushed sketches are merged")
+}
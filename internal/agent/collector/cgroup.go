@@ -0,0 +1,231 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+func init() {
+	Register("cgroup", newCgroupCollector)
+}
+
+// cgroupMetricPrefix starts the names of all cgroup metrics
+const cgroupMetricPrefix = "cgroup."
+
+// cgroupCPUCounters maps cpu.stat keys to the counters they are reported in
+var cgroupCPUCounters = map[string]string{
+	"usage_usec":     "CPUUsageUsec",
+	"user_usec":      "CPUUserUsec",
+	"system_usec":    "CPUSystemUsec",
+	"nr_throttled":   "CPUThrottled",
+	"throttled_usec": "CPUThrottledUsec",
+}
+
+// cgroupIOCounters maps io.stat keys to the counters they are reported in, summed over all devices
+var cgroupIOCounters = map[string]string{
+	"rbytes": "IOReadBytes",
+	"wbytes": "IOWriteBytes",
+	"rios":   "IOReadOps",
+	"wios":   "IOWriteOps",
+}
+
+// cgroupCollector reports the resource usage of the cgroup v2 the agent runs in, which inside a
+// container reflects the container rather than the host; files of controllers that are not enabled
+// for the cgroup are skipped
+type cgroupCollector struct {
+	counters *deltaTracker
+	dir      string
+	interval time.Duration
+}
+
+func newCgroupCollector(env Env, interval time.Duration) (Collector, error) {
+	dir, err := detectCgroupDir("/proc/self/cgroup", "/sys/fs/cgroup")
+	if err != nil {
+		return nil, err
+	}
+
+	return &cgroupCollector{
+		counters: newDeltaTracker(),
+		dir:      dir,
+		interval: intervalOrDefault(interval, env.Cfg.PollInterval),
+	}, nil
+}
+
+// detectCgroupDir finds the cgroup v2 directory of the current process from the '0::<path>' entry
+// of procCgroup; if that path is not visible under mountPoint, as happens in a container without
+// a cgroup namespace, the mount point itself is used
+func detectCgroupDir(procCgroup, mountPoint string) (string, error) {
+	data, err := os.ReadFile(procCgroup)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		path, ok := strings.CutPrefix(strings.TrimSpace(line), "0::")
+		if !ok {
+			continue
+		}
+
+		dir := filepath.Join(mountPoint, path)
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err == nil {
+			return dir, nil
+		}
+		if _, err := os.Stat(filepath.Join(mountPoint, "cgroup.controllers")); err == nil {
+			return mountPoint, nil
+		}
+		return "", fmt.Errorf("cgroup %s is not mounted at %s", path, mountPoint)
+	}
+
+	return "", errors.New("no cgroup v2 hierarchy found, only cgroup v2 is supported")
+}
+
+func (c *cgroupCollector) Name() string {
+	return "cgroup"
+}
+
+func (c *cgroupCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *cgroupCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	var errs []error
+
+	gauges := []struct {
+		file string
+		name string
+	}{
+		{"memory.current", "MemoryCurrent"},
+		{"memory.max", "MemoryMax"},
+		{"pids.current", "PidsCurrent"},
+	}
+	for _, g := range gauges {
+		value, ok, err := c.readValue(g.file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			metrics = append(metrics, models.Metrics{ID: cgroupMetricPrefix + g.name, MType: constants.MetricTypeGauge, Value: &value})
+		}
+	}
+
+	totals := make(map[string]int64)
+	if err := c.readCPUStat(totals); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.readIOStat(totals); err != nil {
+		errs = append(errs, err)
+	}
+
+	for name, total := range totals {
+		delta, ok := c.counters.delta(name, total)
+		if !ok || delta == 0 {
+			continue
+		}
+		metrics = append(metrics, models.Metrics{ID: cgroupMetricPrefix + name, MType: constants.MetricTypeCounter, Delta: &delta})
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+// readFile reads a file of the cgroup directory, data is nil if the file does not exist
+func (c *cgroupCollector) readFile(file string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// readValue reads a single value file; ok is false if the file does not exist or holds 'max',
+// the value of an unlimited resource
+func (c *cgroupCollector) readValue(file string) (value float64, ok bool, err error) {
+	data, err := c.readFile(file)
+	if err != nil || data == nil {
+		return 0, false, err
+	}
+
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, false, nil
+	}
+
+	value, err = strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("malformed %s: %w", file, err)
+	}
+	return value, true, nil
+}
+
+// readCPUStat adds the cpu.stat counters to totals, the file consists of 'key value' lines
+func (c *cgroupCollector) readCPUStat(totals map[string]int64) error {
+	data, err := c.readFile("cpu.stat")
+	if err != nil || data == nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		name, ok := cgroupCPUCounters[fields[0]]
+		if !ok {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed cpu.stat %s: %w", fields[0], err)
+		}
+		totals[name] += value
+	}
+
+	return scanner.Err()
+}
+
+// readIOStat adds the io.stat counters of all devices to totals,
+// every line is a device followed by 'key=value' pairs
+func (c *cgroupCollector) readIOStat(totals map[string]int64) error {
+	data, err := c.readFile("io.stat")
+	if err != nil || data == nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			key, valueStr, _ := strings.Cut(field, "=")
+			name, ok := cgroupIOCounters[key]
+			if !ok {
+				continue
+			}
+
+			value, err := strconv.ParseInt(valueStr, 10, 64)
+			if err != nil {
+				return fmt.Errorf("malformed io.stat %s: %w", key, err)
+			}
+			totals[name] += value
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,105 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFiles creates files with the given contents under dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestDetectCgroupDir(t *testing.T) {
+	mount := t.TempDir()
+	procCgroup := filepath.Join(t.TempDir(), "cgroup")
+
+	writeFiles(t, mount, map[string]string{
+		"cgroup.controllers":                            "cpu io memory pids\n",
+		"system.slice/agent.service/cgroup.controllers": "cpu io memory pids\n",
+	})
+
+	testCases := []struct {
+		name     string
+		content  string
+		expected string
+		wantErr  bool
+	}{
+		{name: "nested", content: "0::/system.slice/agent.service\n", expected: filepath.Join(mount, "system.slice/agent.service")},
+		{name: "namespaced", content: "0::/\n", expected: mount},
+		{name: "not mounted", content: "0::/kubepods/pod1/abc\n", expected: mount},
+		{name: "cgroup v1", content: "12:memory:/docker/abc\n1:name=systemd:/docker/abc\n", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(procCgroup, []byte(tc.content), 0644))
+
+			dir, err := detectCgroupDir(procCgroup, mount)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, dir)
+		})
+	}
+}
+
+func TestCgroupCollector(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"memory.current": "104857600\n",
+		"memory.max":     "max\n",
+		"pids.current":   "12\n",
+		"cpu.stat":       "usage_usec 1000\nuser_usec 600\nsystem_usec 400\nnr_periods 0\nnr_throttled 0\nthrottled_usec 0\n",
+		"io.stat":        "8:0 rbytes=4096 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+	})
+
+	c := &cgroupCollector{counters: newDeltaTracker(), dir: dir}
+
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"cgroup.MemoryCurrent": "gauge 1.048576e+08",
+		"cgroup.PidsCurrent":   "gauge 12",
+	}, metricsByName(metrics), "unlimited memory.max is skipped and counters only set their baselines")
+
+	writeFiles(t, dir, map[string]string{
+		"memory.max": "536870912\n",
+		"cpu.stat":   "usage_usec 3500\nuser_usec 2000\nsystem_usec 1500\nnr_periods 4\nnr_throttled 1\nthrottled_usec 250\n",
+		"io.stat":    "8:0 rbytes=8192 wbytes=100 rios=2 wios=1\n8:16 rbytes=10 wbytes=0 rios=1 wios=0\n",
+	})
+	require.NoError(t, os.Remove(filepath.Join(dir, "pids.current")))
+
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"cgroup.MemoryCurrent":    "gauge 1.048576e+08",
+		"cgroup.MemoryMax":        "gauge 5.36870912e+08",
+		"cgroup.CPUUsageUsec":     "counter 2500",
+		"cgroup.CPUUserUsec":      "counter 1400",
+		"cgroup.CPUSystemUsec":    "counter 1100",
+		"cgroup.CPUThrottled":     "counter 1",
+		"cgroup.CPUThrottledUsec": "counter 250",
+		"cgroup.IOReadBytes":      "counter 4106",
+		"cgroup.IOWriteBytes":     "counter 100",
+		"cgroup.IOReadOps":        "counter 2",
+		"cgroup.IOWriteOps":       "counter 1",
+	}, metricsByName(metrics))
+
+	writeFiles(t, dir, map[string]string{"memory.current": "lots\n"})
+	_, err = c.Collect(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/buffer"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/selfstats"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"go.uber.org/zap"
+)
+
+// Collector produces a set of metrics every Interval
+type Collector interface {
+	// Name returns the name the collector is registered and configured under
+	Name() string
+
+	// Interval returns how often Collect is called
+	Interval() time.Duration
+
+	// Collect gathers the current metrics; counters are reported as deltas since the previous call
+	// a collector may return metrics together with an error if only part of its sources failed
+	Collect(ctx context.Context) ([]models.Metrics, error)
+}
+
+// Env holds the agent state a collector factory may depend on
+type Env struct {
+	Cfg        *config.Config
+	Sugar      *zap.SugaredLogger
+	Stats      *selfstats.Stats
+	SpoolDepth func() int
+}
+
+// Factory creates a collector; interval is the configured collection interval,
+// zero means the collector should pick its own default
+type Factory func(env Env, interval time.Duration) (Collector, error)
+
+// Settings is the configuration of a single enabled collector
+type Settings struct {
+	Name     string
+	Interval time.Duration
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a collector available under name, it is meant to be called from init functions
+// and panics if the name is already taken
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("collector %s is already registered", name))
+	}
+	registry[name] = factory
+}
+
+// Registered returns the names of all registered collectors in alphabetical order
+func Registered() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ParseSettings parses a comma separated list of enabled collectors,
+// each entry is a collector name optionally followed by ':' and an interval in seconds, e.g. 'runtime:2,random'
+func ParseSettings(spec string) ([]Settings, error) {
+	var result []Settings
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, intervalStr, hasInterval := strings.Cut(entry, ":")
+		settings := Settings{Name: strings.TrimSpace(name)}
+
+		if hasInterval {
+			// intervals below a nanosecond round to zero, which is not a valid interval either
+			seconds, err := strconv.ParseFloat(strings.TrimSpace(intervalStr), 64)
+			settings.Interval = time.Duration(seconds * float64(time.Second))
+			if err != nil || settings.Interval <= 0 {
+				return nil, fmt.Errorf("invalid interval for collector %s: %s", settings.Name, intervalStr)
+			}
+		}
+
+		if seen[settings.Name] {
+			return nil, fmt.Errorf("collector %s is configured twice", settings.Name)
+		}
+		seen[settings.Name] = true
+
+		result = append(result, settings)
+	}
+
+	return result, nil
+}
+
+// Build creates the collectors enabled in cfg.Collectors, every collector must have a positive interval
+func Build(env Env) ([]Collector, error) {
+	settings, err := ParseSettings(env.Cfg.Collectors)
+	if err != nil {
+		return nil, err
+	}
+
+	collectors := make([]Collector, 0, len(settings))
+	for _, s := range settings {
+		registryMu.Lock()
+		factory, ok := registry[s.Name]
+		registryMu.Unlock()
+
+		if !ok {
+			return nil, fmt.Errorf("unknown collector: %s. Registered collectors are %s", s.Name, strings.Join(Registered(), ", "))
+		}
+
+		c, err := factory(env, s.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create collector %s: %w", s.Name, err)
+		}
+		// a collector falling back to an unset poll or report interval would have none
+		if c.Interval() <= 0 {
+			return nil, fmt.Errorf("collector %s has no positive interval: %s", s.Name, c.Interval())
+		}
+		collectors = append(collectors, c)
+	}
+
+	return collectors, nil
+}
+
+// Run starts a goroutine per collector that collects immediately and then on every interval,
+// adding the results to buf until ctx is done; collection errors are logged and do not stop the collector
+func Run(ctx context.Context, sugar *zap.SugaredLogger, collectors []Collector, buf *buffer.Buffer) {
+	for _, c := range collectors {
+		go func(c Collector) {
+			ticker := time.NewTicker(c.Interval())
+			defer ticker.Stop()
+
+			for {
+				metrics, err := c.Collect(ctx)
+				if err != nil {
+					sugar.Errorw("Collector failed", "collector", c.Name(), "err", err)
+				}
+				buf.Add(metrics)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(c)
+	}
+}
+
+// intervalOrDefault returns interval, or fallback if no interval was configured
+func intervalOrDefault(interval, fallback time.Duration) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+	return fallback
+}
@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/buffer"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/selfstats"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+)
+
+func TestParseSettings(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		expected []Settings
+		wantErr  bool
+	}{
+		{spec: "runtime,random", expected: []Settings{{Name: "runtime"}, {Name: "random"}}},
+		{spec: " runtime:5 , self:0.5,", expected: []Settings{{Name: "runtime", Interval: 5 * time.Second}, {Name: "self", Interval: 500 * time.Millisecond}}},
+		{spec: "", expected: nil},
+		{spec: "runtime:abc", wantErr: true},
+		{spec: "runtime:0", wantErr: true},
+		{spec: "runtime:1e-10", wantErr: true},
+		{spec: "runtime,runtime:2", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			settings, err := ParseSettings(tc.spec)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, settings)
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	cfg := &config.Config{PollInterval: 2 * time.Second, ReportInterval: 10 * time.Second}
+	env := Env{Cfg: cfg, Sugar: zap.NewNop().Sugar(), Stats: selfstats.New(nil)}
+
+	cfg.Collectors = "runtime,random:7,self"
+	collectors, err := Build(env)
+	require.NoError(t, err)
+	require.Len(t, collectors, 3)
+
+	assert.Equal(t, "runtime", collectors[0].Name())
+	assert.Equal(t, 2*time.Second, collectors[0].Interval())
+	assert.Equal(t, 7*time.Second, collectors[1].Interval())
+	assert.Equal(t, 10*time.Second, collectors[2].Interval())
+
+	cfg.Collectors = "runtime,unknown"
+	_, err = Build(env)
+	assert.Error(t, err)
+
+	cfg.Collectors = "runtime"
+	cfg.PollInterval = 0
+	_, err = Build(env)
+	assert.Error(t, err, "a collector without an interval would panic in time.NewTicker")
+}
+
+func TestRun(t *testing.T) {
+	cfg := &config.Config{PollInterval: time.Hour, Collectors: "runtime,random"}
+	collectors, err := Build(Env{Cfg: cfg})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := buffer.New()
+	Run(ctx, zap.NewNop().Sugar(), collectors, buf)
+
+	// every collector collects once right away
+	names := make(map[string]string)
+	require.Eventually(t, func() bool {
+		for _, m := range buf.Drain() {
+			names[m.ID] = m.MType
+		}
+		return names["RandomValue"] != "" && names["Alloc"] != ""
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, constants.MetricTypeGauge, names["Alloc"])
+	assert.Equal(t, constants.MetricTypeGauge, names["RandomValue"])
+	assert.Equal(t, constants.MetricTypeCounter, names["PollCount"])
+}
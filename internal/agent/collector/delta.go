@@ -0,0 +1,46 @@
+package collector
+
+import "sync"
+
+// deltaTracker turns monotonic totals read from an external source into counter deltas
+// the first observation of a key only records a baseline, and a total lower than the previous one
+// is treated as a reset of the source, so the whole new total is reported
+type deltaTracker struct {
+	last map[string]int64
+	mu   sync.Mutex
+}
+
+func newDeltaTracker() *deltaTracker {
+	return &deltaTracker{last: make(map[string]int64)}
+}
+
+// delta records total for key and returns the increase since the previous observation,
+// ok is false when there is no previous observation to compare with
+func (t *deltaTracker) delta(key string, total int64) (delta int64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev, seen := t.last[key]
+	t.last[key] = total
+
+	if !seen {
+		return 0, false
+	}
+	if total < prev {
+		return total, true
+	}
+	return total - prev, true
+}
+
+// forget drops the baselines of all keys for which keep returns false,
+// so that series which disappeared from the source do not accumulate
+func (t *deltaTracker) forget(keep func(key string) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key := range t.last {
+		if !keep(key) {
+			delete(t.last, key)
+		}
+	}
+}
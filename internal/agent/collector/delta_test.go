@@ -0,0 +1,38 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaTracker(t *testing.T) {
+	tracker := newDeltaTracker()
+
+	steps := []struct {
+		key      string
+		total    int64
+		expected int64
+		ok       bool
+	}{
+		{key: "a", total: 10, ok: false},
+		{key: "a", total: 15, expected: 5, ok: true},
+		{key: "b", total: 3, ok: false},
+		{key: "a", total: 15, expected: 0, ok: true},
+		{key: "a", total: 4, expected: 4, ok: true},
+		{key: "b", total: 7, expected: 4, ok: true},
+	}
+
+	for i, step := range steps {
+		delta, ok := tracker.delta(step.key, step.total)
+		assert.Equal(t, step.ok, ok, "step %d", i)
+		assert.Equal(t, step.expected, delta, "step %d", i)
+	}
+
+	tracker.forget(func(key string) bool { return key != "a" })
+	_, ok := tracker.delta("a", 20)
+	assert.False(t, ok, "a forgotten key starts from a new baseline")
+	delta, ok := tracker.delta("b", 9)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), delta)
+}
@@ -0,0 +1,188 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+func init() {
+	Register("exec", newExecCollector)
+}
+
+// execWaitDelay bounds how long a command's output pipes are drained after it was killed,
+// so that background processes started by a script cannot keep the collector waiting
+const execWaitDelay = time.Second
+
+// execCollector runs shell commands and reports the metrics they print
+// every command runs concurrently with its own timeout, and a failing command does not
+// affect the metrics reported by the others
+type execCollector struct {
+	commands []string
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func newExecCollector(env Env, interval time.Duration) (Collector, error) {
+	if env.Cfg.ExecConfig == "" {
+		return nil, errors.New("no exec config file configured")
+	}
+
+	commands, err := readExecConfig(env.Cfg.ExecConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &execCollector{
+		commands: commands,
+		interval: intervalOrDefault(interval, env.Cfg.ReportInterval),
+		timeout:  env.Cfg.ExecTimeout,
+	}, nil
+}
+
+// readExecConfig reads one shell command per line, skipping empty lines and '#' comments
+func readExecConfig(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+
+	return commands, nil
+}
+
+func (c *execCollector) Name() string {
+	return "exec"
+}
+
+func (c *execCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *execCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	results := make([][]models.Metrics, len(c.commands))
+	errs := make([]error, len(c.commands))
+
+	var wg sync.WaitGroup
+	for i, command := range c.commands {
+		wg.Add(1)
+		go func(i int, command string) {
+			defer wg.Done()
+
+			metrics, err := c.run(ctx, command)
+			if err != nil {
+				errs[i] = fmt.Errorf("command %q: %w", command, err)
+				return
+			}
+			results[i] = metrics
+		}(i, command)
+	}
+	wg.Wait()
+
+	var metrics []models.Metrics
+	for _, result := range results {
+		metrics = append(metrics, result...)
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+// run executes a single command with the collector timeout and parses its standard output
+func (c *execCollector) run(ctx context.Context, command string) ([]models.Metrics, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.WaitDelay = execWaitDelay
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseExecOutput(out)
+}
+
+// parseExecOutput parses command output either as a JSON array of metrics or as lines of
+// 'type name value', where the value of a counter is the delta to add; empty lines and '#' comments are skipped
+func parseExecOutput(out []byte) ([]models.Metrics, error) {
+	out = bytes.TrimSpace(out)
+
+	if bytes.HasPrefix(out, []byte("[")) {
+		var metrics []models.Metrics
+		if err := json.Unmarshal(out, &metrics); err != nil {
+			return nil, err
+		}
+		for _, metric := range metrics {
+			if err := metric.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		return metrics, nil
+	}
+
+	var metrics []models.Metrics
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 'type name value', got %q", lineNo, line)
+		}
+
+		metric := models.Metrics{MType: fields[0], ID: fields[1]}
+		switch metric.MType {
+		case constants.MetricTypeGauge:
+			value, err := utils.ParseFloat(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			metric.Value = &value
+		case constants.MetricTypeCounter:
+			delta, err := utils.ParseInt(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			metric.Delta = &delta
+		default:
+			return nil, fmt.Errorf("line %d: unknown metric type: %s", lineNo, metric.MType)
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, scanner.Err()
+}
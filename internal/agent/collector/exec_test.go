@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+func TestParseExecOutput(t *testing.T) {
+	value := 12.5
+	delta := int64(3)
+
+	testCases := []struct {
+		name     string
+		out      string
+		expected []models.Metrics
+		wantErr  bool
+	}{
+		{
+			name: "text",
+			out:  "# queue stats\ngauge QueueDepth 12.5\n\ncounter QueueProcessed 3\n",
+			expected: []models.Metrics{
+				{ID: "QueueDepth", MType: constants.MetricTypeGauge, Value: &value},
+				{ID: "QueueProcessed", MType: constants.MetricTypeCounter, Delta: &delta},
+			},
+		},
+		{
+			name: "json",
+			out:  `[{"id":"QueueDepth","type":"gauge","value":12.5},{"id":"QueueProcessed","type":"counter","delta":3}]`,
+			expected: []models.Metrics{
+				{ID: "QueueDepth", MType: constants.MetricTypeGauge, Value: &value},
+				{ID: "QueueProcessed", MType: constants.MetricTypeCounter, Delta: &delta},
+			},
+		},
+		{name: "empty", out: "  \n", expected: nil},
+		{name: "missing field", out: "gauge QueueDepth", wantErr: true},
+		{name: "bad counter", out: "counter QueueProcessed 1.5", wantErr: true},
+		{name: "unknown type", out: "meter QueueDepth 1", wantErr: true},
+		{name: "invalid json metric", out: `[{"id":"QueueDepth","type":"gauge"}]`, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics, err := parseExecOutput([]byte(tc.out))
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, metrics)
+		})
+	}
+}
+
+func TestExecCollector(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "exec.conf")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+# working commands
+echo "gauge QueueDepth 7"
+printf 'counter Jobs 2\n'
+
+# broken commands must not affect the others
+exit 3
+echo "not a metric"
+sleep 5
+`), 0644))
+
+	cfg := &config.Config{ExecConfig: configPath, ExecTimeout: 200 * time.Millisecond, ReportInterval: time.Second}
+	c, err := newExecCollector(Env{Cfg: cfg}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, c.Interval())
+
+	start := time.Now()
+	metrics, err := c.Collect(context.Background())
+	assert.Less(t, time.Since(start), 3*time.Second)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exit 3")
+	assert.Contains(t, err.Error(), "not a metric")
+	assert.Contains(t, err.Error(), "timed out")
+
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "QueueDepth", metrics[0].ID)
+	assert.Equal(t, 7.0, *metrics[0].Value)
+	assert.Equal(t, "Jobs", metrics[1].ID)
+	assert.Equal(t, int64(2), *metrics[1].Delta)
+}
+
+func TestExecCollectorWithoutConfig(t *testing.T) {
+	_, err := newExecCollector(Env{Cfg: &config.Config{}}, 0)
+	assert.Error(t, err)
+}
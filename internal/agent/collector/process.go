@@ -0,0 +1,373 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+func init() {
+	Register("process", newProcessCollector)
+}
+
+const (
+	// processMetricPrefix starts the names of all process metrics, followed by the process label
+	processMetricPrefix = "process."
+	// clockTicks is the kernel USER_HZ used for CPU times in /proc/<pid>/stat, it is 100 on all common platforms
+	clockTicks = 100
+	// commMaxLen is the length the kernel truncates process names in /proc/<pid>/comm to
+	commMaxLen = 15
+)
+
+// processTarget is a configured process, selected either by name or by a pidfile
+type processTarget struct {
+	label   string
+	name    string
+	pidfile string
+}
+
+// processStats are the values read for a single process
+type processStats struct {
+	startTime  uint64 // in clock ticks since boot, tells a reused PID apart from the original process
+	cpuTicks   int64
+	rss        float64
+	threads    float64
+	fds        float64
+	readBytes  int64
+	writeBytes int64
+	hasIO      bool
+}
+
+// processCollector reports resource usage of other processes on the host
+// all processes matching a target are summed up under the target label; CPU time and I/O bytes
+// are reported as counter deltas tracked per PID and start time, so a restarted process starts a
+// new baseline instead of producing a negative delta
+type processCollector struct {
+	counters  *deltaTracker
+	procRoot  string
+	targets   []processTarget
+	interval  time.Duration
+	collected bool
+}
+
+func newProcessCollector(env Env, interval time.Duration) (Collector, error) {
+	specs := utils.SplitList(env.Cfg.Processes)
+	if len(specs) == 0 {
+		return nil, errors.New("no processes configured")
+	}
+
+	targets := make([]processTarget, 0, len(specs))
+	for _, spec := range specs {
+		targets = append(targets, parseProcessTarget(spec))
+	}
+
+	return &processCollector{
+		counters: newDeltaTracker(),
+		procRoot: "/proc",
+		targets:  targets,
+		interval: intervalOrDefault(interval, env.Cfg.PollInterval),
+	}, nil
+}
+
+// parseProcessTarget treats a spec containing a path separator as a pidfile, labelled with the file name
+// without its extension, and any other spec as a process name
+func parseProcessTarget(spec string) processTarget {
+	if !strings.Contains(spec, "/") {
+		return processTarget{label: spec, name: spec}
+	}
+
+	base := filepath.Base(spec)
+	return processTarget{label: strings.TrimSuffix(base, filepath.Ext(base)), pidfile: spec}
+}
+
+func (c *processCollector) Name() string {
+	return "process"
+}
+
+func (c *processCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *processCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	var errs []error
+	seen := make(map[string]bool)
+
+	for _, target := range c.targets {
+		pids, err := c.findPIDs(target)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("process %s: %w", target.label, err))
+			continue
+		}
+
+		var total processStats
+		var cpuDelta, readDelta, writeDelta int64
+		count := 0
+
+		for _, pid := range pids {
+			stats, err := c.readProcess(pid)
+			if errors.Is(err, os.ErrNotExist) {
+				// the process exited while it was being read
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("process %s (pid %d): %w", target.label, pid, err))
+				continue
+			}
+
+			count++
+			total.rss += stats.rss
+			total.threads += stats.threads
+			total.fds += stats.fds
+
+			key := fmt.Sprintf("%s/%d/%d/", target.label, pid, stats.startTime)
+			cpuDelta += c.delta(seen, key+"cpu", stats.cpuTicks*1000/clockTicks)
+			if stats.hasIO {
+				readDelta += c.delta(seen, key+"read", stats.readBytes)
+				writeDelta += c.delta(seen, key+"write", stats.writeBytes)
+			}
+		}
+
+		prefix := processMetricPrefix + target.label + "."
+		gauges := []struct {
+			name  string
+			value float64
+		}{
+			{"Count", float64(count)},
+			{"RSS", total.rss},
+			{"Threads", total.threads},
+			{"OpenFDs", total.fds},
+		}
+		for _, g := range gauges {
+			value := g.value
+			metrics = append(metrics, models.Metrics{ID: prefix + g.name, MType: constants.MetricTypeGauge, Value: &value})
+		}
+
+		counters := []struct {
+			name  string
+			delta int64
+		}{
+			{"CPUTimeMs", cpuDelta},
+			{"ReadBytes", readDelta},
+			{"WriteBytes", writeDelta},
+		}
+		for _, cnt := range counters {
+			if cnt.delta == 0 {
+				continue
+			}
+			delta := cnt.delta
+			metrics = append(metrics, models.Metrics{ID: prefix + cnt.name, MType: constants.MetricTypeCounter, Delta: &delta})
+		}
+	}
+
+	c.counters.forget(func(key string) bool { return seen[key] })
+	c.collected = true
+
+	return metrics, errors.Join(errs...)
+}
+
+// delta returns the counter delta for key; a process first seen after the initial collection
+// has started since then, so its whole total is new
+func (c *processCollector) delta(seen map[string]bool, key string, total int64) int64 {
+	seen[key] = true
+
+	delta, ok := c.counters.delta(key, total)
+	if !ok && c.collected {
+		return total
+	}
+	return delta
+}
+
+// findPIDs returns the PIDs of the processes matching target in ascending order
+// a missing pidfile or a pidfile pointing to a process that is gone yields no PIDs, not an error
+func (c *processCollector) findPIDs(target processTarget) ([]int, error) {
+	if target.pidfile != "" {
+		data, err := os.ReadFile(target.pidfile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("invalid pidfile %s", target.pidfile)
+		}
+		return []int{pid}, nil
+	}
+
+	entries, err := os.ReadDir(c.procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	name := target.name
+	if len(name) > commMaxLen {
+		name = name[:commMaxLen]
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		comm, err := os.ReadFile(filepath.Join(c.procRoot, entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+
+	return pids, nil
+}
+
+// readProcess reads stat, status, io and fd of a single process
+// io and fd are skipped if they are not readable, which is the case for processes of other users
+func (c *processCollector) readProcess(pid int) (processStats, error) {
+	dir := filepath.Join(c.procRoot, strconv.Itoa(pid))
+
+	var stats processStats
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return stats, err
+	}
+	if err := parseProcStat(stat, &stats); err != nil {
+		return stats, err
+	}
+
+	status, err := os.ReadFile(filepath.Join(dir, "status"))
+	if err != nil {
+		return stats, err
+	}
+	if err := parseProcStatus(status, &stats); err != nil {
+		return stats, err
+	}
+
+	if ioData, err := os.ReadFile(filepath.Join(dir, "io")); err == nil {
+		if err := parseProcIO(ioData, &stats); err != nil {
+			return stats, err
+		}
+	} else if !errors.Is(err, os.ErrPermission) {
+		return stats, err
+	}
+
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		stats.fds = float64(len(fds))
+	} else if !errors.Is(err, os.ErrPermission) {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// parseProcStat reads utime, stime and starttime from /proc/<pid>/stat
+// the process name in parentheses may contain spaces, so fields are counted from the last ')'
+func parseProcStat(data []byte, stats *processStats) error {
+	end := bytes.LastIndexByte(data, ')')
+	if end == -1 {
+		return errors.New("malformed stat")
+	}
+
+	// fields[0] is the state, the third field of the file
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return errors.New("malformed stat")
+	}
+
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed stat utime: %w", err)
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed stat stime: %w", err)
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed stat starttime: %w", err)
+	}
+
+	stats.cpuTicks = utime + stime
+	stats.startTime = startTime
+	return nil
+}
+
+// parseProcStatus reads VmRSS and Threads from /proc/<pid>/status, kernel threads have no VmRSS
+func parseProcStatus(data []byte, stats *processStats) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch key {
+		case "VmRSS":
+			kb, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return fmt.Errorf("malformed status VmRSS: %w", err)
+			}
+			stats.rss = kb * 1024
+		case "Threads":
+			threads, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return fmt.Errorf("malformed status Threads: %w", err)
+			}
+			stats.threads = threads
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseProcIO reads read_bytes and write_bytes, the bytes actually fetched from and sent to storage
+func parseProcIO(data []byte, stats *processStats) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		var target *int64
+		switch key {
+		case "read_bytes":
+			target = &stats.readBytes
+		case "write_bytes":
+			target = &stats.writeBytes
+		default:
+			continue
+		}
+
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed io %s: %w", key, err)
+		}
+		*target = n
+	}
+	stats.hasIO = true
+
+	return scanner.Err()
+}
@@ -0,0 +1,123 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// writeFakeProcess creates /proc/<pid> files of a process in root
+func writeFakeProcess(t *testing.T, root string, pid int, comm string, startTime, cpuTicks, readBytes int64, fds int) {
+	t.Helper()
+
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "fd"), 0755))
+
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d 0 -1 4194560 100 0 0 0 %d %d 0 0 20 0 4 0 %d 1000 200\n",
+		pid, comm, pid, pid, cpuTicks, cpuTicks, startTime)
+	files := map[string]string{
+		"comm":   comm + "\n",
+		"stat":   stat,
+		"status": "Name:\t" + comm + "\nThreads:\t4\nVmRSS:\t    2048 kB\n",
+		"io":     fmt.Sprintf("rchar: 1\nwchar: 2\nread_bytes: %d\nwrite_bytes: 0\n", readBytes),
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	for i := 0; i < fds; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "fd", strconv.Itoa(i)), nil, 0644))
+	}
+}
+
+// metricsByName formats metrics as 'type value' keyed by metric name
+func metricsByName(metrics []models.Metrics) map[string]string {
+	result := make(map[string]string)
+	for _, m := range metrics {
+		if m.MType == constants.MetricTypeCounter {
+			result[m.ID] = fmt.Sprintf("counter %d", *m.Delta)
+		} else {
+			result[m.ID] = fmt.Sprintf("gauge %g", *m.Value)
+		}
+	}
+	return result
+}
+
+func TestProcessCollector(t *testing.T) {
+	root := t.TempDir()
+	pidfile := filepath.Join(t.TempDir(), "db.pid")
+
+	writeFakeProcess(t, root, 100, "web server", 5000, 50, 4096, 3)
+	writeFakeProcess(t, root, 101, "web server", 5001, 10, 0, 2)
+	writeFakeProcess(t, root, 200, "other", 6000, 1, 0, 1)
+	require.NoError(t, os.WriteFile(pidfile, []byte("200\n"), 0644))
+
+	cfg := &config.Config{Processes: "web server," + pidfile + ",missing"}
+	c, err := newProcessCollector(Env{Cfg: cfg}, 0)
+	require.NoError(t, err)
+	c.(*processCollector).procRoot = root
+
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"process.web server.Count":   "gauge 2",
+		"process.web server.RSS":     "gauge 4.194304e+06",
+		"process.web server.Threads": "gauge 8",
+		"process.web server.OpenFDs": "gauge 5",
+		"process.db.Count":           "gauge 1",
+		"process.db.RSS":             "gauge 2.097152e+06",
+		"process.db.Threads":         "gauge 4",
+		"process.db.OpenFDs":         "gauge 1",
+		"process.missing.Count":      "gauge 0",
+		"process.missing.RSS":        "gauge 0",
+		"process.missing.Threads":    "gauge 0",
+		"process.missing.OpenFDs":    "gauge 0",
+	}, metricsByName(metrics), "the first collection only sets the counter baselines")
+
+	// pid 100 keeps running, pid 101 was restarted as pid 102
+	writeFakeProcess(t, root, 100, "web server", 5000, 60, 8192, 3)
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "101")))
+	writeFakeProcess(t, root, 102, "web server", 7000, 5, 100, 2)
+
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	byName := metricsByName(metrics)
+	assert.Equal(t, "counter 300", byName["process.web server.CPUTimeMs"], "(60-50)*2 ticks of pid 100 and 5*2 ticks of the new pid 102")
+	assert.Equal(t, "counter 4196", byName["process.web server.ReadBytes"])
+	assert.Equal(t, "gauge 2", byName["process.web server.Count"])
+	assert.NotContains(t, byName, "process.db.CPUTimeMs")
+
+	// a reused pid with a different start time is a new process
+	writeFakeProcess(t, root, 200, "other", 9000, 1, 0, 1)
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "counter 20", metricsByName(metrics)["process.db.CPUTimeMs"])
+}
+
+func TestParseProcStat(t *testing.T) {
+	var stats processStats
+	stat := "42 (a (weird) name) R 1 42 42 0 -1 4194560 100 0 0 0 7 3 0 0 20 0 1 0 12345 1000 200\n"
+	require.NoError(t, parseProcStat([]byte(stat), &stats))
+	assert.Equal(t, int64(10), stats.cpuTicks)
+	assert.Equal(t, uint64(12345), stats.startTime)
+
+	assert.Error(t, parseProcStat([]byte("42 (name) R 1 2"), &stats))
+}
+
+func TestNewProcessCollector(t *testing.T) {
+	_, err := newProcessCollector(Env{Cfg: &config.Config{}}, 0)
+	assert.Error(t, err)
+
+	assert.Equal(t, processTarget{label: "nginx", name: "nginx"}, parseProcessTarget("nginx"))
+	assert.Equal(t, processTarget{label: "postgres", pidfile: "/run/postgres.pid"}, parseProcessTarget("/run/postgres.pid"))
+}
@@ -0,0 +1,368 @@
+package collector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+func init() {
+	Register("prometheus", newPrometheusCollector)
+}
+
+// promAcceptHeader asks for the text exposition format, which is the only one the collector parses
+const promAcceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// promSample is a single parsed series of the text exposition format
+type promSample struct {
+	name  string // flattened series name, e.g. http_requests_total{code=200,method=get}
+	mType string // Prometheus type of the metric family: counter, gauge, histogram, summary or untyped
+	value float64
+}
+
+// prometheusCollector scrapes Prometheus endpoints
+// counters, and the _count and _bucket series of histograms and summaries, are reported as
+// deltas between two scrapes; counter deltas are whole numbers, so the _sum series and counters
+// that have had a fractional value, such as *_seconds_total, are reported as gauges of their
+// total instead; everything else is reported as a gauge
+type prometheusCollector struct {
+	client     *http.Client
+	allow      *regexp.Regexp
+	deny       *regexp.Regexp
+	counters   *deltaTracker
+	fractional map[string]bool // cumulative series that had a fractional value, by key
+	prefix     string
+	targets    []string
+	maxBody    int64
+	interval   time.Duration
+	mu         sync.Mutex
+}
+
+func newPrometheusCollector(env Env, interval time.Duration) (Collector, error) {
+	targets := utils.SplitList(env.Cfg.PromTargets)
+	if len(targets) == 0 {
+		return nil, errors.New("no Prometheus targets configured")
+	}
+
+	c := &prometheusCollector{
+		counters:   newDeltaTracker(),
+		fractional: make(map[string]bool),
+		prefix:     env.Cfg.PromPrefix,
+		targets:    targets,
+		maxBody:    env.Cfg.MaxBodySize,
+		interval:   intervalOrDefault(interval, env.Cfg.ReportInterval),
+	}
+	c.client = &http.Client{Timeout: c.interval}
+
+	var err error
+	if env.Cfg.PromAllow != "" {
+		if c.allow, err = regexp.Compile(env.Cfg.PromAllow); err != nil {
+			return nil, fmt.Errorf("invalid allow pattern: %w", err)
+		}
+	}
+	if env.Cfg.PromDeny != "" {
+		if c.deny, err = regexp.Compile(env.Cfg.PromDeny); err != nil {
+			return nil, fmt.Errorf("invalid deny pattern: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *prometheusCollector) Name() string {
+	return "prometheus"
+}
+
+func (c *prometheusCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *prometheusCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	results := make([][]models.Metrics, len(c.targets))
+	errs := make([]error, len(c.targets))
+
+	var wg sync.WaitGroup
+	for i, target := range c.targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+
+			samples, err := c.scrape(ctx, target)
+			if err != nil {
+				errs[i] = fmt.Errorf("target %s: %w", target, err)
+				return
+			}
+			results[i] = c.convert(target, samples)
+		}(i, target)
+	}
+	wg.Wait()
+
+	var metrics []models.Metrics
+	for _, result := range results {
+		metrics = append(metrics, result...)
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+// scrape fetches and parses a single target
+func (c *prometheusCollector) scrape(ctx context.Context, target string) ([]promSample, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", promAcceptHeader)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// a larger exposition fails the scrape rather than being parsed partially
+	var body io.Reader = resp.Body
+	if c.maxBody > 0 {
+		body = http.MaxBytesReader(nil, resp.Body, c.maxBody)
+	}
+
+	return parsePromText(body)
+}
+
+// convert filters the samples of a target and turns them into metrics
+// counter baselines are kept per target, so equal series of different targets do not interfere
+func (c *prometheusCollector) convert(target string, samples []promSample) []models.Metrics {
+	keyPrefix := target + "\x00"
+	seen := make(map[string]bool, len(samples))
+
+	var metrics []models.Metrics
+	for _, sample := range samples {
+		if c.allow != nil && !c.allow.MatchString(sample.name) {
+			continue
+		}
+		if c.deny != nil && c.deny.MatchString(sample.name) {
+			continue
+		}
+		if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+			continue
+		}
+
+		name := c.prefix + sample.name
+		key := keyPrefix + sample.name
+
+		if !isPromCumulative(sample) || c.isFractional(key, sample) {
+			seen[key] = true
+			value := sample.value
+			metrics = append(metrics, models.Metrics{ID: name, MType: constants.MetricTypeGauge, Value: &value})
+			continue
+		}
+
+		seen[key] = true
+
+		delta, ok := c.counters.delta(key, int64(sample.value))
+		if !ok || delta == 0 {
+			continue
+		}
+		metrics = append(metrics, models.Metrics{ID: name, MType: constants.MetricTypeCounter, Delta: &delta})
+	}
+
+	keep := func(key string) bool {
+		return !strings.HasPrefix(key, keyPrefix) || seen[key]
+	}
+	c.counters.forget(keep)
+
+	c.mu.Lock()
+	for key := range c.fractional {
+		if !keep(key) {
+			delete(c.fractional, key)
+		}
+	}
+	c.mu.Unlock()
+
+	return metrics
+}
+
+// isFractional reports whether a cumulative sample is reported as a gauge because its values are not whole numbers:
+// _sum series always are, and a series stays one once it had a fractional value, so that it does not switch types
+func (c *prometheusCollector) isFractional(key string, sample promSample) bool {
+	base, _, _ := strings.Cut(sample.name, "{")
+	if sample.mType != "counter" && strings.HasSuffix(base, "_sum") {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sample.value != math.Trunc(sample.value) {
+		c.fractional[key] = true
+	}
+	return c.fractional[key]
+}
+
+// isPromCumulative reports whether a sample only ever grows until its source restarts
+func isPromCumulative(sample promSample) bool {
+	switch sample.mType {
+	case "counter":
+		return true
+	case "histogram", "summary":
+		base, _, _ := strings.Cut(sample.name, "{")
+		return strings.HasSuffix(base, "_count") || strings.HasSuffix(base, "_sum") || strings.HasSuffix(base, "_bucket")
+	}
+	return false
+}
+
+// parsePromText parses the Prometheus text exposition format
+// labels are flattened into the name in alphabetical order and timestamps are ignored
+func parsePromText(r io.Reader) ([]promSample, error) {
+	types := make(map[string]string)
+
+	var samples []promSample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		base, name, rest, err := parsePromSeries(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		valueFields := strings.Fields(rest)
+		if len(valueFields) == 0 || len(valueFields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a value and an optional timestamp, got %q", lineNo, rest)
+		}
+
+		value, err := utils.ParseFloat(valueFields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		samples = append(samples, promSample{name: name, mType: promFamilyType(types, base), value: value})
+	}
+
+	return samples, scanner.Err()
+}
+
+// promFamilyType returns the declared type of the family a series belongs to,
+// histogram, summary and counter series may carry a suffix after the family name
+func promFamilyType(types map[string]string, base string) string {
+	if t, ok := types[base]; ok {
+		return t
+	}
+
+	for _, suffix := range []string{"_bucket", "_count", "_sum", "_total"} {
+		if t, ok := types[strings.TrimSuffix(base, suffix)]; ok && strings.HasSuffix(base, suffix) {
+			return t
+		}
+	}
+
+	return "untyped"
+}
+
+// parsePromSeries splits a sample line into the metric name, the flattened series name and the rest of the line
+func parsePromSeries(line string) (base, name, rest string, err error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end == -1 {
+		return "", "", "", fmt.Errorf("missing value in %q", line)
+	}
+
+	base = line[:end]
+	if base == "" {
+		return "", "", "", fmt.Errorf("missing metric name in %q", line)
+	}
+
+	if line[end] != '{' {
+		return base, base, line[end:], nil
+	}
+
+	labels, n, err := parsePromLabels(line[end+1:])
+	if err != nil {
+		return "", "", "", err
+	}
+	if len(labels) == 0 {
+		return base, base, line[end+1+n:], nil
+	}
+
+	sort.Strings(labels)
+	return base, base + "{" + strings.Join(labels, ",") + "}", line[end+1+n:], nil
+}
+
+// parsePromLabels parses the label pairs following an opening brace into 'name=value' strings
+// and returns the number of bytes consumed including the closing brace
+func parsePromLabels(s string) ([]string, int, error) {
+	var labels []string
+	i := 0
+
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, errors.New("unterminated label set")
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		eq := strings.IndexByte(s[i:], '=')
+		if eq == -1 {
+			return nil, 0, fmt.Errorf("missing '=' in labels %q", s)
+		}
+		label := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i >= len(s) || s[i] != '"' {
+			return nil, 0, fmt.Errorf("label %s has an unquoted value", label)
+		}
+		i++
+
+		var value strings.Builder
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("label %s has an unterminated value", label)
+		}
+		i++
+
+		labels = append(labels, label+"="+value.String())
+	}
+}
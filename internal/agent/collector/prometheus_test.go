@@ -0,0 +1,157 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+)
+
+func TestParsePromText(t *testing.T) {
+	text := `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{code="400", method="post"} 3
+# TYPE queue_depth gauge
+queue_depth 12.5
+# TYPE rpc_duration_seconds histogram
+rpc_duration_seconds_bucket{le="0.5"} 4
+rpc_duration_seconds_sum 1.5
+rpc_duration_seconds_count 4
+# TYPE build_info untyped
+build_info{version="1.2 \"beta\", rc1"} 1
+temperature +Inf
+`
+
+	samples, err := parsePromText(strings.NewReader(text))
+	require.NoError(t, err)
+
+	assert.Equal(t, []promSample{
+		{name: "http_requests_total{code=200,method=post}", mType: "counter", value: 1027},
+		{name: "http_requests_total{code=400,method=post}", mType: "counter", value: 3},
+		{name: "queue_depth", mType: "gauge", value: 12.5},
+		{name: "rpc_duration_seconds_bucket{le=0.5}", mType: "histogram", value: 4},
+		{name: "rpc_duration_seconds_sum", mType: "histogram", value: 1.5},
+		{name: "rpc_duration_seconds_count", mType: "histogram", value: 4},
+		{name: `build_info{version=1.2 "beta", rc1}`, mType: "untyped", value: 1},
+		{name: "temperature", mType: "untyped", value: math.Inf(1)},
+	}, samples)
+}
+
+func TestParsePromTextErrors(t *testing.T) {
+	for _, text := range []string{
+		"queue_depth",
+		"queue_depth abc",
+		`queue_depth{le="0.5" 1`,
+		`queue_depth{le=0.5} 1`,
+		"queue_depth 1 2 3",
+	} {
+		_, err := parsePromText(strings.NewReader(text))
+		assert.Error(t, err, text)
+	}
+}
+
+// describe collects once from c and describes the metrics by name
+func describe(t *testing.T, c Collector) map[string]string {
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+
+	result := make(map[string]string)
+	for _, m := range metrics {
+		if m.MType == constants.MetricTypeCounter {
+			result[m.ID] = fmt.Sprintf("counter %d", *m.Delta)
+		} else {
+			result[m.ID] = fmt.Sprintf("gauge %g", *m.Value)
+		}
+	}
+	return result
+}
+
+func TestPrometheusCollector(t *testing.T) {
+	var scrape atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the third scrape simulates a restart of the exporter
+		requests := map[int64]float64{1: 100, 2: 107, 3: 5}[scrape.Add(1)]
+		fmt.Fprintf(w, "# TYPE requests_total counter\nrequests_total %g\n", requests)
+		fmt.Fprintf(w, "# TYPE queue_depth gauge\nqueue_depth 3\n")
+		fmt.Fprintf(w, "# TYPE go_goroutines gauge\ngo_goroutines 8\n")
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		PromTargets:    ts.URL + ", ",
+		PromPrefix:     "app.",
+		PromDeny:       "^go_",
+		ReportInterval: time.Second,
+	}
+	c, err := newPrometheusCollector(Env{Cfg: cfg}, 0)
+	require.NoError(t, err)
+
+	collect := func() map[string]string { return describe(t, c) }
+
+	assert.Equal(t, map[string]string{"app.queue_depth": "gauge 3"}, collect(), "the first scrape sets the counter baseline")
+	assert.Equal(t, map[string]string{"app.queue_depth": "gauge 3", "app.requests_total": "counter 7"}, collect())
+	assert.Equal(t, map[string]string{"app.queue_depth": "gauge 3", "app.requests_total": "counter 5"}, collect())
+}
+
+func TestPrometheusCollectorFractional(t *testing.T) {
+	var scrape atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := float64(scrape.Add(1))
+		fmt.Fprintf(w, "# TYPE cpu_seconds_total counter\ncpu_seconds_total %g\n", map[float64]float64{1: 2, 2: 2.25, 3: 3}[n])
+		fmt.Fprintf(w, "# TYPE rpc_seconds histogram\nrpc_seconds_sum %g\nrpc_seconds_count %g\n", 0.5*n, 2*n)
+	}))
+	defer ts.Close()
+
+	c, err := newPrometheusCollector(Env{Cfg: &config.Config{PromTargets: ts.URL, ReportInterval: time.Second}}, 0)
+	require.NoError(t, err)
+
+	collect := func() map[string]string { return describe(t, c) }
+
+	assert.Equal(t, map[string]string{"rpc_seconds_sum": "gauge 0.5"}, collect())
+	assert.Equal(t, map[string]string{"rpc_seconds_sum": "gauge 1", "rpc_seconds_count": "counter 2", "cpu_seconds_total": "gauge 2.25"}, collect())
+	assert.Equal(t, map[string]string{"rpc_seconds_sum": "gauge 1.5", "rpc_seconds_count": "counter 2", "cpu_seconds_total": "gauge 3"}, collect(),
+		"a counter that had a fractional value stays a gauge")
+}
+
+func TestPrometheusCollectorErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	_, err := newPrometheusCollector(Env{Cfg: &config.Config{}}, 0)
+	assert.Error(t, err)
+
+	_, err = newPrometheusCollector(Env{Cfg: &config.Config{PromTargets: ts.URL, PromAllow: "("}}, 0)
+	assert.Error(t, err)
+
+	c, err := newPrometheusCollector(Env{Cfg: &config.Config{PromTargets: ts.URL, ReportInterval: time.Second}}, 0)
+	require.NoError(t, err)
+	_, err = c.Collect(context.Background())
+	assert.ErrorContains(t, err, "503")
+
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(w, "queue_depth_%d %d\n", i, i)
+		}
+	}))
+	defer large.Close()
+
+	c, err = newPrometheusCollector(Env{Cfg: &config.Config{PromTargets: large.URL, ReportInterval: time.Second, MaxBodySize: 256}}, 0)
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background())
+	assert.Error(t, err, "an exposition larger than the body limit fails the scrape")
+	assert.Empty(t, metrics)
+}
@@ -0,0 +1,36 @@
+package collector
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+func init() {
+	Register("random", newRandomCollector)
+}
+
+// randomCollector reports a random gauge in RandomValue
+type randomCollector struct {
+	interval time.Duration
+}
+
+func newRandomCollector(env Env, interval time.Duration) (Collector, error) {
+	return &randomCollector{interval: intervalOrDefault(interval, env.Cfg.PollInterval)}, nil
+}
+
+func (c *randomCollector) Name() string {
+	return "random"
+}
+
+func (c *randomCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *randomCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	value := rand.Float64()
+	return []models.Metrics{{ID: "RandomValue", MType: constants.MetricTypeGauge, Value: &value}}, nil
+}
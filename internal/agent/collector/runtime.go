@@ -0,0 +1,81 @@
+package collector
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+func init() {
+	Register("runtime", newRuntimeCollector)
+}
+
+// runtimeCollector reports runtime.MemStats gauges and counts its own polls in PollCount
+type runtimeCollector struct {
+	interval time.Duration
+}
+
+func newRuntimeCollector(env Env, interval time.Duration) (Collector, error) {
+	return &runtimeCollector{interval: intervalOrDefault(interval, env.Cfg.PollInterval)}, nil
+}
+
+func (c *runtimeCollector) Name() string {
+	return "runtime"
+}
+
+func (c *runtimeCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *runtimeCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	gauges := collectMemoryMetrics()
+
+	result := make([]models.Metrics, 0, len(gauges)+1)
+	for name, value := range gauges {
+		localValue := value
+		result = append(result, models.Metrics{ID: name, MType: constants.MetricTypeGauge, Value: &localValue})
+	}
+
+	pollCount := int64(1)
+	result = append(result, models.Metrics{ID: "PollCount", MType: constants.MetricTypeCounter, Delta: &pollCount})
+
+	return result, nil
+}
+
+func collectMemoryMetrics() map[string]float64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return map[string]float64{
+		"Alloc":         float64(m.Alloc),
+		"BuckHashSys":   float64(m.BuckHashSys),
+		"Frees":         float64(m.Frees),
+		"GCCPUFraction": float64(m.GCCPUFraction),
+		"GCSys":         float64(m.GCSys),
+		"HeapAlloc":     float64(m.HeapAlloc),
+		"HeapIdle":      float64(m.HeapIdle),
+		"HeapInuse":     float64(m.HeapInuse),
+		"HeapObjects":   float64(m.HeapObjects),
+		"HeapReleased":  float64(m.HeapReleased),
+		"HeapSys":       float64(m.HeapSys),
+		"LastGC":        float64(m.LastGC),
+		"Lookups":       float64(m.Lookups),
+		"MCacheInuse":   float64(m.MCacheInuse),
+		"MCacheSys":     float64(m.MCacheSys),
+		"MSpanInuse":    float64(m.MSpanInuse),
+		"MSpanSys":      float64(m.MSpanSys),
+		"Mallocs":       float64(m.Mallocs),
+		"NextGC":        float64(m.NextGC),
+		"NumForcedGC":   float64(m.NumForcedGC),
+		"OtherSys":      float64(m.OtherSys),
+		"NumGC":         float64(m.NumGC),
+		"PauseTotalNs":  float64(m.PauseTotalNs),
+		"StackInuse":    float64(m.StackInuse),
+		"StackSys":      float64(m.StackSys),
+		"Sys":           float64(m.Sys),
+		"TotalAlloc":    float64(m.TotalAlloc),
+	}
+}
@@ -0,0 +1,38 @@
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+func init() {
+	Register("self", newSelfCollector)
+}
+
+// selfCollector reports the agent's own operational metrics recorded in selfstats
+type selfCollector struct {
+	env      Env
+	interval time.Duration
+}
+
+func newSelfCollector(env Env, interval time.Duration) (Collector, error) {
+	return &selfCollector{env: env, interval: intervalOrDefault(interval, env.Cfg.ReportInterval)}, nil
+}
+
+func (c *selfCollector) Name() string {
+	return "self"
+}
+
+func (c *selfCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *selfCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	depth := 0
+	if c.env.SpoolDepth != nil {
+		depth = c.env.SpoolDepth()
+	}
+	return c.env.Stats.Collect(depth), nil
+}
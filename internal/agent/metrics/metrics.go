@@ -5,12 +5,12 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"runtime"
+	"time"
 
-	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
-	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/buffer"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/selfstats"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/upstream"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
 	"github.com/go-resty/resty/v2"
@@ -19,116 +19,64 @@ import (
 
 const urlTemplate = "%s/updates"
 
-func UpdateMetrics(pollCount *int64, randomValue *float64) {
-	*pollCount++
-	*randomValue = rand.Float64()
-}
-
-func collectMemoryMetrics() map[string]float64 {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	return map[string]float64{
-		"Alloc":         float64(m.Alloc),
-		"BuckHashSys":   float64(m.BuckHashSys),
-		"Frees":         float64(m.Frees),
-		"GCCPUFraction": float64(m.GCCPUFraction),
-		"GCSys":         float64(m.GCSys),
-		"HeapAlloc":     float64(m.HeapAlloc),
-		"HeapIdle":      float64(m.HeapIdle),
-		"HeapInuse":     float64(m.HeapInuse),
-		"HeapObjects":   float64(m.HeapObjects),
-		"HeapReleased":  float64(m.HeapReleased),
-		"HeapSys":       float64(m.HeapSys),
-		"LastGC":        float64(m.LastGC),
-		"Lookups":       float64(m.Lookups),
-		"MCacheInuse":   float64(m.MCacheInuse),
-		"MCacheSys":     float64(m.MCacheSys),
-		"MSpanInuse":    float64(m.MSpanInuse),
-		"MSpanSys":      float64(m.MSpanSys),
-		"Mallocs":       float64(m.Mallocs),
-		"NextGC":        float64(m.NextGC),
-		"NumForcedGC":   float64(m.NumForcedGC),
-		"OtherSys":      float64(m.OtherSys),
-		"NumGC":         float64(m.NumGC),
-		"PauseTotalNs":  float64(m.PauseTotalNs),
-		"StackInuse":    float64(m.StackInuse),
-		"StackSys":      float64(m.StackSys),
-		"Sys":           float64(m.Sys),
-		"TotalAlloc":    float64(m.TotalAlloc),
-	}
-}
-
-func reportMetrics(sugar *zap.SugaredLogger, url string, client *resty.Client, res []models.Metrics) {
+// sendMetrics gzips the batch and posts it to url, any non-OK response is reported as an error
+// payload sizes and the request outcome are recorded in stats
+func sendMetrics(url string, client *resty.Client, stats *selfstats.Stats, res []models.Metrics) error {
 	jsonData, err := json.Marshal(res)
-
 	if err != nil {
-		sugar.Errorw("JSON marshaling failed", err)
+		return fmt.Errorf("JSON marshaling failed: %w", err)
 	}
 
 	var b bytes.Buffer
 	gz := gzip.NewWriter(&b)
-	if _, gzErr := gz.Write(jsonData); gzErr != nil {
-		sugar.Errorw("Failed to write gzipped JSON data", err)
-		return
+	if _, err := gz.Write(jsonData); err != nil {
+		return fmt.Errorf("failed to write gzipped JSON data: %w", err)
 	}
-	if gzErr := gz.Close(); gzErr != nil {
-		sugar.Errorw("Failed to close gzip writer", err)
-		return
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %w", err)
 	}
+	stats.ObservePayload(len(jsonData), b.Len())
 
+	start := time.Now()
 	resp, err := client.R().
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Content-Encoding", "gzip").
 		SetBody(b.Bytes()).
 		Post(url)
 
-	if err != nil {
-		sugar.Errorw("Error sending request for metric", err)
-		return
+	if err == nil && resp.StatusCode() != http.StatusOK {
+		err = fmt.Errorf("received non-OK response for metrics: %s", resp.Status())
+	} else if err != nil {
+		err = fmt.Errorf("error sending request for metrics: %w", err)
 	}
+	stats.ObserveRequest(time.Since(start), err)
 
-	if resp.StatusCode() != http.StatusOK {
-		sugar.Errorw("Received non-OK response for metric", resp.Status())
-	}
+	return err
 }
 
-func generateMetricURL(addr string) string {
-	return fmt.Sprintf(urlTemplate, utils.EnsureHTTPScheme(addr))
+func generateMetricURL(addr string, secure bool) string {
+	return fmt.Sprintf(urlTemplate, utils.EnsureScheme(addr, secure))
 }
 
-func ReportMetrics(sugar *zap.SugaredLogger, cfg *config.Config, client *resty.Client, randomValue float64, pollCount int64) {
-	url := generateMetricURL(cfg.Addr)
-
-	gauges := collectMemoryMetrics()
-	counters := map[string]int64{
-		"PollCount": pollCount,
+// NewSender returns an upstream.SendFunc that posts batches to the /updates endpoint of a server,
+// addresses without a scheme use https if secure and http otherwise
+func NewSender(client *resty.Client, stats *selfstats.Stats, secure bool) upstream.SendFunc {
+	return func(addr string, batch []models.Metrics) error {
+		return sendMetrics(generateMetricURL(addr, secure), client, stats, batch)
 	}
+}
 
-	var response []models.Metrics
-
-	gauges["RandomValue"] = randomValue
-
-	for name, value := range gauges {
-		localValue := value
-		metric := models.Metrics{
-			ID:    name,
-			MType: constants.MetricTypeGauge,
-			Value: &localValue,
-		}
-
-		response = append(response, metric)
+// ReportMetrics drains the metrics gathered by the collectors since the last report and sends them
+// through the upstream pool; if the batch could be neither delivered nor spooled it is put back
+// into the buffer so it is retried with the next report
+func ReportMetrics(sugar *zap.SugaredLogger, pool *upstream.Pool, buf *buffer.Buffer) {
+	batch := buf.Drain()
+	if len(batch) == 0 {
+		return
 	}
 
-	for name, delta := range counters {
-		localDelta := delta
-		metric := models.Metrics{
-			ID:    name,
-			MType: constants.MetricTypeCounter,
-			Delta: &localDelta,
-		}
-		response = append(response, metric)
+	if err := pool.Deliver(batch); err != nil {
+		sugar.Errorw("Failed to report metrics", "err", err)
+		buf.Restore(batch)
 	}
-
-	reportMetrics(sugar, url, client, response)
 }
@@ -0,0 +1,184 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/buffer"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/gzip"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+// unixPrefix marks a push address that is a Unix socket path rather than a TCP address
+const unixPrefix = "unix:"
+
+// timeouts of the push endpoint; applications push small payloads over a local connection,
+// so a client taking longer than this is stuck rather than slow
+const (
+	readTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// decodeMetric extracts the metric of an /update request, either from a JSON body or from the URL,
+// where a value that cannot be parsed for the metric type is an error
+func decodeMetric(r *http.Request) (models.Metrics, error) {
+	var metric models.Metrics
+
+	if strings.TrimSpace(r.Header.Get("Content-Type")) == constants.ApplicationJSON {
+		err := json.NewDecoder(r.Body).Decode(&metric)
+		return metric, err
+	}
+
+	metric.MType = chi.URLParam(r, "type")
+	metric.ID = chi.URLParam(r, "name")
+	valueStr := chi.URLParam(r, "value")
+
+	switch metric.MType {
+	case constants.MetricTypeGauge:
+		value, err := utils.ParseFloat(valueStr)
+		if err != nil {
+			return metric, fmt.Errorf("invalid value for gauge %s: %s", metric.ID, valueStr)
+		}
+		metric.Value = &value
+	case constants.MetricTypeCounter:
+		delta, err := utils.ParseInt(valueStr)
+		if err != nil {
+			return metric, fmt.Errorf("invalid delta for counter %s: %s", metric.ID, valueStr)
+		}
+		metric.Delta = &delta
+	case constants.MetricTypeSet:
+		if valueStr != "" {
+			metric.Members = []string{valueStr}
+		}
+	}
+
+	return metric, nil
+}
+
+// writeError responds with the status of err, bodies exceeding the size limit are reported as 413
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// handleUpdate adds a single valid metric to buf
+func handleUpdate(buf *buffer.Buffer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metric, err := decodeMetric(r)
+		if err == nil {
+			err = metric.Validate()
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		buf.Add([]models.Metrics{metric})
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handleUpdates adds a JSON array of metrics to buf, the whole batch is rejected if any metric is invalid
+func handleUpdates(buf *buffer.Buffer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		for _, metric := range metrics {
+			if err := metric.Validate(); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+
+		buf.Add(metrics)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// NewHandler returns a router accepting the server's /update and /updates formats
+// the values are aggregated in buf and forwarded with the agent's next report;
+// accepted requests are answered with an empty 200 OK
+func NewHandler(cfg *config.Config, sugar *zap.SugaredLogger, buf *buffer.Buffer) http.Handler {
+	r := chi.NewRouter()
+	r.Use(gzip.WithCompression(sugar))
+	r.Use(middleware.RequestSize(cfg.MaxBodySize))
+
+	r.Route("/update", func(r chi.Router) {
+		r.Post("/{type}/{name}/{value}", handleUpdate(buf))
+		r.Post("/", handleUpdate(buf))
+	})
+
+	r.Route("/updates", func(r chi.Router) {
+		r.Post("/", handleUpdates(buf))
+	})
+
+	return r
+}
+
+// listen opens a TCP listener, or a Unix socket listener for addresses starting with 'unix:'
+// a stale socket file left by a previous run is removed first
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// Start begins listening on cfg.PushAddr and serves the push endpoint in a goroutine
+// the server is shut down when ctx is done
+func Start(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger, buf *buffer.Buffer) error {
+	ln, err := listen(cfg.PushAddr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:      NewHandler(cfg, sugar, buf),
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sugar.Errorw("Push endpoint stopped", "err", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			sugar.Errorw("Failed to shut down push endpoint", "err", err)
+		}
+	}()
+
+	sugar.Infow("Push endpoint listening", "addr", cfg.PushAddr)
+	return nil
+}
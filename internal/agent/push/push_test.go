@@ -0,0 +1,80 @@
+package push
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/buffer"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+func TestPushEndpoint(t *testing.T) {
+	buf := buffer.New()
+	cfg := &config.Config{MaxBodySize: 128}
+	ts := httptest.NewServer(NewHandler(cfg, zap.NewNop().Sugar(), buf))
+	defer ts.Close()
+
+	requests := []struct {
+		path        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"/update/gauge/QueueDepth/3", constants.TextPlain, "", http.StatusOK},
+		{"/update/counter/Jobs/2", constants.TextPlain, "", http.StatusOK},
+		{"/update", constants.ApplicationJSON, `{"id":"QueueDepth","type":"gauge","value":5}`, http.StatusOK},
+		{"/updates", constants.ApplicationJSON, `[{"id":"Jobs","type":"counter","delta":4}]`, http.StatusOK},
+		{"/updates", constants.ApplicationJSON, `[{"id":"Jobs","type":"counter"}]`, http.StatusBadRequest},
+		{"/updates", constants.ApplicationJSON, `[{"id":"Jobs","type":"counter","delta":1},{"id":"Jobs"}]`, http.StatusBadRequest},
+		{"/update/gauge/QueueDepth/abc", constants.TextPlain, "", http.StatusBadRequest},
+		{"/update/histogram/Latency/1", constants.TextPlain, "", http.StatusBadRequest},
+		{"/updates", constants.ApplicationJSON, `[` + strings.Repeat(`{"id":"Jobs","type":"counter","delta":1},`, 10) + `]`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, req := range requests {
+		resp, err := http.Post(ts.URL+req.path, req.contentType, strings.NewReader(req.body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, req.status, resp.StatusCode, req.path)
+	}
+
+	value := 5.0
+	delta := int64(6)
+	assert.Equal(t, []models.Metrics{
+		{ID: "Jobs", MType: constants.MetricTypeCounter, Delta: &delta},
+		{ID: "QueueDepth", MType: constants.MetricTypeGauge, Value: &value},
+	}, buf.Drain())
+}
+
+func TestStartUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	cfg := &config.Config{PushAddr: unixPrefix + socket, MaxBodySize: 1 << 20}
+	buf := buffer.New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, Start(ctx, cfg, zap.NewNop().Sugar(), buf))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	resp, err := client.Post("http://agent/update/counter/Jobs/1", constants.TextPlain, nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, buf.Len())
+}
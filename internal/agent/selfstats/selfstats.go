@@ -0,0 +1,126 @@
+package selfstats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// names of the operational metrics, all of them carry constants.AgentMetricPrefix
+const (
+	BatchesSent      = constants.AgentMetricPrefix + "BatchesSent"
+	BatchesFailed    = constants.AgentMetricPrefix + "BatchesFailed"
+	Retries          = constants.AgentMetricPrefix + "Retries"
+	PayloadBytes     = constants.AgentMetricPrefix + "PayloadBytes"
+	PayloadBytesGzip = constants.AgentMetricPrefix + "PayloadBytesGzip"
+	LastReportAge    = constants.AgentMetricPrefix + "LastReportAge"
+	RequestLatency   = constants.AgentMetricPrefix + "RequestLatency"
+	SpoolDepth       = constants.AgentMetricPrefix + "SpoolDepth"
+	RequestDuration  = constants.AgentMetricPrefix + "RequestDuration"
+)
+
+// Stats accumulates operational metrics of the agent between reports
+// counters are kept as deltas since the last Collect; all methods are safe for
+// concurrent use and do nothing on a nil *Stats
+type Stats struct {
+	lastSuccess time.Time
+	now         func() time.Time
+	counters    map[string]int64
+	lastLatency time.Duration
+	latency     models.Histogram
+	mu          sync.Mutex
+}
+
+// New creates Stats, the age of the last successful report is measured from now until the first success
+// request latencies are reported as a histogram in seconds over latencyBounds
+func New(latencyBounds []float64) *Stats {
+	s := &Stats{
+		now:      time.Now,
+		counters: make(map[string]int64),
+		latency:  models.NewHistogram(latencyBounds),
+	}
+	s.lastSuccess = s.now()
+	return s
+}
+
+// ObserveRequest records the outcome and duration of a single request to a server
+func (s *Stats) ObserveRequest(latency time.Duration, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastLatency = latency
+	s.latency.Observe(latency.Seconds())
+	if err != nil {
+		s.counters[BatchesFailed]++
+		return
+	}
+	s.counters[BatchesSent]++
+	s.lastSuccess = s.now()
+}
+
+// ObservePayload records the size of a batch before and after compression
+func (s *Stats) ObservePayload(raw, compressed int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[PayloadBytes] += int64(raw)
+	s.counters[PayloadBytesGzip] += int64(compressed)
+}
+
+// AddRetry records an additional attempt to deliver a batch that was already tried before
+func (s *Stats) AddRetry() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[Retries]++
+}
+
+// Collect returns the operational metrics and resets the counter deltas and the latency histogram
+// spoolDepth is the number of batches currently waiting to be replayed
+func (s *Stats) Collect(spoolDepth int) []models.Metrics {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	gauges := map[string]float64{
+		LastReportAge:  s.now().Sub(s.lastSuccess).Seconds(),
+		RequestLatency: s.lastLatency.Seconds(),
+		SpoolDepth:     float64(spoolDepth),
+	}
+
+	result := make([]models.Metrics, 0, len(gauges)+len(s.counters)+1)
+	for name, value := range gauges {
+		localValue := value
+		result = append(result, models.Metrics{ID: name, MType: constants.MetricTypeGauge, Value: &localValue})
+	}
+	for name, delta := range s.counters {
+		localDelta := delta
+		result = append(result, models.Metrics{ID: name, MType: constants.MetricTypeCounter, Delta: &localDelta})
+	}
+
+	s.counters = make(map[string]int64)
+
+	if s.latency.Count > 0 {
+		result = append(result, models.NewHistogramMetric(RequestDuration, s.latency))
+		s.latency = models.NewHistogram(s.latency.Bounds)
+	}
+
+	return result
+}
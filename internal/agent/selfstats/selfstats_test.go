@@ -0,0 +1,58 @@
+package selfstats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// byName indexes collected metrics by name
+func byName(metrics []models.Metrics) map[string]models.Metrics {
+	result := make(map[string]models.Metrics)
+	for _, m := range metrics {
+		result[m.ID] = m
+	}
+	return result
+}
+
+func TestCollect(t *testing.T) {
+	clock := time.Unix(100, 0)
+	s := New([]float64{0.01, 0.05})
+	s.now = func() time.Time { return clock }
+
+	s.ObservePayload(1000, 200)
+	s.ObserveRequest(50*time.Millisecond, nil)
+	clock = clock.Add(5 * time.Second)
+	s.ObserveRequest(20*time.Millisecond, errors.New("refused"))
+	s.AddRetry()
+
+	got := byName(s.Collect(3))
+	assert.Equal(t, int64(1), *got[BatchesSent].Delta)
+	assert.Equal(t, int64(1), *got[BatchesFailed].Delta)
+	assert.Equal(t, int64(1), *got[Retries].Delta)
+	assert.Equal(t, int64(1000), *got[PayloadBytes].Delta)
+	assert.Equal(t, int64(200), *got[PayloadBytesGzip].Delta)
+	assert.Equal(t, 5.0, *got[LastReportAge].Value)
+	assert.Equal(t, 0.02, *got[RequestLatency].Value)
+	assert.Equal(t, 3.0, *got[SpoolDepth].Value)
+	assert.Equal(t, []int64{0, 2, 0}, got[RequestDuration].Buckets)
+	assert.Equal(t, int64(2), *got[RequestDuration].Count)
+
+	// counters are deltas and start over after each collection
+	got = byName(s.Collect(0))
+	assert.NotContains(t, got, BatchesSent)
+	assert.NotContains(t, got, RequestDuration)
+	assert.Contains(t, got, LastReportAge)
+}
+
+func TestNilStats(t *testing.T) {
+	var s *Stats
+	s.ObserveRequest(time.Millisecond, nil)
+	s.ObservePayload(1, 1)
+	s.AddRetry()
+	assert.Nil(t, s.Collect(0))
+}
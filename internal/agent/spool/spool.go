@@ -0,0 +1,418 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".json"
+	pendingFile   = "pending.json"
+)
+
+// segment is a spooled batch of gauge values as stored on disk
+type segment struct {
+	Created time.Time        `json:"created"`
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+// pending holds the counter deltas, histograms, summaries and set sketches merged from all spooled batches,
+// they are kept in a single file so that a push adds all of them or none
+type pending struct {
+	Counters   map[string]int64            `json:"counters,omitempty"`
+	Histograms map[string]models.Histogram `json:"histograms,omitempty"`
+	Summaries  map[string]sketch.Sketch    `json:"summaries,omitempty"`
+	Sets       map[string]hll.Sketch       `json:"sets,omitempty"`
+}
+
+// empty reports whether nothing is pending
+func (p *pending) empty() bool {
+	return len(p.Counters) == 0 && len(p.Histograms) == 0 && len(p.Summaries) == 0 && len(p.Sets) == 0
+}
+
+// add merges a metric that is not a gauge into p
+func (p *pending) add(metric models.Metrics) {
+	switch metric.MType {
+	case constants.MetricTypeCounter:
+		p.Counters[metric.ID] += *metric.Delta
+	case constants.MetricTypeHistogram:
+		if existing, ok := p.Histograms[metric.ID]; ok {
+			p.Histograms[metric.ID] = existing.Merge(metric.Histogram())
+		} else {
+			p.Histograms[metric.ID] = metric.Histogram()
+		}
+	case constants.MetricTypeSummary:
+		if existing, ok := p.Summaries[metric.ID]; ok {
+			p.Summaries[metric.ID] = existing.Merge(*metric.Sketch)
+		} else {
+			p.Summaries[metric.ID] = metric.Sketch.Clone()
+		}
+	case constants.MetricTypeSet:
+		p.Sets[metric.ID] = p.Sets[metric.ID].Merge(metric.Set())
+	}
+}
+
+// metrics returns the pending metrics
+func (p *pending) metrics() []models.Metrics {
+	var result []models.Metrics
+	for id, delta := range p.Counters {
+		localDelta := delta
+		result = append(result, models.Metrics{ID: id, MType: constants.MetricTypeCounter, Delta: &localDelta})
+	}
+	for id, h := range p.Histograms {
+		result = append(result, models.NewHistogramMetric(id, h))
+	}
+	for id, sk := range p.Summaries {
+		result = append(result, models.NewSummaryMetric(id, sk))
+	}
+	for id, set := range p.Sets {
+		result = append(result, models.Metrics{ID: id, MType: constants.MetricTypeSet, Registers: set.Registers})
+	}
+	return result
+}
+
+// spoolFile is the name and contents of a file written by Push
+type spoolFile struct {
+	name string
+	data []byte
+}
+
+// Spool is a bounded on-disk queue of metric batches that could not be delivered
+// gauges are kept as ordered segments which are evicted when they exceed the size or age limits;
+// counter deltas, histograms, summaries and set sketches from all spooled batches are merged into a single pending set that
+// is never evicted, so each observation is replayed exactly once regardless of how many batches failed
+type Spool struct {
+	dir       string
+	maxSize   int64
+	maxAge    time.Duration
+	now       func() time.Time
+	writeFile func(name string, data []byte, perm os.FileMode) error
+	mu        sync.Mutex
+	next      uint64
+}
+
+// New opens the spool in dir, creating the directory if it does not exist
+// segments left by a previous run are kept and replayed first
+func New(dir string, maxSize int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:       dir,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		now:       time.Now,
+		writeFile: os.WriteFile,
+	}
+
+	names, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		last := names[len(names)-1]
+		if _, err := fmt.Sscanf(last, segmentPrefix+"%d"+segmentSuffix, &s.next); err != nil {
+			return nil, fmt.Errorf("unexpected spool segment name %s: %w", last, err)
+		}
+	}
+
+	return s, nil
+}
+
+// Push appends a batch to the spool
+// gauges are written as a new segment, counter deltas, histograms, summaries and sets are added to the pending set;
+// the batch is stored completely or, if an error is returned, not at all, so it can be retried without sending anything twice
+func (s *Spool) Push(batch []models.Metrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var gauges, others []models.Metrics
+	for _, metric := range batch {
+		switch {
+		case metric.MType == constants.MetricTypeCounter && metric.Delta != nil,
+			metric.MType == constants.MetricTypeHistogram,
+			metric.MType == constants.MetricTypeSummary && metric.Sketch != nil,
+			metric.MType == constants.MetricTypeSet:
+			others = append(others, metric)
+		default:
+			gauges = append(gauges, metric)
+		}
+	}
+
+	var files []spoolFile
+	if len(gauges) > 0 {
+		data, err := json.Marshal(segment{Created: s.now(), Metrics: gauges})
+		if err != nil {
+			return err
+		}
+		files = append(files, spoolFile{name: fmt.Sprintf("%s%020d%s", segmentPrefix, s.next+1, segmentSuffix), data: data})
+	}
+
+	if len(others) > 0 {
+		p, err := s.loadPending()
+		if err != nil {
+			return err
+		}
+		for _, metric := range others {
+			p.add(metric)
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, spoolFile{name: pendingFile, data: data})
+	}
+
+	if err := s.commit(files); err != nil {
+		return err
+	}
+	if len(gauges) > 0 {
+		s.next++
+	}
+
+	// the batch is stored, so failing to evict old segments must not fail the push;
+	// Replay enforces the limits again before sending anything
+	_ = s.enforceLimits()
+	return nil
+}
+
+// commit writes files under temporary names and renames them into place once all of them were written;
+// the pending file comes last, so when it is renamed the push is complete, and on error the files
+// already renamed are removed again, which leaves the spool as it was
+func (s *Spool) commit(files []spoolFile) error {
+	tmps := make([]string, 0, len(files))
+	removeTmps := func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+
+	for _, f := range files {
+		tmp := filepath.Join(s.dir, f.name+".tmp")
+		tmps = append(tmps, tmp)
+		if err := s.writeFile(tmp, f.data, 0644); err != nil {
+			removeTmps()
+			return err
+		}
+	}
+
+	for i, f := range files {
+		if err := os.Rename(tmps[i], filepath.Join(s.dir, f.name)); err != nil {
+			removeTmps()
+			for _, renamed := range files[:i] {
+				_ = s.remove(renamed.name)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replay sends the spooled batches to send in the order they were pushed
+// the pending counters, histograms, summaries and sets are sent together with the oldest segment; every batch is removed
+// from the spool once send succeeds and replay stops at the first error
+func (s *Spool) Replay(send func([]models.Metrics) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enforceLimits(); err != nil {
+		return err
+	}
+
+	names, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	p, err := s.loadPending()
+	if err != nil {
+		return err
+	}
+
+	if !p.empty() {
+		var batch []models.Metrics
+		if len(names) > 0 {
+			if batch, err = s.readSegment(names[0]); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, p.metrics()...)
+
+		if err := send(batch); err != nil {
+			return err
+		}
+		if err := s.remove(pendingFile); err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			if err := s.remove(names[0]); err != nil {
+				return err
+			}
+			names = names[1:]
+		}
+	}
+
+	for _, name := range names {
+		batch, err := s.readSegment(name)
+		if err != nil {
+			return err
+		}
+		if err := send(batch); err != nil {
+			return err
+		}
+		if err := s.remove(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of spooled batches, counting the pending counters, histograms, summaries and sets as one batch
+// when there are no gauge segments to carry them
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, err := s.segments()
+	if err != nil {
+		return 0
+	}
+	if len(names) > 0 {
+		return len(names)
+	}
+
+	if _, err := os.Stat(filepath.Join(s.dir, pendingFile)); err == nil {
+		return 1
+	}
+	return 0
+}
+
+// enforceLimits removes segments older than maxAge and then the oldest segments
+// until the total size of the spool fits into maxSize; the pending set is never evicted but counts
+// towards maxSize, it is bounded by the number of metric names since all of its entries have a fixed size
+func (s *Spool) enforceLimits() error {
+	names, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	info, err := os.Stat(filepath.Join(s.dir, pendingFile))
+	if err == nil {
+		total = info.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	type entry struct {
+		name string
+		size int64
+	}
+
+	var kept []entry
+
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+
+		if s.maxAge > 0 && s.now().Sub(info.ModTime()) > s.maxAge {
+			if err := s.remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		kept = append(kept, entry{name: name, size: info.Size()})
+		total += info.Size()
+	}
+
+	for len(kept) > 0 && s.maxSize > 0 && total > s.maxSize {
+		if err := s.remove(kept[0].name); err != nil {
+			return err
+		}
+		total -= kept[0].size
+		kept = kept[1:]
+	}
+
+	return nil
+}
+
+// segments returns the names of the segment files in the order they were written
+func (s *Spool) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, segmentPrefix) && strings.HasSuffix(name, segmentSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// readSegment returns the metrics stored in a segment file
+func (s *Spool) readSegment(name string) ([]models.Metrics, error) {
+	var seg segment
+	if err := s.readJSON(name, &seg); err != nil {
+		return nil, err
+	}
+	return seg.Metrics, nil
+}
+
+// loadPending reads the pending metrics, an absent file means there are none
+func (s *Spool) loadPending() (*pending, error) {
+	p := &pending{
+		Counters:   make(map[string]int64),
+		Histograms: make(map[string]models.Histogram),
+		Summaries:  make(map[string]sketch.Sketch),
+		Sets:       make(map[string]hll.Sketch),
+	}
+
+	err := s.readJSON(pendingFile, p)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+
+	return p, err
+}
+
+// readJSON decodes a spool file into v
+func (s *Spool) readJSON(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// remove deletes a spool file, a file that is already gone is not an error
+func (s *Spool) remove(name string) error {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
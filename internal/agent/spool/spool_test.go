@@ -0,0 +1,221 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
+)
+
+func gauge(name string, value float64) models.Metrics {
+	return models.Metrics{ID: name, MType: constants.MetricTypeGauge, Value: &value}
+}
+
+func counter(name string, delta int64) models.Metrics {
+	return models.Metrics{ID: name, MType: constants.MetricTypeCounter, Delta: &delta}
+}
+
+// collect replays the spool and returns the batches that were sent
+func collect(t *testing.T, s *Spool) [][]models.Metrics {
+	var sent [][]models.Metrics
+	require.NoError(t, s.Replay(func(batch []models.Metrics) error {
+		sent = append(sent, batch)
+		return nil
+	}))
+	return sent
+}
+
+func TestReplayOrderAndCounterMerge(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 1), counter("PollCount", 5)}))
+	require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 2), counter("PollCount", 3)}))
+	require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 3)}))
+	assert.Equal(t, 3, s.Len())
+
+	sent := collect(t, s)
+	require.Len(t, sent, 3)
+
+	// the merged counters travel with the oldest batch only
+	assert.Equal(t, []models.Metrics{gauge("Alloc", 1), counter("PollCount", 8)}, sent[0])
+	assert.Equal(t, []models.Metrics{gauge("Alloc", 2)}, sent[1])
+	assert.Equal(t, []models.Metrics{gauge("Alloc", 3)}, sent[2])
+
+	assert.Equal(t, 0, s.Len())
+	assert.Empty(t, collect(t, s))
+}
+
+func TestReplayStopsOnError(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 1), counter("PollCount", 1)}))
+	require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 2)}))
+
+	calls := 0
+	err = s.Replay(func(batch []models.Metrics) error {
+		calls++
+		if calls == 2 {
+			return errors.New("server unavailable")
+		}
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, s.Len())
+
+	// the counters were delivered with the first batch and must not be sent again
+	sent := collect(t, s)
+	assert.Equal(t, [][]models.Metrics{{gauge("Alloc", 2)}}, sent)
+}
+
+func TestCountersOnly(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Push([]models.Metrics{counter("PollCount", 2)}))
+	require.NoError(t, s.Push([]models.Metrics{counter("PollCount", 4)}))
+	assert.Equal(t, 1, s.Len())
+
+	assert.Equal(t, [][]models.Metrics{{counter("PollCount", 6)}}, collect(t, s))
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New(dir, 1, 0)
+		require.NoError(t, err)
+
+		require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 1), counter("PollCount", 1)}))
+		require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 2), counter("PollCount", 1)}))
+
+		// gauge segments are evicted but counter deltas are kept
+		assert.Equal(t, [][]models.Metrics{{counter("PollCount", 2)}}, collect(t, s))
+	})
+
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New(dir, 0, time.Minute)
+		require.NoError(t, err)
+
+		require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 1)}))
+		require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 2)}))
+
+		names, err := s.segments()
+		require.NoError(t, err)
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, names[0]), old, old))
+
+		assert.Equal(t, [][]models.Metrics{{gauge("Alloc", 2)}}, collect(t, s))
+	})
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 1)}))
+
+	reopened, err := New(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, reopened.Push([]models.Metrics{gauge("Alloc", 2)}))
+
+	assert.Equal(t, [][]models.Metrics{{gauge("Alloc", 1)}, {gauge("Alloc", 2)}}, collect(t, reopened))
+}
+
+func TestHistogramMerge(t *testing.T) {
+	s, err := New(t.TempDir(), 1, 0)
+	require.NoError(t, err)
+
+	h := models.NewHistogram([]float64{1})
+	h.Observe(0.5)
+	require.NoError(t, s.Push([]models.Metrics{models.NewHistogramMetric("Latency", h)}))
+	require.NoError(t, s.Push([]models.Metrics{models.NewHistogramMetric("Latency", h)}))
+	assert.Equal(t, 1, s.Len())
+
+	// histograms are never evicted by the size limit
+	merged := h.Merge(h)
+	assert.Equal(t, [][]models.Metrics{{models.NewHistogramMetric("Latency", merged)}}, collect(t, s))
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestSummaryMerge(t *testing.T) {
+	s, err := New(t.TempDir(), 1, 0)
+	require.NoError(t, err)
+
+	sk := sketch.New(sketch.DefaultAlpha)
+	sk.Add(0.5)
+	sk.Add(-2)
+	require.NoError(t, s.Push([]models.Metrics{models.NewSummaryMetric("Latency", sk)}))
+	require.NoError(t, s.Push([]models.Metrics{models.NewSummaryMetric("Latency", sk)}))
+	assert.Equal(t, 1, s.Len())
+
+	// summaries are never evicted by the size limit
+	merged := sk.Merge(sk)
+	assert.Equal(t, [][]models.Metrics{{models.NewSummaryMetric("Latency", merged)}}, collect(t, s))
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestSetMerge(t *testing.T) {
+	s, err := New(t.TempDir(), 1, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Push([]models.Metrics{{ID: "Users", MType: constants.MetricTypeSet, Members: []string{"bob", "alice"}}}))
+	require.NoError(t, s.Push([]models.Metrics{{ID: "Users", MType: constants.MetricTypeSet, Members: []string{"alice", "carol"}}}))
+	assert.Equal(t, 1, s.Len())
+
+	// sets are never evicted by the size limit and are spooled as sketches
+	users := models.Metrics{Members: []string{"alice", "bob", "carol"}}.Set()
+	expected := models.Metrics{ID: "Users", MType: constants.MetricTypeSet, Registers: users.Registers}
+	assert.Equal(t, [][]models.Metrics{{expected}}, collect(t, s))
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestLimitsCountPending(t *testing.T) {
+	s, err := New(t.TempDir(), 1024, 0)
+	require.NoError(t, err)
+
+	// the sketch of a set alone is larger than the limit, so no gauge segment fits next to it
+	require.NoError(t, s.Push([]models.Metrics{{ID: "Users", MType: constants.MetricTypeSet, Members: []string{"alice"}}}))
+	require.NoError(t, s.Push([]models.Metrics{gauge("Alloc", 1)}))
+	assert.Equal(t, 1, s.Len())
+
+	sent := collect(t, s)
+	require.Len(t, sent, 1)
+	require.Len(t, sent[0], 1)
+	assert.Equal(t, constants.MetricTypeSet, sent[0][0].MType)
+}
+
+func TestPushIsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Push([]models.Metrics{counter("PollCount", 5)}))
+
+	writes := 0
+	s.writeFile = func(name string, data []byte, perm os.FileMode) error {
+		writes++
+		if writes == 2 {
+			return errors.New("disk full")
+		}
+		return os.WriteFile(name, data, perm)
+	}
+	require.Error(t, s.Push([]models.Metrics{gauge("Alloc", 1), counter("PollCount", 3)}))
+	assert.Equal(t, 2, writes)
+
+	// the failed batch is put back into the buffer by the caller, so none of it may remain spooled
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, pendingFile, entries[0].Name())
+	assert.Equal(t, [][]models.Metrics{{counter("PollCount", 5)}}, collect(t, s))
+}
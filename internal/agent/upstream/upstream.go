@@ -0,0 +1,266 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/selfstats"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/agent/spool"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// ModeFailover sends every batch to the first healthy server in the configured order
+	ModeFailover = "failover"
+	// ModeFanout sends every batch to all servers, each with its own health state and spool
+	ModeFanout = "fanout"
+)
+
+// ErrNoUpstream is returned when no server accepted a batch in failover mode
+var ErrNoUpstream = errors.New("no upstream server accepted the batch")
+
+// SendFunc delivers a batch to a single server address
+type SendFunc func(addr string, batch []models.Metrics) error
+
+// Target is a single upstream server and its health state
+type Target struct {
+	nextProbe time.Time
+	spool     *spool.Spool
+	Addr      string
+	failures  int
+}
+
+// healthy reports whether the target may be used now; an unhealthy target becomes
+// usable again once its probe time has come, and the next send acts as the recovery probe
+func (t *Target) healthy(now time.Time) bool {
+	return t.failures == 0 || !now.Before(t.nextProbe)
+}
+
+// Pool distributes batches over one or more upstream servers
+type Pool struct {
+	now           func() time.Time
+	sugar         *zap.SugaredLogger
+	send          SendFunc
+	stats         *selfstats.Stats
+	spool         *spool.Spool
+	mode          string
+	targets       []*Target
+	retryInterval time.Duration
+	mu            sync.Mutex
+}
+
+// NewPool creates a pool for the comma separated server addresses in cfg.Addr
+// in failover mode batches that no server accepted go to a single spool in cfg.SpoolDir, if set,
+// in fanout mode every server gets its own spool in a subdirectory named after its address, so cfg.SpoolDir is required;
+// retries of batches that were already attempted are recorded in stats, which may be nil
+func NewPool(cfg *config.Config, sugar *zap.SugaredLogger, send SendFunc, stats *selfstats.Stats) (*Pool, error) {
+	addrs := SplitAddrs(cfg.Addr)
+	if len(addrs) == 0 {
+		return nil, errors.New("no upstream server address configured")
+	}
+
+	mode := cfg.UpstreamMode
+	if mode == "" {
+		mode = ModeFailover
+	}
+	if mode != ModeFailover && mode != ModeFanout {
+		return nil, fmt.Errorf("invalid upstream mode: %s. Possible values are '%s' or '%s'", mode, ModeFailover, ModeFanout)
+	}
+	// without a spool a server that is down would miss batches the others already got,
+	// and resending them to every server would count them twice on the others
+	if mode == ModeFanout && cfg.SpoolDir == "" {
+		return nil, errors.New("upstream mode fanout requires a spool directory")
+	}
+
+	p := &Pool{
+		now:           time.Now,
+		sugar:         sugar,
+		send:          send,
+		stats:         stats,
+		mode:          mode,
+		retryInterval: cfg.UpstreamRetry,
+	}
+
+	for _, addr := range addrs {
+		target := &Target{Addr: addr}
+
+		if mode == ModeFanout && cfg.SpoolDir != "" {
+			sp, err := spool.New(filepath.Join(cfg.SpoolDir, url.PathEscape(addr)), cfg.SpoolMaxSize, cfg.SpoolMaxAge)
+			if err != nil {
+				return nil, err
+			}
+			target.spool = sp
+		}
+
+		p.targets = append(p.targets, target)
+	}
+
+	if mode == ModeFailover && cfg.SpoolDir != "" {
+		sp, err := spool.New(cfg.SpoolDir, cfg.SpoolMaxSize, cfg.SpoolMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		p.spool = sp
+	}
+
+	return p, nil
+}
+
+// SplitAddrs splits a comma separated list of server addresses, ignoring empty entries
+func SplitAddrs(addrs string) []string {
+	return utils.SplitList(addrs)
+}
+
+// Deliver sends a batch according to the pool mode
+// spooled batches are replayed before the live batch so that it never overtakes them;
+// an error is returned only if the batch was neither delivered nor spooled anywhere
+func (p *Pool) Deliver(batch []models.Metrics) error {
+	if p.mode == ModeFanout {
+		return p.deliverFanout(batch)
+	}
+
+	return p.deliverWithSpool(p.spool, batch, p.sendFailover)
+}
+
+// SpoolDepth returns the total number of batches waiting in the pool spools
+func (p *Pool) SpoolDepth() int {
+	depth := 0
+	if p.spool != nil {
+		depth += p.spool.Len()
+	}
+	for _, target := range p.targets {
+		if target.spool != nil {
+			depth += target.spool.Len()
+		}
+	}
+	return depth
+}
+
+// deliverWithSpool replays sp and then sends the live batch, spooling it if either step fails
+func (p *Pool) deliverWithSpool(sp *spool.Spool, batch []models.Metrics, send func([]models.Metrics) error) error {
+	if sp == nil {
+		return send(batch)
+	}
+
+	err := sp.Replay(func(b []models.Metrics) error {
+		p.stats.AddRetry()
+		return send(b)
+	})
+	if err == nil {
+		err = send(batch)
+	}
+	if err == nil {
+		return nil
+	}
+
+	p.sugar.Errorw("Failed to report metrics, spooling batch", "err", err)
+	if spErr := sp.Push(batch); spErr != nil {
+		return fmt.Errorf("failed to spool metrics: %w, send error: %v", spErr, err)
+	}
+
+	return nil
+}
+
+// sendFailover tries the targets in the configured order, skipping those that are unhealthy
+// and not yet due for a recovery probe; the first target to accept the batch wins
+func (p *Pool) sendFailover(batch []models.Metrics) error {
+	attempted := false
+	for _, target := range p.targets {
+		if !p.isHealthy(target) {
+			continue
+		}
+
+		if attempted {
+			p.stats.AddRetry()
+		}
+		attempted = true
+
+		err := p.send(target.Addr, batch)
+		p.record(target, err)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return ErrNoUpstream
+}
+
+// deliverFanout sends the batch to every target concurrently
+// a target that is down keeps receiving batches into its own spool without being contacted
+// until its recovery probe is due; an error is returned only if no target got the batch,
+// since retrying it would duplicate it on the others, so the targets that lost it are logged instead
+func (p *Pool) deliverFanout(batch []models.Metrics) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(p.targets))
+
+	for i, target := range p.targets {
+		wg.Add(1)
+		go func(i int, target *Target) {
+			defer wg.Done()
+
+			send := func(b []models.Metrics) error {
+				if !p.isHealthy(target) {
+					return fmt.Errorf("upstream %s is unhealthy", target.Addr)
+				}
+				err := p.send(target.Addr, b)
+				p.record(target, err)
+				return err
+			}
+
+			if err := p.deliverWithSpool(target.spool, batch, send); err != nil {
+				errs[i] = fmt.Errorf("upstream %s: %w", target.Addr, err)
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == len(p.targets) {
+		return errors.Join(failed...)
+	}
+
+	for _, err := range failed {
+		p.sugar.Errorw("Dropped metrics batch for upstream server", "err", err)
+	}
+	return nil
+}
+
+// isHealthy reports whether target may be contacted now
+func (p *Pool) isHealthy(target *Target) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return target.healthy(p.now())
+}
+
+// record updates the health state of target after a send attempt
+func (p *Pool) record(target *Target, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		if target.failures > 0 {
+			p.sugar.Infow("Upstream server recovered", "addr", target.Addr)
+		}
+		target.failures = 0
+		return
+	}
+
+	if target.failures == 0 {
+		p.sugar.Warnw("Upstream server marked unhealthy", "addr", target.Addr, "err", err)
+	}
+	target.failures++
+	target.nextProbe = p.now().Add(p.retryInterval)
+}
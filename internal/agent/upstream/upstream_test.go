@@ -0,0 +1,152 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// fakeServers records delivered batches per address and fails for addresses marked down
+type fakeServers struct {
+	down      map[string]bool
+	delivered map[string]int
+	mu        sync.Mutex
+}
+
+func newFakeServers() *fakeServers {
+	return &fakeServers{down: map[string]bool{}, delivered: map[string]int{}}
+}
+
+func (f *fakeServers) send(addr string, batch []models.Metrics) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down[addr] {
+		return errors.New("connection refused")
+	}
+	f.delivered[addr]++
+	return nil
+}
+
+func (f *fakeServers) setDown(addr string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[addr] = down
+}
+
+func (f *fakeServers) count(addr string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.delivered[addr]
+}
+
+func batch() []models.Metrics {
+	value := 1.0
+	return []models.Metrics{{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &value}}
+}
+
+func newTestPool(t *testing.T, cfg *config.Config, servers *fakeServers, clock *time.Time) *Pool {
+	p, err := NewPool(cfg, zap.NewNop().Sugar(), servers.send, nil)
+	require.NoError(t, err)
+	p.now = func() time.Time { return *clock }
+	return p
+}
+
+func TestSplitAddrs(t *testing.T) {
+	assert.Equal(t, []string{"a:8080", "b:8080"}, SplitAddrs(" a:8080, ,b:8080,"))
+	assert.Nil(t, SplitAddrs(""))
+}
+
+func TestFailover(t *testing.T) {
+	clock := time.Unix(0, 0)
+	servers := newFakeServers()
+	cfg := &config.Config{Addr: "primary,secondary", UpstreamMode: ModeFailover, UpstreamRetry: time.Minute}
+	p := newTestPool(t, cfg, servers, &clock)
+
+	require.NoError(t, p.Deliver(batch()))
+	assert.Equal(t, 1, servers.count("primary"))
+
+	servers.setDown("primary", true)
+	require.NoError(t, p.Deliver(batch()))
+	assert.Equal(t, 1, servers.count("secondary"))
+
+	// the primary is not contacted again until its probe is due
+	servers.setDown("primary", false)
+	require.NoError(t, p.Deliver(batch()))
+	assert.Equal(t, 1, servers.count("primary"))
+	assert.Equal(t, 2, servers.count("secondary"))
+
+	clock = clock.Add(time.Minute)
+	require.NoError(t, p.Deliver(batch()))
+	assert.Equal(t, 2, servers.count("primary"))
+	assert.Equal(t, 2, servers.count("secondary"))
+}
+
+func TestFailoverAllDown(t *testing.T) {
+	clock := time.Unix(0, 0)
+	servers := newFakeServers()
+	servers.setDown("a", true)
+	servers.setDown("b", true)
+
+	t.Run("without spool", func(t *testing.T) {
+		p := newTestPool(t, &config.Config{Addr: "a,b"}, servers, &clock)
+		assert.ErrorIs(t, p.Deliver(batch()), ErrNoUpstream)
+	})
+
+	t.Run("with spool", func(t *testing.T) {
+		cfg := &config.Config{Addr: "a,b", SpoolDir: t.TempDir()}
+		p := newTestPool(t, cfg, servers, &clock)
+
+		require.NoError(t, p.Deliver(batch()))
+		require.NoError(t, p.Deliver(batch()))
+		assert.Equal(t, 2, p.SpoolDepth())
+
+		servers.setDown("b", false)
+		require.NoError(t, p.Deliver(batch()))
+		assert.Equal(t, 3, servers.count("b"))
+		assert.Equal(t, 0, p.SpoolDepth())
+	})
+}
+
+func TestFanout(t *testing.T) {
+	clock := time.Unix(0, 0)
+	servers := newFakeServers()
+	cfg := &config.Config{Addr: "a,b", UpstreamMode: ModeFanout, UpstreamRetry: time.Minute, SpoolDir: t.TempDir()}
+	p := newTestPool(t, cfg, servers, &clock)
+
+	require.NoError(t, p.Deliver(batch()))
+	assert.Equal(t, 1, servers.count("a"))
+	assert.Equal(t, 1, servers.count("b"))
+
+	servers.setDown("b", true)
+	require.NoError(t, p.Deliver(batch()))
+	require.NoError(t, p.Deliver(batch()))
+	assert.Equal(t, 3, servers.count("a"))
+	assert.Equal(t, 1, servers.count("b"))
+	assert.Equal(t, 2, p.SpoolDepth())
+
+	// b catches up with everything it missed once it recovers
+	servers.setDown("b", false)
+	clock = clock.Add(time.Minute)
+	require.NoError(t, p.Deliver(batch()))
+	assert.Equal(t, 4, servers.count("a"))
+	assert.Equal(t, 4, servers.count("b"))
+	assert.Equal(t, 0, p.SpoolDepth())
+}
+
+func TestInvalidMode(t *testing.T) {
+	_, err := NewPool(&config.Config{Addr: "a", UpstreamMode: "broadcast"}, zap.NewNop().Sugar(), newFakeServers().send, nil)
+	assert.Error(t, err)
+
+	_, err = NewPool(&config.Config{Addr: "a,b", UpstreamMode: ModeFanout}, zap.NewNop().Sugar(), newFakeServers().send, nil)
+	assert.Error(t, err, "fanout without a spool would lose batches for servers that are down")
+}
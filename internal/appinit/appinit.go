@@ -2,21 +2,37 @@ package appinit
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/certs"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/dbstorage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/events"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/filestorage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/health"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/logger"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/selfmetrics"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/storage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
 	"go.uber.org/zap"
 )
 
+// certReloadInterval is how often the certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
 // initAppWithConfigParser initializes the application by loading the configuration and setting up the logger.
 // It uses the provided function to parse the configuration.
 // It returns a configuration object, a logger, a function to sync the logger, and possibly an error.
@@ -45,22 +61,70 @@ func InitAgentApp() (*config.Config, *zap.SugaredLogger, func(), error) {
 }
 
 // InitServer sets up and returns an HTTP server based on the provided configuration and router
-func InitServer(cfg *config.Config, r http.Handler) *http.Server {
+// it serves TLS if tlsConfig is not nil
+func InitServer(cfg *config.Config, r http.Handler, tlsConfig *tls.Config) *http.Server {
 	return &http.Server{
 		Addr:         cfg.Addr,
 		Handler:      r,
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
 		IdleTimeout:  cfg.IdleTimeout,
+		TLSConfig:    tlsConfig,
+	}
+}
+
+// initCertReloader loads the configured certificate files and reloads them when they change until ctx is done,
+// it returns nil if no files are configured
+func initCertReloader(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger) (*certs.Reloader, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" && cfg.TLSCAFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+	reloader.Watch(ctx, sugar, certReloadInterval)
+	return reloader, nil
+}
+
+// InitServerTLS returns the TLS config of the server, nil if no certificate is configured, which serves plain HTTP;
+// with a CA bundle clients must present a certificate signed by one of its CAs
+func InitServerTLS(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSCAFile != "" {
+		return nil, errors.New("verifying client certificates requires a server certificate")
 	}
+
+	reloader, err := initCertReloader(ctx, cfg, sugar)
+	if err != nil || reloader == nil {
+		return nil, err
+	}
+
+	if cfg.TLSCAFile != "" {
+		sugar.Info("Serving TLS, client certificates are required")
+	} else {
+		sugar.Info("Serving TLS")
+	}
+	return reloader.ServerConfig(), nil
+}
+
+// InitAgentTLS returns the TLS config of the agent, nil if neither a client certificate nor a CA bundle is configured,
+// in which case the system roots verify servers
+func InitAgentTLS(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger) (*tls.Config, error) {
+	reloader, err := initCertReloader(ctx, cfg, sugar)
+	if err != nil || reloader == nil {
+		return nil, err
+	}
+	return reloader.ClientConfig(), nil
 }
 
 // InitDataSave configures the data storage mechanism based on the provided configuration
-func InitDataSave(sugar *zap.SugaredLogger, storage *storage.InMemoryStorage, cfg *config.Config) {
+// the saves are recorded in reg, which may be nil
+func InitDataSave(sugar *zap.SugaredLogger, storage *storage.InMemoryStorage, cfg *config.Config, reg *selfmetrics.Registry) {
 	if cfg.StoreInterval == 0 {
-		filestorage.StartSyncSave(sugar, cfg, storage)
+		filestorage.StartSyncSave(sugar, cfg, storage, reg)
 	} else {
-		filestorage.StartPeriodicSave(sugar, cfg, storage)
+		filestorage.StartPeriodicSave(sugar, cfg, storage, reg)
 	}
 }
 
@@ -74,15 +138,21 @@ func InitSignalHandling() (chan struct{}, chan os.Signal) {
 }
 
 // StartServer launches the HTTP server in a goroutine and sends any errors to the provided channel
+// it serves TLS with the certificates of its TLS config if it has one
 func StartServer(srv *http.Server, errChan chan error) {
 	go func() {
+		if srv.TLSConfig != nil {
+			errChan <- srv.ListenAndServeTLS("", "")
+			return
+		}
 		errChan <- srv.ListenAndServe()
 	}()
 }
 
 // InitDBStorage initializes a database storage based on the provided configuration and logger
+// checker is marked restored once the tables exist
 // it returns an instance of dbstorage.StorageInterface or an error if any step in the initialization fails
-func InitDBStorage(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger, wg *sync.WaitGroup) (dbstorage.Interface, error) {
+func InitDBStorage(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger, wg *sync.WaitGroup, checker *health.Checker) (dbstorage.Interface, error) {
 	dbStorage, err := dbstorage.NewDBStorage(cfg)
 	if err != nil {
 		return nil, err
@@ -102,15 +172,207 @@ func InitDBStorage(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLo
 	if err := dbStorage.CreateTables(ctx); err != nil {
 		return nil, err
 	}
+	checker.MarkRestored()
 	return dbStorage, nil
 }
 
 // InitInMemoryStorage initializes an in-memory storage based on the provided configuration and logger
-// it restores any saved data and sets up automatic data saving
+// it restores any saved data, marking checker restored afterwards, and sets up automatic data saving, which is recorded in reg
 // it returns an instance of storage.InMemoryStorage or an error if any step in the initialization fails
-func InitInMemoryStorage(cfg *config.Config, sugar *zap.SugaredLogger) (*storage.InMemoryStorage, error) {
+func InitInMemoryStorage(cfg *config.Config, sugar *zap.SugaredLogger, reg *selfmetrics.Registry, checker *health.Checker) (*storage.InMemoryStorage, error) {
+	tiers, err := history.ParseTiers(cfg.HistoryTiers)
+	if err != nil {
+		return nil, err
+	}
+
 	storage := storage.NewInMemoryStorage()
+	storage.SetRatePoints(cfg.RatePoints)
+	storage.SetHistoryTiers(tiers)
 	filestorage.RestoreData(sugar, storage, cfg)
-	InitDataSave(sugar, storage, cfg)
+	checker.MarkRestored()
+	InitDataSave(sugar, storage, cfg, reg)
 	return storage, nil
 }
+
+// InitTokens loads the bearer tokens of the tenants from the configured file,
+// it returns no tokens if no file is configured, which disables tenants and authentication
+func InitTokens(cfg *config.Config, sugar *zap.SugaredLogger) (tenant.Tokens, error) {
+	if cfg.TokensFile == "" {
+		return nil, nil
+	}
+
+	tokens, err := tenant.LoadTokens(cfg.TokensFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokens from %s: %w", cfg.TokensFile, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %s", cfg.TokensFile)
+	}
+
+	sugar.Infof("Loaded %d tenant tokens", len(tokens))
+	return tokens, nil
+}
+
+// InitLimits creates the per-client rate limiter, nil if rate limiting is disabled,
+// and the per-tenant metric quota, which is enforced by the storage if it supports quotas
+func InitLimits(cfg *config.Config, sugar *zap.SugaredLogger, store models.GeneralStorageInterface) (*limits.Limiter, *limits.Quota) {
+	var limiter *limits.Limiter
+	if cfg.RateLimit > 0 {
+		limiter = limits.NewLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+
+	quota := limits.NewQuota(cfg.MaxMetrics)
+	if setter, ok := store.(limits.QuotaSetter); ok && quota.Enabled() {
+		setter.SetQuota(quota)
+	} else if quota.Enabled() {
+		sugar.Warn("Store does not support metric quotas")
+	}
+
+	return limiter, quota
+}
+
+// InitAudit opens the configured audit sink, which is closed when ctx is done, and makes the storage record
+// accepted updates in it; it returns no log if auditing is disabled, and fails rather than silently
+// not auditing if the storage does not support it
+func InitAudit(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger, store models.GeneralStorageInterface) (*audit.Log, error) {
+	if cfg.AuditSink == "" {
+		return nil, nil
+	}
+	setter, ok := store.(audit.Setter)
+	if !ok {
+		return nil, errors.New("store does not support auditing")
+	}
+
+	var sink audit.Sink
+	var err error
+	switch cfg.AuditSink {
+	case "file":
+		sink, err = audit.NewFileSink(cfg.AuditFile, cfg.AuditMaxSize, cfg.AuditBackups)
+	case "db":
+		if cfg.DBDSN == "" {
+			return nil, errors.New("the db audit sink requires a database DSN")
+		}
+		sink, err = audit.NewDBSink(ctx, cfg.DBDSN)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %s, expected 'file' or 'db'", cfg.AuditSink)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit sink: %w", err)
+	}
+
+	auditLog := audit.NewLog(sugar, sink)
+	setter.SetAudit(auditLog)
+
+	go func() {
+		<-ctx.Done()
+		if err := auditLog.Close(); err != nil {
+			sugar.Errorf("Error while closing the audit log: %v", err)
+		}
+	}()
+
+	sugar.Infof("Auditing updates to the %s sink", cfg.AuditSink)
+	return auditLog, nil
+}
+
+// InitEvents starts publishing update events to the configured sinks until ctx is done,
+// it returns no publisher if no sink is configured
+func InitEvents(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger) (*events.Publisher, error) {
+	var sinks []events.Sink
+	if cfg.EventsFile != "" {
+		sink, err := events.NewFileSink(cfg.EventsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open events file: %w", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.EventsURL != "" {
+		sinks = append(sinks, events.NewHTTPSink(cfg.EventsURL))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	pub := events.NewPublisher(sugar, cfg.EventsBuffer, sinks...)
+	pub.Start(ctx)
+	sugar.Infof("Publishing update events to %d sinks", len(sinks))
+	return pub, nil
+}
+
+// InitHealth adds the check of the initialized storage to the readiness checker
+func InitHealth(checker *health.Checker, store models.GeneralStorageInterface) {
+	checker.Add("storage", health.StorageCheck(store))
+}
+
+// InitDebug starts the debug listener serving the self-metrics at /metrics and the pprof profiles
+// under /debug/pprof/ until ctx is done; it returns no registry if no debug address is configured;
+// the listener is neither authenticated nor encrypted, so it should only be reachable by operators
+func InitDebug(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger) *selfmetrics.Registry {
+	if cfg.DebugAddr == "" {
+		return nil
+	}
+
+	reg := selfmetrics.New()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", selfmetrics.Handler(sugar, reg))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// no write timeout, CPU profiles and traces are streamed for as long as they are requested
+	srv := &http.Server{Addr: cfg.DebugAddr, Handler: mux, ReadHeaderTimeout: cfg.ReadTimeout}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sugar.Errorf("Debug listener failed: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			sugar.Errorf("Error while closing the debug listener: %v", err)
+		}
+	}()
+
+	sugar.Infof("Serving self-metrics and pprof on %s", cfg.DebugAddr)
+	return reg
+}
+
+// InitComponentMetrics exposes the counters of the server components and the connection pool
+// of a database storage in reg, which may be nil; every component may be nil as well
+func InitComponentMetrics(reg *selfmetrics.Registry, store models.GeneralStorageInterface, limiter *limits.Limiter, quota *limits.Quota, auditLog *audit.Log, pub *events.Publisher) {
+	if reg == nil {
+		return
+	}
+
+	if s, ok := store.(dbstorage.Interface); ok {
+		reg.AddDBStats(s.Stats)
+	}
+	reg.AddCounter("rate_limited_requests_total", "Requests rejected by the rate limiter.", func() float64 {
+		return float64(limiter.Rejected())
+	})
+	reg.AddCounter("quota_exceeded_updates_total", "Updates rejected by the metric quota.", func() float64 {
+		return float64(quota.Rejected())
+	})
+	reg.AddCounter("audit_failed_writes_total", "Writes to the audit sink that failed.", func() float64 {
+		return float64(auditLog.Failed())
+	})
+	reg.AddCounter("events_dropped_total", "Update events dropped because the queue of a sink was full.", func() float64 {
+		return float64(pub.Dropped())
+	})
+	reg.AddCounter("events_failed_total", "Update events a sink failed to deliver.", func() float64 {
+		return float64(pub.Failed())
+	})
+}
+
+// InitHistoryCompaction starts removing expired metric history from the storage until ctx is done,
+// nothing is started if the storage keeps no history or the compaction interval is not positive
+func InitHistoryCompaction(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger, store models.GeneralStorageInterface) {
+	compactor, ok := store.(history.Compactor)
+	if !ok || cfg.HistoryTiers == "" || cfg.CompactInterval <= 0 {
+		return
+	}
+
+	history.StartCompaction(ctx, sugar, compactor, cfg.CompactInterval)
+}
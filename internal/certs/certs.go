@@ -0,0 +1,197 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Reloader keeps a certificate with its key and a CA bundle loaded from files, all of them optional,
+// and reloads them when one of the files changes; it is safe for concurrent use
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	stamps   map[string]string // modification time and size of every file when it was loaded
+	mu       sync.RWMutex
+}
+
+// NewReloader loads the certificate and key, which must be given together, and the CA bundle
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a certificate and its key must be given together")
+	}
+
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// stamp returns the modification time and size of a file, which change when the file is replaced
+func stamp(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// Reload loads the files again if any of them changed and reports whether they did;
+// on error the previously loaded certificate and CA bundle are kept
+func (r *Reloader) Reload() (bool, error) {
+	stamps := make(map[string]string)
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		s, err := stamp(file)
+		if err != nil {
+			return false, err
+		}
+		stamps[file] = s
+	}
+
+	r.mu.RLock()
+	changed := len(stamps) != len(r.stamps)
+	for file, s := range stamps {
+		changed = changed || r.stamps[file] != s
+	}
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to load certificate %s: %w", r.certFile, err)
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates in CA bundle %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.stamps = cert, pool, stamps
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Watch reloads the files every interval until ctx is done
+func (r *Reloader) Watch(ctx context.Context, sugar *zap.SugaredLogger, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				changed, err := r.Reload()
+				if err != nil {
+					sugar.Errorf("Error when reloading certificates, keeping the loaded ones: %v", err)
+				} else if changed {
+					sugar.Info("Reloaded certificates")
+				}
+			}
+		}
+	}()
+}
+
+// Certificate returns the loaded certificate, nil if none is configured
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert
+}
+
+// CAPool returns the loaded CA bundle, nil if none is configured
+func (r *Reloader) CAPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.pool
+}
+
+// ServerConfig returns a server TLS config that always presents the current certificate,
+// with a CA bundle clients must present a certificate that it verifies
+func (r *Reloader) ServerConfig() *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return r.Certificate(), nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: getCertificate}
+	if r.caFile != "" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		// the config of every handshake is built anew, so that it uses the current CA bundle
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: getCertificate,
+				ClientAuth:     tls.RequireAndVerifyClientCert,
+				ClientCAs:      r.CAPool(),
+			}, nil
+		}
+	}
+	return cfg
+}
+
+// ClientConfig returns a client TLS config that presents the current certificate, if there is one,
+// and verifies servers against the current CA bundle instead of the system roots if there is one
+func (r *Reloader) ClientConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if r.certFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		}
+	}
+	if r.caFile != "" {
+		// RootCAs would pin the bundle loaded now, so the built-in verification is replaced
+		// by one against the bundle loaded at the time of every handshake
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = r.verifyServer
+	}
+	return cfg
+}
+
+// verifyServer verifies the certificate chain and name of a server against the current CA bundle
+func (r *Reloader) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         r.CAPool(),
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,188 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issue creates a certificate for name signed by parent, a self-signed CA if parent is nil
+func issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+// writePair writes cert and key as PEM files into dir and returns their paths
+func writePair(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// handshake connects a client with clientCfg to a server with serverCfg and returns the error of either side
+func handshake(t *testing.T, serverCfg, clientCfg *tls.Config) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- tls.Server(conn, serverCfg).Handshake()
+	}()
+
+	clientCfg = clientCfg.Clone()
+	clientCfg.ServerName = "server"
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientCfg)
+	if err == nil {
+		conn.Close()
+	}
+	// TLS 1.3 servers verify the client certificate after the client considers the handshake done
+	if serverErr := <-serverErr; err == nil {
+		err = serverErr
+	}
+	return err
+}
+
+func TestReloaderMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "ca", nil, nil)
+	caFile, _ := writePair(t, dir, "ca", ca, caKey)
+	serverCert, serverKey := issue(t, "server", ca, caKey)
+	serverCertFile, serverKeyFile := writePair(t, dir, "server", serverCert, serverKey)
+	clientCert, clientKey := issue(t, "client", ca, caKey)
+	clientCertFile, clientKeyFile := writePair(t, dir, "client", clientCert, clientKey)
+
+	server, err := NewReloader(serverCertFile, serverKeyFile, caFile)
+	require.NoError(t, err)
+
+	client, err := NewReloader(clientCertFile, clientKeyFile, caFile)
+	require.NoError(t, err)
+	assert.NoError(t, handshake(t, server.ServerConfig(), client.ClientConfig()))
+
+	anonymous, err := NewReloader("", "", caFile)
+	require.NoError(t, err)
+	assert.Error(t, handshake(t, server.ServerConfig(), anonymous.ClientConfig()), "clients without a certificate must be rejected")
+
+	other, otherKey := issue(t, "other", nil, nil)
+	otherCertFile, otherKeyFile := writePair(t, dir, "other", other, otherKey)
+	stranger, err := NewReloader(otherCertFile, otherKeyFile, caFile)
+	require.NoError(t, err)
+	assert.Error(t, handshake(t, server.ServerConfig(), stranger.ClientConfig()), "clients with a certificate of another CA must be rejected")
+}
+
+func TestReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "ca", nil, nil)
+	first, firstKey := issue(t, "server", ca, caKey)
+	certFile, keyFile := writePair(t, dir, "server", first, firstKey)
+
+	r, err := NewReloader(certFile, keyFile, "")
+	require.NoError(t, err)
+	serverCfg := r.ServerConfig()
+
+	changed, err := r.Reload()
+	require.NoError(t, err)
+	assert.False(t, changed, "unchanged files must not be reloaded")
+
+	second, secondKey := issue(t, "server", ca, caKey)
+	writePair(t, dir, "server", second, secondKey)
+	// make the change visible on file systems with coarse modification times
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+
+	changed, err = r.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	cert, err := serverCfg.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.Raw, cert.Certificate[0], "configs created before a reload must use the new certificate")
+
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	_, err = r.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, second.Raw, r.Certificate().Certificate[0], "a failed reload must keep the loaded certificate")
+}
+
+func TestClientConfigReloadsCA(t *testing.T) {
+	dir := t.TempDir()
+	oldCA, oldCAKey := issue(t, "old-ca", nil, nil)
+	caFile, _ := writePair(t, dir, "ca", oldCA, oldCAKey)
+	newCA, newCAKey := issue(t, "new-ca", nil, nil)
+	serverCert, serverKey := issue(t, "server", newCA, newCAKey)
+	serverCertFile, serverKeyFile := writePair(t, dir, "server", serverCert, serverKey)
+
+	server, err := NewReloader(serverCertFile, serverKeyFile, "")
+	require.NoError(t, err)
+	client, err := NewReloader("", "", caFile)
+	require.NoError(t, err)
+	clientCfg := client.ClientConfig()
+	assert.Error(t, handshake(t, server.ServerConfig(), clientCfg), "servers of another CA must be rejected")
+
+	writePair(t, dir, "ca", newCA, newCAKey)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(caFile, later, later))
+	changed, err := client.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+	assert.NoError(t, handshake(t, server.ServerConfig(), clientCfg), "configs created before a reload must use the new CA bundle")
+}
+
+func TestNewReloaderRequiresKeyWithCertificate(t *testing.T) {
+	_, err := NewReloader("server.crt", "", "")
+	assert.Error(t, err)
+
+	_, err = NewReloader("", "server.key", "")
+	assert.Error(t, err)
+}
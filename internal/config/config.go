@@ -16,12 +16,49 @@ import (
 // convert to time.Duration. Instead, the values are manually parsed and converted in functions like
 // parseEnvWithDuration to allow for more flexible input, such as '300' being interpreted as '300s'.
 type Config struct {
-	Addr            string        `env:"ADDRESS"`           // the address and port on which the server will run
+	Addr            string        `env:"ADDRESS"`           // the address and port on which the server will run, for the agent a comma separated list of servers
 	Environment     string        `env:"ENVIRONMENT"`       // the application's environment, can be 'development' or 'production'
 	FileStoragePath string        `env:"FILE_STORAGE_PATH"` // the filename where the current metrics are saved
 	DBDSN           string        `env:"DATABASE_DSN"`      // the Data Source Name for connecting to the database
 	MaxOpenConns    int           `env:"MAX_OPEN_CONNS"`    // max number of open database connections
 	MaxIdleConns    int           `env:"MAX_IDLE_CONNS"`    // max number of idle database connections
+	LogBodyLimit    int           `env:"LOG_BODY_LIMIT"`    // max number of request body bytes written to the request log, 0 disables body logging
+	MaxBodySize     int64         `env:"MAX_BODY_SIZE"`     // max size of a decompressed request body, in bytes
+	RatePoints      int           `env:"RATE_POINTS"`       // number of recent totals the server keeps per counter to compute rates
+	HistoryTiers    string        `env:"HISTORY_TIERS"`     // comma separated 'resolution:retention' tiers of gauge and counter history, empty disables it
+	CompactInterval time.Duration `env:"COMPACT_INTERVAL"`  // interval for removing history that is past its retention, in seconds
+	TokensFile      string        `env:"TOKENS_FILE"`       // file of 'tenant:sha256 hash' bearer tokens of the server, empty disables tenants and authentication
+	RateLimit       float64       `env:"RATE_LIMIT"`        // max sustained requests per second of a client, identified by token or IP, 0 disables rate limiting
+	RateBurst       int           `env:"RATE_BURST"`        // max requests of a client in a burst above the rate limit
+	MaxMetrics      int           `env:"MAX_METRICS"`       // max number of distinct metrics per tenant, 0 is unlimited
+	AuditSink       string        `env:"AUDIT_SINK"`        // where accepted updates are audited, 'file' or 'db', empty disables auditing
+	AuditFile       string        `env:"AUDIT_FILE"`        // JSON lines file of the 'file' audit sink
+	AuditMaxSize    int64         `env:"AUDIT_MAX_SIZE"`    // size at which the audit file is rotated, in bytes, 0 never rotates it
+	AuditBackups    int           `env:"AUDIT_BACKUPS"`     // number of rotated audit files that are kept
+	EventsFile      string        `env:"EVENTS_FILE"`       // JSON lines file that update events are appended to, empty disables the file sink
+	EventsURL       string        `env:"EVENTS_URL"`        // URL that batches of update events are posted to, empty disables the HTTP sink
+	EventsBuffer    int           `env:"EVENTS_BUFFER"`     // max number of events queued per sink, further events are dropped until it catches up
+	DrainDelay      time.Duration `env:"DRAIN_DELAY"`       // time the server keeps serving with a failing readiness check before it shuts down, in seconds
+	DebugAddr       string        `env:"DEBUG_ADDRESS"`     // address of the listener serving self-metrics and pprof, empty disables it
+	Token           string        `env:"TOKEN"`             // bearer token the agent sends to the server, empty sends none
+	TLSCertFile     string        `env:"TLS_CERT_FILE"`     // PEM certificate of the server, empty serves plain HTTP; for the agent the client certificate
+	TLSKeyFile      string        `env:"TLS_KEY_FILE"`      // PEM private key of the certificate in TLSCertFile
+	TLSCAFile       string        `env:"TLS_CA_FILE"`       // PEM CA bundle client certificates must verify against; for the agent the bundle that replaces the system roots
+	SpoolDir        string        `env:"SPOOL_DIR"`         // directory where the agent keeps batches it failed to send, spooling is disabled unless it is set
+	SpoolMaxSize    int64         `env:"SPOOL_MAX_SIZE"`    // max total size of spooled gauge batches, in bytes
+	SpoolMaxAge     time.Duration `env:"SPOOL_MAX_AGE"`     // max age of a spooled gauge batch, in seconds
+	UpstreamMode    string        `env:"UPSTREAM_MODE"`     // how the agent uses multiple servers, 'failover' or 'fanout', fanout requires a spool directory
+	UpstreamRetry   time.Duration `env:"UPSTREAM_RETRY"`    // delay before an unhealthy server is probed again, in seconds
+	Collectors      string        `env:"COLLECTORS"`        // comma separated list of enabled agent collectors with optional intervals, e.g. 'runtime:2,random'
+	ExecConfig      string        `env:"EXEC_CONFIG"`       // file with the shell commands run by the exec collector, one per line
+	ExecTimeout     time.Duration `env:"EXEC_TIMEOUT"`      // max run time of a single exec collector command, in seconds
+	PushAddr        string        `env:"PUSH_ADDRESS"`      // local address or 'unix:/path' socket where the agent accepts metrics from applications, empty disables it
+	PromTargets     string        `env:"PROM_TARGETS"`      // comma separated list of Prometheus endpoint URLs scraped by the prometheus collector
+	PromPrefix      string        `env:"PROM_PREFIX"`       // prefix added to the names of scraped Prometheus metrics
+	PromAllow       string        `env:"PROM_ALLOW"`        // regular expression a scraped series must match to be reported, empty allows all
+	PromDeny        string        `env:"PROM_DENY"`         // regular expression of scraped series that are dropped, empty drops none
+	Processes       string        `env:"PROCESSES"`         // comma separated list of process names or pidfile paths watched by the process collector
+	HistogramBounds string        `env:"HISTOGRAM_BUCKETS"` // comma separated ascending upper bucket bounds of the histograms reported by the agent
 	Restore         bool          `env:"RESTORE"`           // whether to restore previously saved values from a file upon server startup
 	ConnMaxLifetime time.Duration `env:"CONN_MAX_LIFETIME"` // max lifetime of a database connection, in seconds
 	ReportInterval  time.Duration `env:"REPORT_INTERVAL"`   // interval for sending metrics to the server, in seconds
@@ -51,6 +88,59 @@ const (
 	defaultMaxOpenConns    = 25  // in seconds
 	defaultMaxIdleConns    = 25  // in seconds
 	defaultConnMaxLifetime = 300 // in seconds
+
+	defaultLogBodyLimit = 1024     // in bytes
+	defaultMaxBodySize  = 10 << 20 // in bytes
+
+	defaultSpoolDir     = ""
+	defaultSpoolMaxSize = 10 << 20 // in bytes
+	defaultSpoolMaxAge  = 3600     // in seconds
+
+	defaultUpstreamMode  = "failover"
+	defaultUpstreamRetry = 30 // in seconds
+
+	defaultCollectors  = "runtime,random,self"
+	defaultExecConfig  = ""
+	defaultExecTimeout = 5 // in seconds
+	defaultPushAddr    = ""
+
+	defaultPromTargets = ""
+	defaultPromPrefix  = ""
+	defaultPromAllow   = ""
+	defaultPromDeny    = ""
+
+	defaultProcesses = ""
+
+	defaultHistogramBounds = "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10" // request latency buckets, in seconds
+
+	defaultRatePoints = 120
+
+	defaultHistoryTiers    = ""  // history is opt-in, the in-memory storage keeps every point of its tiers in RAM
+	defaultCompactInterval = 300 // in seconds
+
+	defaultTokensFile = ""
+	defaultToken      = ""
+
+	defaultTLSCertFile = ""
+	defaultTLSKeyFile  = ""
+	defaultTLSCAFile   = ""
+
+	defaultRateLimit  = 0
+	defaultRateBurst  = 50
+	defaultMaxMetrics = 0
+
+	defaultAuditSink    = ""
+	defaultAuditFile    = "/tmp/metrics-audit.jsonl"
+	defaultAuditMaxSize = 100 << 20 // in bytes
+	defaultAuditBackups = 5
+
+	defaultEventsFile   = ""
+	defaultEventsURL    = ""
+	defaultEventsBuffer = 1000
+
+	defaultDrainDelay = 0 // in seconds
+
+	defaultDebugAddr = ""
 )
 
 // loadAndParseFlags is responsible for configuring, parsing, and validating
@@ -140,6 +230,24 @@ func loadServerFlags(flagSet *flag.FlagSet, cfg *Config) PostParseSetter {
 	maxOpenConns := flagSet.Int("mo", defaultMaxOpenConns, "Specify the maximum number of open database connections")
 	maxIdleConns := flagSet.Int("mi", defaultMaxIdleConns, "Specify the maximum number of idle database connections")
 	connMaxLifetime := flagSet.Int64("ml", defaultConnMaxLifetime, "Specify the maximum lifetime of a database connection, in seconds")
+	logBodyLimit := flagSet.Int("lb", defaultLogBodyLimit, "Specify the maximum number of request body bytes to log, 0 disables body logging")
+	maxBodySize := flagSet.Int64("mb", defaultMaxBodySize, "Specify the maximum size of a decompressed request body, in bytes")
+	ratePoints := flagSet.Int("rp", defaultRatePoints, "Specify the number of recent totals kept per counter to compute rates, at least 2")
+	historyTiers := flagSet.String("ht", defaultHistoryTiers, "Specify the history tiers as comma separated 'resolution:retention' pairs, e.g. 'raw:1d,1m:30d'; history is disabled unless tiers are given")
+	compactInterval := flagSet.Int64("ci", defaultCompactInterval, "Set the interval for removing history that is past its retention, in seconds")
+	tokensFile := flagSet.String("tf", defaultTokensFile, "Specify the file of 'tenant:sha256 hash' bearer tokens, one per line, empty disables tenants and authentication")
+	rateLimit := flagSet.Float64("rl", defaultRateLimit, "Specify the maximum sustained requests per second of a client, identified by token or IP, 0 disables rate limiting")
+	rateBurst := flagSet.Int("rb", defaultRateBurst, "Specify the maximum requests of a client in a burst above the rate limit")
+	maxMetrics := flagSet.Int("mm", defaultMaxMetrics, "Specify the maximum number of distinct metrics per tenant, 0 is unlimited")
+	auditSink := flagSet.String("as", defaultAuditSink, "Specify where accepted updates are audited, 'file' or 'db' for a table in the database of -d, empty disables auditing")
+	auditFile := flagSet.String("af", defaultAuditFile, "Specify the JSON lines file of the 'file' audit sink")
+	auditMaxSize := flagSet.Int64("az", defaultAuditMaxSize, "Specify the size at which the audit file is rotated, in bytes, 0 never rotates it")
+	auditBackups := flagSet.Int("ab", defaultAuditBackups, "Specify the number of rotated audit files that are kept")
+	eventsFile := flagSet.String("ef", defaultEventsFile, "Specify the JSON lines file that update events are appended to, empty disables the file sink")
+	eventsURL := flagSet.String("eu", defaultEventsURL, "Specify the URL that batches of update events are posted to, empty disables the HTTP sink")
+	eventsBuffer := flagSet.Int("eb", defaultEventsBuffer, "Specify the maximum number of events queued per sink, further events are dropped until it catches up")
+	drainDelay := flagSet.Int64("dd", defaultDrainDelay, "Set the time the server keeps serving with a failing readiness check before it shuts down, in seconds")
+	debugAddr := flagSet.String("da", defaultDebugAddr, "Specify the address of the listener serving self-metrics and pprof, empty disables it")
 
 	return func(cfg *Config) {
 		cfg.ReadTimeout = time.Duration(*readTimeout) * time.Second
@@ -152,6 +260,37 @@ func loadServerFlags(flagSet *flag.FlagSet, cfg *Config) PostParseSetter {
 		cfg.MaxOpenConns = *maxOpenConns
 		cfg.MaxIdleConns = *maxIdleConns
 		cfg.ConnMaxLifetime = time.Duration(*connMaxLifetime) * time.Second
+		cfg.LogBodyLimit = *logBodyLimit
+		cfg.MaxBodySize = *maxBodySize
+		cfg.RatePoints = *ratePoints
+		cfg.HistoryTiers = *historyTiers
+		cfg.CompactInterval = time.Duration(*compactInterval) * time.Second
+		cfg.TokensFile = *tokensFile
+		cfg.RateLimit = *rateLimit
+		cfg.RateBurst = *rateBurst
+		cfg.MaxMetrics = *maxMetrics
+		cfg.AuditSink = *auditSink
+		cfg.AuditFile = *auditFile
+		cfg.AuditMaxSize = *auditMaxSize
+		cfg.AuditBackups = *auditBackups
+		cfg.EventsFile = *eventsFile
+		cfg.EventsURL = *eventsURL
+		cfg.EventsBuffer = *eventsBuffer
+		cfg.DrainDelay = time.Duration(*drainDelay) * time.Second
+		cfg.DebugAddr = *debugAddr
+	}
+}
+
+// loadTLSFlags loads flags related to TLS settings, which the server and the agent share
+func loadTLSFlags(flagSet *flag.FlagSet, cfg *Config) PostParseSetter {
+	certFile := flagSet.String("crt", defaultTLSCertFile, "Specify the PEM certificate of the server, or the client certificate of the agent; the server serves plain HTTP without one")
+	keyFile := flagSet.String("key", defaultTLSKeyFile, "Specify the PEM private key of the certificate")
+	caFile := flagSet.String("ca", defaultTLSCAFile, "Specify the PEM CA bundle that client certificates must verify against, or that the agent verifies the server against")
+
+	return func(cfg *Config) {
+		cfg.TLSCertFile = *certFile
+		cfg.TLSKeyFile = *keyFile
+		cfg.TLSCAFile = *caFile
 	}
 }
 
@@ -159,29 +298,74 @@ func loadServerFlags(flagSet *flag.FlagSet, cfg *Config) PostParseSetter {
 func loadAgentFlags(flagSet *flag.FlagSet, cfg *Config) PostParseSetter {
 	reportInterval := flagSet.Int64("r", defaultReportInterval, "Set the interval for sending metrics to the server, in seconds")
 	pollInterval := flagSet.Int64("p", defaultPollInterval, "Set the interval for polling metrics from the runtime package, in seconds")
+	spoolDir := flagSet.String("sd", defaultSpoolDir, "Specify the directory for batches that could not be sent, e.g. a directory under $XDG_STATE_HOME; empty disables spooling")
+	spoolMaxSize := flagSet.Int64("ss", defaultSpoolMaxSize, "Specify the maximum total size of spooled batches, in bytes")
+	spoolMaxAge := flagSet.Int64("sa", defaultSpoolMaxAge, "Specify the maximum age of a spooled batch, in seconds")
+	upstreamMode := flagSet.String("um", defaultUpstreamMode, "Specify how multiple server addresses are used. Possible values are 'failover' or 'fanout'")
+	upstreamRetry := flagSet.Int64("ur", defaultUpstreamRetry, "Set the delay before an unhealthy server is probed again, in seconds")
+	collectors := flagSet.String("c", defaultCollectors, "Specify the enabled collectors as a comma separated list of name[:interval in seconds]")
+	execConfig := flagSet.String("ec", defaultExecConfig, "Specify the file with the commands run by the exec collector, one per line")
+	execTimeout := flagSet.Int64("et", defaultExecTimeout, "Set the maximum run time of a single exec collector command, in seconds")
+	pushAddr := flagSet.String("la", defaultPushAddr, "Specify the local address or 'unix:/path' socket for applications to push metrics to, empty disables it")
+	maxBodySize := flagSet.Int64("mb", defaultMaxBodySize, "Specify the maximum size of a decompressed request body on the push endpoint, in bytes")
+	promTargets := flagSet.String("pt", defaultPromTargets, "Specify the Prometheus endpoint URLs scraped by the prometheus collector as a comma separated list")
+	promPrefix := flagSet.String("pp", defaultPromPrefix, "Specify the prefix added to the names of scraped Prometheus metrics")
+	promAllow := flagSet.String("pa", defaultPromAllow, "Specify a regular expression a scraped series must match to be reported, empty allows all")
+	promDeny := flagSet.String("pd", defaultPromDeny, "Specify a regular expression of scraped series to drop, empty drops none")
+	processes := flagSet.String("ps", defaultProcesses, "Specify the process names or pidfile paths watched by the process collector as a comma separated list")
+	histogramBounds := flagSet.String("hb", defaultHistogramBounds, "Specify the ascending upper bucket bounds of the histograms reported by the agent as a comma separated list")
+	token := flagSet.String("tk", defaultToken, "Specify the bearer token sent to the server, empty sends none")
 
 	return func(cfg *Config) {
 		cfg.ReportInterval = time.Duration(*reportInterval) * time.Second
 		cfg.PollInterval = time.Duration(*pollInterval) * time.Second
+		cfg.SpoolDir = *spoolDir
+		cfg.SpoolMaxSize = *spoolMaxSize
+		cfg.SpoolMaxAge = time.Duration(*spoolMaxAge) * time.Second
+		cfg.UpstreamMode = *upstreamMode
+		cfg.UpstreamRetry = time.Duration(*upstreamRetry) * time.Second
+		cfg.Collectors = *collectors
+		cfg.ExecConfig = *execConfig
+		cfg.ExecTimeout = time.Duration(*execTimeout) * time.Second
+		cfg.PushAddr = *pushAddr
+		cfg.MaxBodySize = *maxBodySize
+		cfg.PromTargets = *promTargets
+		cfg.PromPrefix = *promPrefix
+		cfg.PromAllow = *promAllow
+		cfg.PromDeny = *promDeny
+		cfg.Processes = *processes
+		cfg.HistogramBounds = *histogramBounds
+		cfg.Token = *token
 	}
 }
 
 // parseServerConfig creates a new Config and populates it with server-related settings
 func ParseServerConfig() (*Config, error) {
 	cfg := &Config{}
-	if err := loadAndParseFlags(cfg, loadGeneralFlags, loadServerFlags); err != nil {
+	if err := loadAndParseFlags(cfg, loadGeneralFlags, loadServerFlags, loadTLSFlags); err != nil {
 		return nil, err
 	}
 	return cfg, loadFromEnv(cfg)
 }
 
 // parseAgentConfig creates a new Config and populates it with agent-related settings
+// the poll and report intervals must be positive
 func ParseAgentConfig() (*Config, error) {
 	cfg := &Config{}
-	if err := loadAndParseFlags(cfg, loadGeneralFlags, loadAgentFlags); err != nil {
+	if err := loadAndParseFlags(cfg, loadGeneralFlags, loadAgentFlags, loadTLSFlags); err != nil {
 		return nil, err
 	}
-	return cfg, loadFromEnv(cfg)
+	if err := loadFromEnv(cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.PollInterval <= 0 {
+		return cfg, fmt.Errorf("invalid poll interval: %s, it must be positive", cfg.PollInterval)
+	}
+	if cfg.ReportInterval <= 0 {
+		return cfg, fmt.Errorf("invalid report interval: %s, it must be positive", cfg.ReportInterval)
+	}
+	return cfg, nil
 }
 
 // loadFromEnv overrides Config fields from environment variables
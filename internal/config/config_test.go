@@ -88,3 +88,12 @@ func TestParseConfig(t *testing.T) {
 	}
 
 }
+
+func TestParseAgentConfigIntervals(t *testing.T) {
+	for _, args := range [][]string{{"-p", "0"}, {"-r", "-1"}} {
+		os.Args = append([]string{"cmd"}, args...)
+		if _, err := ParseAgentConfig(); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package constants
 
 const (
-	MetricTypeGauge   = "gauge"
-	MetricTypeCounter = "counter"
-	ApplicationJSON   = "application/json"
-	TextPlain         = "text/plain"
+	MetricTypeGauge     = "gauge"
+	MetricTypeCounter   = "counter"
+	MetricTypeHistogram = "histogram"
+	MetricTypeSummary   = "summary"
+	MetricTypeSet       = "set"
+	ApplicationJSON     = "application/json"
+	TextPlain           = "text/plain"
+	AgentMetricPrefix   = "agent." // reserved name prefix for the agent's own operational metrics
 )
@@ -0,0 +1,133 @@
+package hll
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// Precision is the number of hash bits used to pick a register, the standard error of the estimate
+	// is 1.04 / sqrt(2^Precision), about 0.8%
+	Precision = 14
+	// Registers is the number of registers of a sketch
+	Registers = 1 << Precision
+	// maxRank is the largest value a register can hold
+	maxRank = 64 - Precision + 1
+)
+
+// Sketch is a HyperLogLog sketch that estimates the number of distinct members added to it
+// in a fixed amount of memory; two sketches merge into exactly the sketch of the union of their members,
+// so sets reported by different agents or in different batches can be combined in any order
+type Sketch struct {
+	Registers []byte `json:"registers,omitempty"` // maximum rank per register, empty for an empty sketch
+}
+
+// New creates an empty sketch
+func New() Sketch {
+	return Sketch{Registers: make([]byte, Registers)}
+}
+
+// hash returns a well mixed 64 bit hash of member, it is stable across processes and versions
+// so that sketches built on different hosts can be merged
+func hash(member string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(member))
+	x := h.Sum64()
+
+	// murmur3 finalizer, fnv alone does not spread short inputs over the high bits
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add records a member
+func (s *Sketch) Add(member string) {
+	if len(s.Registers) == 0 {
+		s.Registers = make([]byte, Registers)
+	}
+
+	x := hash(member)
+	index := x >> (64 - Precision)
+	// the guard bit caps the rank at maxRank when all remaining bits are zero
+	rank := byte(bits.LeadingZeros64(x<<Precision|1<<(Precision-1)) + 1)
+	if rank > s.Registers[index] {
+		s.Registers[index] = rank
+	}
+}
+
+// Merge returns the sketch of the union of the members of s and other
+func (s Sketch) Merge(other Sketch) Sketch {
+	if len(other.Registers) == 0 {
+		return s.Clone()
+	}
+	if len(s.Registers) == 0 {
+		return other.Clone()
+	}
+
+	merged := s.Clone()
+	for i, rank := range other.Registers {
+		if rank > merged.Registers[i] {
+			merged.Registers[i] = rank
+		}
+	}
+	return merged
+}
+
+// Clone returns a deep copy of s
+func (s Sketch) Clone() Sketch {
+	if len(s.Registers) == 0 {
+		return Sketch{}
+	}
+	return Sketch{Registers: append([]byte(nil), s.Registers...)}
+}
+
+// Estimate returns the estimated number of distinct members, small cardinalities are
+// estimated by linear counting over the empty registers
+func (s Sketch) Estimate() uint64 {
+	if len(s.Registers) == 0 {
+		return 0
+	}
+
+	m := float64(Registers)
+	var sum float64
+	var empty int
+	for _, rank := range s.Registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			empty++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && empty > 0 {
+		estimate = m * math.Log(m/float64(empty))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// Validate checks that the sketch is empty or has exactly Registers registers holding possible ranks
+func (s Sketch) Validate() error {
+	if len(s.Registers) == 0 {
+		return nil
+	}
+	if len(s.Registers) != Registers {
+		return fmt.Errorf("set sketch has %d registers, expected %d", len(s.Registers), Registers)
+	}
+	for i, rank := range s.Registers {
+		if rank > maxRank {
+			return fmt.Errorf("set sketch register %d holds impossible rank %d", i, rank)
+		}
+	}
+	return nil
+}
+
+// String formats the estimated cardinality
+func (s Sketch) String() string {
+	return fmt.Sprintf("~%d", s.Estimate())
+}
@@ -0,0 +1,76 @@
+package hll
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		s := New()
+		for i := 0; i < n; i++ {
+			s.Add(fmt.Sprintf("user-%d", i))
+			// duplicates do not change the estimate
+			s.Add(fmt.Sprintf("user-%d", i))
+		}
+
+		if n == 0 {
+			assert.Equal(t, uint64(0), s.Estimate())
+			continue
+		}
+		assert.InEpsilon(t, n, s.Estimate(), 0.03, "n=%d", n)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, all := New(), New(), New()
+	for i := 0; i < 5000; i++ {
+		member := fmt.Sprintf("host-%d", i)
+		if i < 3000 {
+			a.Add(member)
+		}
+		if i >= 2000 {
+			b.Add(member)
+		}
+		all.Add(member)
+	}
+
+	assert.Equal(t, all, a.Merge(b))
+	assert.Equal(t, all, b.Merge(a))
+	assert.Equal(t, a, a.Merge(Sketch{}))
+	assert.Equal(t, a, Sketch{}.Merge(a))
+
+	merged := Sketch{}.Merge(a)
+	merged.Registers[0]++
+	assert.NotEqual(t, merged.Registers[0], a.Registers[0], "merge must not share registers")
+}
+
+func TestValidate(t *testing.T) {
+	s := New()
+	s.Add("a")
+	require.NoError(t, s.Validate())
+	require.NoError(t, Sketch{}.Validate())
+
+	assert.Error(t, Sketch{Registers: make([]byte, 16)}.Validate())
+
+	s.Registers[0] = maxRank + 1
+	assert.Error(t, s.Validate())
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	s := New()
+	s.Add("a")
+	s.Add("b")
+
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+
+	var decoded Sketch
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, s, decoded)
+	assert.Equal(t, uint64(2), decoded.Estimate())
+}
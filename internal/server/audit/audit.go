@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+// Entry records a single accepted metric update
+type Entry struct {
+	ID       int64     `json:"id" db:"id"` // position in the log assigned by the sink, increasing in the order entries were written
+	Time     time.Time `json:"time" db:"ts"`
+	Client   string    `json:"client" db:"client"`                 // IP address of the client
+	Identity string    `json:"identity,omitempty" db:"identity"`   // common name of the client certificate, if it presented one
+	Tenant   string    `json:"tenant,omitempty" db:"tenant"`       // tenant of the bearer token, empty for the default tenant
+	MType    string    `json:"type" db:"type"`                     // type of the metric
+	Name     string    `json:"name" db:"name"`                     // name of the metric
+	Old      *float64  `json:"old,omitempty" db:"old_value"`       // value of a gauge before the update, nil for a new gauge
+	New      *float64  `json:"new,omitempty" db:"new_value"`       // value of a gauge after the update
+	Delta    *int64    `json:"delta,omitempty" db:"counter_delta"` // delta added to a counter
+}
+
+// Filter selects entries of a tenant, empty Name selects every metric, zero Since every time and zero After every id
+type Filter struct {
+	Tenant string
+	Name   string
+	Since  time.Time // entries at or after Since are selected
+	After  int64     // entries with a greater id are selected; the id of the last entry read pages to the next ones
+	Limit  int       // at most Limit entries are returned, the oldest first
+}
+
+// Match reports whether the filter selects e, the limit is not considered
+func (f Filter) Match(e Entry) bool {
+	return e.Tenant == f.Tenant && (f.Name == "" || e.Name == f.Name) && !e.Time.Before(f.Since) && e.ID > f.After
+}
+
+// Sink stores entries and reads them back
+type Sink interface {
+	// Write appends entries to the sink in their order, assigning them ids greater than those of all earlier entries
+	Write(ctx context.Context, entries []Entry) error
+
+	// Read returns the entries selected by f in the order they were written
+	Read(ctx context.Context, f Filter) ([]Entry, error)
+
+	// Close releases the resources of the sink
+	Close() error
+}
+
+// Log fills in who made the updates reported by storages and writes them to a sink;
+// a nil Log is disabled
+type Log struct {
+	sink   Sink
+	sugar  *zap.SugaredLogger
+	now    func() time.Time
+	failed atomic.Int64
+}
+
+// NewLog creates a log writing to sink
+func NewLog(sugar *zap.SugaredLogger, sink Sink) *Log {
+	return &Log{sink: sink, sugar: sugar, now: time.Now}
+}
+
+// Enabled reports whether updates are recorded
+func (l *Log) Enabled() bool {
+	return l != nil
+}
+
+// Record writes entries of updates made by the client in ctx, stamped with the current time;
+// the updates are already applied, so a failed write is logged and counted instead of returned
+func (l *Log) Record(ctx context.Context, entries []Entry) {
+	if !l.Enabled() || len(entries) == 0 {
+		return
+	}
+
+	c, _ := ctx.Value(clientKey{}).(client)
+	now := l.now().UTC()
+	for i := range entries {
+		entries[i].Time = now
+		entries[i].Client = c.addr
+		entries[i].Identity = c.identity
+		entries[i].Tenant = tenant.FromContext(ctx)
+	}
+
+	if err := l.sink.Write(ctx, entries); err != nil {
+		l.failed.Add(1)
+		l.sugar.Errorw("Failed to write audit entries", "err", err, "entries", len(entries))
+	}
+}
+
+// Read returns the entries of the tenant in ctx selected by the other fields of f
+func (l *Log) Read(ctx context.Context, f Filter) ([]Entry, error) {
+	f.Tenant = tenant.FromContext(ctx)
+	return l.sink.Read(ctx, f)
+}
+
+// Failed returns the number of writes that failed so far
+func (l *Log) Failed() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.failed.Load()
+}
+
+// Close closes the sink
+func (l *Log) Close() error {
+	return l.sink.Close()
+}
+
+// Setter is implemented by storages that record the updates they apply
+type Setter interface {
+	// SetAudit makes the storage record accepted updates in l
+	SetAudit(l *Log)
+}
+
+// clientKey is the context key of the client of a request
+type clientKey struct{}
+
+// client identifies who sent a request
+type client struct {
+	addr     string
+	identity string
+}
+
+// Scope returns ctx with the client of r, whose updates Record attributes to it
+func Scope(ctx context.Context, r *http.Request) context.Context {
+	c := client{addr: utils.RemoteIP(r)}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		c.identity = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// Entries returns the entries of a batch of updates applied in order, metrics are identified by their names
+// without the tenant; old holds the values of the updated gauges before the batch, a gauge updated twice
+// has the first value as the old value of the second update
+func Entries(metrics []models.Metrics, old map[string]float64) []Entry {
+	gauges := make(map[string]float64, len(old))
+	for name, value := range old {
+		gauges[name] = value
+	}
+
+	entries := make([]Entry, len(metrics))
+	for i, metric := range metrics {
+		entries[i] = Entry{MType: metric.MType, Name: metric.ID}
+		switch metric.MType {
+		case constants.MetricTypeGauge:
+			if value, ok := gauges[metric.ID]; ok {
+				entries[i].Old = &value
+			}
+			value := *metric.Value
+			entries[i].New = &value
+			gauges[metric.ID] = value
+		case constants.MetricTypeCounter:
+			delta := *metric.Delta
+			entries[i].Delta = &delta
+		}
+	}
+	return entries
+}
@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+)
+
+func TestEntries(t *testing.T) {
+	first, second, delta := 1.5, 2.5, int64(3)
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &first},
+		{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &second},
+		{ID: "Frees", MType: constants.MetricTypeGauge, Value: &first},
+		{ID: "PollCount", MType: constants.MetricTypeCounter, Delta: &delta},
+		{ID: "Latency", MType: constants.MetricTypeHistogram},
+	}
+
+	entries := Entries(metrics, map[string]float64{"Alloc": 0.5})
+	require.Len(t, entries, 5)
+
+	assert.Equal(t, 0.5, *entries[0].Old)
+	assert.Equal(t, 1.5, *entries[0].New)
+	assert.Equal(t, 1.5, *entries[1].Old, "a gauge updated twice has the first value as old value")
+	assert.Equal(t, 2.5, *entries[1].New)
+	assert.Nil(t, entries[2].Old, "a new gauge has no old value")
+	assert.Equal(t, int64(3), *entries[3].Delta)
+	assert.Equal(t, Entry{MType: constants.MetricTypeHistogram, Name: "Latency"}, entries[4])
+
+	first = 9
+	assert.Equal(t, 1.5, *entries[0].New, "entries must not alias the values of the metrics")
+}
+
+func TestLogRecord(t *testing.T) {
+	sink, err := NewFileSink(t.TempDir()+"/audit.jsonl", 0, 0)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	l := NewLog(zap.NewNop().Sugar(), sink)
+	at := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	l.now = func() time.Time { return at }
+
+	r := httptest.NewRequest("POST", "/update/gauge/Alloc/1", nil)
+	r.RemoteAddr = "192.0.2.7:51234"
+	team := Scope(tenant.NewContext(context.Background(), "team"), r)
+
+	value := 1.0
+	l.Record(team, Entries([]models.Metrics{{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &value}}, nil))
+	l.Record(Scope(context.Background(), r), Entries([]models.Metrics{{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &value}}, nil))
+
+	entries, err := l.Read(team, Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "only the entries of the tenant are read")
+	assert.Equal(t, at, entries[0].Time)
+	assert.Equal(t, "192.0.2.7", entries[0].Client)
+	assert.Equal(t, "team", entries[0].Tenant)
+	assert.Equal(t, "Alloc", entries[0].Name)
+	assert.Zero(t, l.Failed())
+
+	var disabled *Log
+	assert.False(t, disabled.Enabled())
+	disabled.Record(team, entries)
+}
+
+func TestFileSink(t *testing.T) {
+	path := t.TempDir() + "/audit.jsonl"
+	// every entry is about 80 bytes, so each file holds two of them
+	sink, err := NewFileSink(path, 200, 2)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	ctx := context.Background()
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		name := "Alloc"
+		if i%2 == 1 {
+			name = "Frees"
+		}
+		entry := Entry{Time: start.Add(time.Duration(i) * time.Minute), Client: "192.0.2.7", MType: constants.MetricTypeGauge, Name: name}
+		require.NoError(t, sink.Write(ctx, []Entry{entry}))
+	}
+
+	_, err = os.Stat(path + ".2")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only two rotated files are kept")
+
+	tests := []struct {
+		name    string
+		filter  Filter
+		minutes []int
+	}{
+		{"all kept entries", Filter{}, []int{2, 3, 4, 5, 6, 7}},
+		{"by name", Filter{Name: "Alloc"}, []int{2, 4, 6}},
+		{"since", Filter{Since: start.Add(5 * time.Minute)}, []int{5, 6, 7}},
+		{"limit", Filter{Limit: 3}, []int{2, 3, 4}},
+		{"other tenant", Filter{Tenant: "team"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := sink.Read(ctx, tt.filter)
+			require.NoError(t, err)
+
+			var minutes []int
+			for _, e := range entries {
+				minutes = append(minutes, int(e.Time.Sub(start)/time.Minute))
+			}
+			assert.Equal(t, tt.minutes, minutes)
+		})
+	}
+}
+
+func TestFileSinkIDs(t *testing.T) {
+	path := t.TempDir() + "/audit.jsonl"
+	sink, err := NewFileSink(path, 0, 0)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	entries := make([]Entry, 7)
+	for i := range entries {
+		entries[i] = Entry{MType: constants.MetricTypeGauge, Name: fmt.Sprintf("m%d", i)}
+	}
+	require.NoError(t, sink.Write(ctx, entries))
+
+	// the entries of a batch share their time, so only the id tells where a page ended
+	var names []string
+	f := Filter{Limit: 3}
+	for {
+		page, err := sink.Read(ctx, f)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		for _, e := range page {
+			names = append(names, e.Name)
+		}
+		f.After = page[len(page)-1].ID
+	}
+	assert.Equal(t, []string{"m0", "m1", "m2", "m3", "m4", "m5", "m6"}, names)
+	require.NoError(t, sink.Close())
+
+	reopened, err := NewFileSink(path, 0, 0)
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.NoError(t, reopened.Write(ctx, entries[:1]))
+
+	read, err := reopened.Read(ctx, Filter{After: 7})
+	require.NoError(t, err)
+	require.Len(t, read, 1)
+	assert.Equal(t, int64(8), read[0].ID, "ids continue after the entries of earlier runs")
+}
+
+func TestReadSQL(t *testing.T) {
+	since := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+
+	stmt, args := readSQL(Filter{Tenant: "team", Name: "Alloc", Since: since, After: 7, Limit: 10})
+	assert.Contains(t, stmt, "WHERE tenant = $1 AND name = $2 AND ts >= $3 AND id > $4 ORDER BY id LIMIT $5")
+	assert.Equal(t, []interface{}{"team", "Alloc", since, int64(7), 10}, args)
+
+	stmt, args = readSQL(Filter{})
+	assert.Contains(t, stmt, "WHERE tenant = $1 ORDER BY id")
+	assert.NotContains(t, stmt, "LIMIT")
+	assert.Equal(t, []interface{}{""}, args)
+}
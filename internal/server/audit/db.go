@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DBSink writes entries to the audit_log table of a Postgres database
+type DBSink struct {
+	db *sqlx.DB
+}
+
+// NewDBSink connects to the database at dsn and creates the audit_log table if it does not exist
+func NewDBSink(ctx context.Context, dsn string) (*DBSink, error) {
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			ts TIMESTAMPTZ NOT NULL,
+			client VARCHAR(255) NOT NULL,
+			identity VARCHAR(255) NOT NULL,
+			tenant VARCHAR(255) NOT NULL,
+			type VARCHAR(16) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			old_value DOUBLE PRECISION,
+			new_value DOUBLE PRECISION,
+			counter_delta BIGINT
+		);
+		CREATE INDEX IF NOT EXISTS audit_log_tenant_ts_index ON audit_log (tenant, ts);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &DBSink{db: db}, nil
+}
+
+// insertChunkSize is the number of entries inserted per statement, which keeps the number of
+// statement parameters below the limit of Postgres
+const insertChunkSize = 1000
+
+// writeLockID identifies the advisory lock serializing the writes to audit_log
+const writeLockID = 0x61756469 // "audi"
+
+// Write inserts entries in a single transaction, so a batch is recorded completely or not at all;
+// writes are serialized, so ids become visible in increasing order and a reader paging by id
+// never skips an entry whose transaction commits later with a smaller id
+func (s *DBSink) Write(ctx context.Context, entries []Entry) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after a successful commit
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", writeLockID); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(entries); start += insertChunkSize {
+		end := start + insertChunkSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		_, err := tx.NamedExecContext(ctx, `
+		INSERT INTO audit_log (ts, client, identity, tenant, type, name, old_value, new_value, counter_delta)
+		VALUES (:ts, :client, :identity, :tenant, :type, :name, :old_value, :new_value, :counter_delta)
+	`, entries[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Read selects the entries in the order of their ids, which is the order they were written
+func (s *DBSink) Read(ctx context.Context, f Filter) ([]Entry, error) {
+	stmt, args := readSQL(f)
+	entries := []Entry{}
+	if err := s.db.SelectContext(ctx, &entries, stmt, args...); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readSQL builds the statement selecting the entries of f and its arguments
+func readSQL(f Filter) (string, []interface{}) {
+	where := []string{"tenant = $1"}
+	args := []interface{}{f.Tenant}
+
+	if f.Name != "" {
+		args = append(args, f.Name)
+		where = append(where, "name = $"+strconv.Itoa(len(args)))
+	}
+	if !f.Since.IsZero() {
+		args = append(args, f.Since)
+		where = append(where, "ts >= $"+strconv.Itoa(len(args)))
+	}
+	if f.After > 0 {
+		args = append(args, f.After)
+		where = append(where, "id > $"+strconv.Itoa(len(args)))
+	}
+
+	stmt := "SELECT id, ts, client, identity, tenant, type, name, old_value, new_value, counter_delta FROM audit_log WHERE " +
+		strings.Join(where, " AND ") + " ORDER BY id"
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		stmt += " LIMIT $" + strconv.Itoa(len(args))
+	}
+	return stmt, args
+}
+
+// Close closes the database connection
+func (s *DBSink) Close() error {
+	return s.db.Close()
+}
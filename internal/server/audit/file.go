@@ -0,0 +1,236 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// FileSink writes entries as JSON lines to a file, which is rotated once it would grow beyond maxSize;
+// rotated files are renamed to path.1, path.2 and so on, and only the newest backups of them are kept
+type FileSink struct {
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+	lastID  int64 // id of the last written entry
+	mu      sync.Mutex
+}
+
+// NewFileSink opens the file at path for appending, maxSize <= 0 never rotates it;
+// ids continue after the last entry in the existing files
+func NewFileSink(path string, maxSize int64, backups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, backups: backups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	lastID, err := s.findLastID()
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	s.lastID = lastID
+	return s, nil
+}
+
+// findLastID returns the greatest id in the newest file holding entries, 0 if there are none
+func (s *FileSink) findLastID() (int64, error) {
+	for n := 0; n <= s.backups; n++ {
+		file, err := os.Open(s.backup(n))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var lastID int64
+		err = scanEntries(file, func(e Entry) bool {
+			if e.ID > lastID {
+				lastID = e.ID
+			}
+			return true
+		})
+		file.Close()
+		if err != nil || lastID > 0 {
+			return lastID, err
+		}
+	}
+	return 0, nil
+}
+
+// open opens the current file for appending, the caller must hold the lock
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// backup returns the path of the n-th rotated file, the current file for n = 0
+func (s *FileSink) backup(n int) string {
+	if n == 0 {
+		return s.path
+	}
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// rotate moves the current file to the first backup, shifting the older ones and dropping the oldest,
+// and opens a new current file; the caller must hold the lock
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.backup(s.backups)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for n := s.backups - 1; n >= 0; n-- {
+		if err := os.Rename(s.backup(n), s.backup(n+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return s.open()
+}
+
+// Write appends entries to the current file, rotating it first if they do not fit into it anymore;
+// a batch is never split across files, and its ids are only used up if it was written
+func (s *FileSink) Write(ctx context.Context, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, entry := range entries {
+		entry.ID = s.lastID + int64(i) + 1
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(buf.Len()) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	s.lastID += int64(len(entries))
+	return nil
+}
+
+// Read scans the rotated files from the oldest and then the current file for the entries selected by f;
+// the lock is only held while the files are opened, so that reading does not block writes
+func (s *FileSink) Read(ctx context.Context, f Filter) ([]Entry, error) {
+	files, err := s.openAll()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll(files)
+
+	entries := []Entry{}
+	for _, opened := range files {
+		err := scanEntries(opened.r, func(e Entry) bool {
+			if f.Match(e) {
+				entries = append(entries, e)
+			}
+			return f.Limit <= 0 || len(entries) < f.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if f.Limit > 0 && len(entries) >= f.Limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// openedFile is a file opened for reading by Read
+type openedFile struct {
+	file *os.File
+	r    io.Reader // reads the file up to the size it had when it was opened
+}
+
+// openAll opens the existing rotated files from the oldest and the current file up to its current size;
+// open files keep their contents when they are rotated away, so they can be read without the lock
+func (s *FileSink) openAll() ([]openedFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []openedFile
+	for n := s.backups; n >= 0; n-- {
+		file, err := os.Open(s.backup(n))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			closeAll(files)
+			return nil, err
+		}
+
+		var r io.Reader = file
+		if n == 0 {
+			r = io.LimitReader(file, s.size)
+		}
+		files = append(files, openedFile{file: file, r: r})
+	}
+	return files, nil
+}
+
+// closeAll closes files opened by openAll
+func closeAll(files []openedFile) {
+	for _, opened := range files {
+		opened.file.Close()
+	}
+}
+
+// scanEntries calls visit for every entry read from r until it returns false;
+// lines that are not entries, such as one cut off by a crash, are skipped
+func scanEntries(r io.Reader, visit func(Entry) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if !visit(e) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the current file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
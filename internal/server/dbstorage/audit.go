@@ -0,0 +1,72 @@
+package dbstorage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/query"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+)
+
+// SetAudit makes the storage record accepted updates in l, it must be called before the storage is used
+func (s *DBStorage) SetAudit(l *audit.Log) {
+	s.audit = l
+}
+
+// inAuditedTx runs fn like inTx and records the updates in the audit log once the transaction is committed;
+// the updates name their metrics without the tenant
+func (s *DBStorage) inAuditedTx(ctx context.Context, updates []models.Metrics, fn func(tx *sqlx.Tx) error) error {
+	var entries []audit.Entry
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		if entries, err = s.auditEntries(ctx, tx, updates); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, entries)
+	return nil
+}
+
+// auditEntries returns within tx the audit entries of updates that are about to be applied, nil if auditing is disabled;
+// the rows of the updated gauges are locked, so that their old values cannot change before tx ends
+func (s *DBStorage) auditEntries(ctx context.Context, tx *sqlx.Tx, updates []models.Metrics) ([]audit.Entry, error) {
+	if !s.audit.Enabled() {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, metric := range updates {
+		if metric.MType == constants.MetricTypeGauge {
+			keys = append(keys, tenant.Key(ctx, metric.ID))
+		}
+	}
+
+	old := make(map[string]float64)
+	if len(keys) > 0 {
+		// rows are locked in name order like the batch upserts, so that concurrent batches cannot deadlock
+		sort.Strings(keys)
+		var stored []query.Sample
+		err := tx.SelectContext(ctx, &stored, "SELECT name, value FROM gauges WHERE name = ANY($1) ORDER BY name FOR UPDATE", pq.Array(keys))
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range stored {
+			if name, ok := tenant.Name(ctx, sample.Name); ok {
+				old[name] = sample.Value
+			}
+		}
+	}
+
+	return audit.Entries(updates, old), nil
+}
@@ -2,19 +2,35 @@ package dbstorage
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 // DBStorage struct for database storage
 type DBStorage struct {
-	db *sqlx.DB
+	db         *sqlx.DB
+	tiers      history.Tiers // history tiers of gauge values and counter totals, empty if history is disabled
+	ratePoints int
+	quota      *limits.Quota // cap on the number of metrics of every tenant, nil if unlimited
+	audit      *audit.Log    // log of accepted updates, nil if auditing is disabled
 }
 
 // Interface defines methods for database storage
@@ -23,6 +39,7 @@ type Interface interface {
 	Ping() error
 	CreateTables(ctx context.Context) error
 	Close() error
+	Stats() sql.DBStats
 }
 
 // NewDBStorage initializes new database storage
@@ -37,7 +54,17 @@ func NewDBStorage(cfg *config.Config) (*DBStorage, error) {
 	db.SetMaxIdleConns(cfg.MaxIdleConns)
 	db.SetConnMaxLifetime(cfg.ConnMaxLifetime * time.Second)
 
-	storage := &DBStorage{db: db}
+	ratePoints := cfg.RatePoints
+	if ratePoints < 2 {
+		ratePoints = 2
+	}
+
+	tiers, err := history.ParseTiers(cfg.HistoryTiers)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &DBStorage{db: db, tiers: tiers, ratePoints: ratePoints}
 
 	return storage, nil
 }
@@ -56,6 +83,16 @@ func (s *DBStorage) Ping() error {
 	return s.db.Ping()
 }
 
+// PingContext checks the database connection until ctx is done
+func (s *DBStorage) PingContext(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Stats returns the statistics of the connection pool
+func (s *DBStorage) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
 // CreateTables creates necessary tables in the database
 func (s *DBStorage) CreateTables(ctx context.Context) error {
 	_, err := s.db.ExecContext(ctx, `
@@ -69,6 +106,43 @@ func (s *DBStorage) CreateTables(ctx context.Context) error {
 			name VARCHAR(255) UNIQUE NOT NULL,
 			value BIGINT NOT NULL
 		);
+		CREATE TABLE IF NOT EXISTS histograms (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) UNIQUE NOT NULL,
+			bounds DOUBLE PRECISION[] NOT NULL,
+			buckets BIGINT[] NOT NULL,
+			sum DOUBLE PRECISION NOT NULL,
+			count BIGINT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS summaries (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) UNIQUE NOT NULL,
+			sketch JSONB NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS sets (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) UNIQUE NOT NULL,
+			registers BYTEA NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS counter_points (
+			id BIGSERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			ts TIMESTAMPTZ NOT NULL,
+			total BIGINT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS counter_points_name_ts_index ON counter_points (name, ts);
+		CREATE TABLE IF NOT EXISTS samples (
+			resolution_ms BIGINT NOT NULL,
+			type VARCHAR(16) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			ts TIMESTAMPTZ NOT NULL,
+			min DOUBLE PRECISION NOT NULL,
+			max DOUBLE PRECISION NOT NULL,
+			sum DOUBLE PRECISION NOT NULL,
+			last DOUBLE PRECISION NOT NULL,
+			count BIGINT NOT NULL,
+			PRIMARY KEY (resolution_ms, type, name, ts)
+		);
 	`)
 	if err != nil {
 		return err
@@ -87,59 +161,380 @@ func (s *DBStorage) CreateTables(ctx context.Context) error {
 	return nil
 }
 
-// UpdateGauge updates the gauge metric in the database
+// UpdateGauge updates the gauge metric in the database and records the value in its history
 func (s *DBStorage) UpdateGauge(ctx context.Context, name string, value float64, shouldNotify bool) error {
-	stmt, err := s.db.PreparexContext(ctx, `
+	key := tenant.Key(ctx, name)
+
+	return s.inAuditedTx(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeGauge, Value: &value}}, func(tx *sqlx.Tx) error {
+		if err := s.admit(ctx, tx, map[string][]string{"gauges": {key}}); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `
 			INSERT INTO gauges (name, value) VALUES ($1, $2)
 			ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value;
-	`)
+	`, key, value)
+		if err != nil {
+			return err
+		}
+
+		gauges := gaugeBatch{names: []string{key}, values: []float64{value}}
+		return recordHistory(ctx, tx, s.tiers, time.Now(), gauges, nil)
+	})
+}
+
+// UpdateCounter updates the counter metric in the database and records its new total for rates
+func (s *DBStorage) UpdateCounter(ctx context.Context, name string, value int64, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	return s.inAuditedTx(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeCounter, Delta: &value}}, func(tx *sqlx.Tx) error {
+		if err := s.admit(ctx, tx, map[string][]string{"counters": {key}}); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO counters (name, value) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value;
+	`, key, value)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := recordCounterPoints(ctx, tx, []string{key}, now, s.ratePoints); err != nil {
+			return err
+		}
+		return recordHistory(ctx, tx, s.tiers, now, gaugeBatch{}, []string{key})
+	})
+}
+
+// sampleUpsert folds a new sample row into the existing point of its tier interval
+const sampleUpsert = `
+	ON CONFLICT (resolution_ms, type, name, ts) DO UPDATE SET
+		min = LEAST(samples.min, EXCLUDED.min),
+		max = GREATEST(samples.max, EXCLUDED.max),
+		sum = samples.sum + EXCLUDED.sum,
+		last = EXCLUDED.last,
+		count = samples.count + EXCLUDED.count;
+`
+
+// recordHistory records the gauge values and the current totals of the named counters at now in every tier
+// rollup tiers are updated in place, so compaction only has to delete expired rows
+func recordHistory(ctx context.Context, tx *sqlx.Tx, tiers history.Tiers, now time.Time, gauges gaugeBatch, counterNames []string) error {
+	for _, tier := range tiers {
+		resolution, bucket := tier.Resolution.Milliseconds(), tier.Bucket(now)
+
+		if len(gauges.names) > 0 {
+			_, err := tx.ExecContext(ctx, `
+	INSERT INTO samples (resolution_ms, type, name, ts, min, max, sum, last, count)
+	SELECT $1, 'gauge', name, $2, value, value, value, value, 1
+	FROM unnest($3::varchar[], $4::double precision[]) AS batch(name, value)`+sampleUpsert,
+				resolution, bucket, pq.Array(gauges.names), pq.Array(gauges.values))
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(counterNames) > 0 {
+			_, err := tx.ExecContext(ctx, `
+	INSERT INTO samples (resolution_ms, type, name, ts, min, max, sum, last, count)
+	SELECT $1, 'counter', name, $2, value, value, value, value, 1
+	FROM counters WHERE name = ANY($3)`+sampleUpsert,
+				resolution, bucket, pq.Array(counterNames))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetHistory fetches the recorded points of a gauge or counter between from and to
+func (s *DBStorage) GetHistory(ctx context.Context, mtype, name string, from, to time.Time) (history.Tier, []history.Point, error) {
+	key := tenant.Key(ctx, name)
+
+	tier, ok := s.tiers.Pick(time.Now(), from)
+	if !ok {
+		return history.Tier{}, nil, history.ErrDisabled
+	}
+
+	var points []history.Point
+	err := s.db.SelectContext(ctx, &points, `
+	SELECT ts AS time, min, max, sum, last, count FROM samples
+	WHERE resolution_ms = $1 AND type = $2 AND name = $3 AND ts >= $4 AND ts <= $5
+	ORDER BY ts;
+`, tier.Resolution.Milliseconds(), mtype, key, tier.Bucket(from), to)
+	if err != nil {
+		return history.Tier{}, nil, err
+	}
+
+	return tier, history.WithAvg(points), nil
+}
+
+// CompactHistory deletes the rows that are past the retention of their tier
+// as well as the rows of tiers that are no longer configured
+func (s *DBStorage) CompactHistory(ctx context.Context, now time.Time) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		resolutions := make([]int64, 0, len(s.tiers))
+		for _, tier := range s.tiers {
+			resolutions = append(resolutions, tier.Resolution.Milliseconds())
+
+			_, err := tx.ExecContext(ctx, "DELETE FROM samples WHERE resolution_ms = $1 AND ts < $2",
+				tier.Resolution.Milliseconds(), now.Add(-tier.Retention))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.ExecContext(ctx, "DELETE FROM samples WHERE resolution_ms <> ALL($1)", pq.Array(resolutions))
+		return err
+	})
+}
+
+// recordCounterPoints records the current totals of the named counters at now
+// and removes all but the newest keep points of each of them
+func recordCounterPoints(ctx context.Context, tx *sqlx.Tx, names []string, now time.Time, keep int) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO counter_points (name, ts, total)
+	SELECT name, $2, value FROM counters WHERE name = ANY($1);
+`, pq.Array(names), now)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.ExecContext(ctx, name, value)
+	_, err = tx.ExecContext(ctx, `
+	DELETE FROM counter_points p USING (
+		SELECT id, row_number() OVER (PARTITION BY name ORDER BY ts DESC, id DESC) AS rn
+		FROM counter_points WHERE name = ANY($1)
+	) ranked
+	WHERE p.id = ranked.id AND ranked.rn > $2;
+`, pq.Array(names), keep)
 	return err
 }
 
-// UpdateCounter updates the counter metric in the database
-func (s *DBStorage) UpdateCounter(ctx context.Context, name string, value int64, shouldNotify bool) error {
-	stmt, err := s.db.PreparexContext(ctx, `
-			INSERT INTO counters (name, value) VALUES ($1, $2)
-			ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value;
-	`)
+// GetCounterRate computes the per-second increase of a counter over the window ending now
+// from the points recorded for it
+func (s *DBStorage) GetCounterRate(ctx context.Context, name string, window time.Duration) (float64, error) {
+	key := tenant.Key(ctx, name)
+
+	var points []models.CounterPoint
+	err := s.db.SelectContext(ctx, &points, "SELECT ts AS time, total FROM counter_points WHERE name = $1 ORDER BY ts, id", key)
 	if err != nil {
+		return 0, err
+	}
+	if len(points) == 0 {
+		return 0, fmt.Errorf("counter %s: %w", name, models.ErrNotFound)
+	}
+
+	return models.CounterRate(points, time.Now(), window)
+}
+
+// UpdateHistogram merges h into the histogram metric in the database
+func (s *DBStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	return s.inAuditedTx(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeHistogram}}, func(tx *sqlx.Tx) error {
+		if err := s.admit(ctx, tx, map[string][]string{"histograms": {key}}); err != nil {
+			return err
+		}
+		return mergeHistogram(ctx, tx, key, h)
+	})
+}
+
+// UpdateSummary merges sk into the summary metric in the database
+func (s *DBStorage) UpdateSummary(ctx context.Context, name string, sk sketch.Sketch, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	if err := sk.Validate(); err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.ExecContext(ctx, name, value)
+	return s.inAuditedTx(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeSummary}}, func(tx *sqlx.Tx) error {
+		if err := s.admit(ctx, tx, map[string][]string{"summaries": {key}}); err != nil {
+			return err
+		}
+		return mergeSummary(ctx, tx, key, sk)
+	})
+}
+
+// UpdateSet adds members to the set metric sketch in the database
+func (s *DBStorage) UpdateSet(ctx context.Context, name string, members []string, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	set := hll.New()
+	for _, member := range members {
+		set.Add(member)
+	}
+
+	return s.inAuditedTx(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeSet}}, func(tx *sqlx.Tx) error {
+		if err := s.admit(ctx, tx, map[string][]string{"sets": {key}}); err != nil {
+			return err
+		}
+		return mergeSet(ctx, tx, key, set)
+	})
+}
+
+// notFound reports the failed lookup of a single metric as models.ErrNotFound if it has no row
+func notFound(err error, mtype, name string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s %s: %w", mtype, name, models.ErrNotFound)
+	}
 	return err
 }
 
 // GetGauge retrieves the gauge metric value from the database
 func (s *DBStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	key := tenant.Key(ctx, name)
+
 	var value float64
-	err := s.db.QueryRowContext(ctx, "SELECT value FROM gauges WHERE name = $1", name).Scan(&value)
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM gauges WHERE name = $1", key).Scan(&value)
 	if err != nil {
-		return 0, err
+		return 0, notFound(err, constants.MetricTypeGauge, name)
 	}
 	return value, nil
 }
 
 // GetCounter retrieves the counter metric value from the database
 func (s *DBStorage) GetCounter(ctx context.Context, name string) (int64, error) {
+	key := tenant.Key(ctx, name)
+
 	var value int64
-	err := s.db.QueryRowContext(ctx, "SELECT value FROM counters WHERE name = $1", name).Scan(&value)
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM counters WHERE name = $1", key).Scan(&value)
 	if err != nil {
-		return 0, err
+		return 0, notFound(err, constants.MetricTypeCounter, name)
 	}
 	return value, nil
 }
 
-// SaveMetrics saves a slice of Metrics in a single transaction
-func (s *DBStorage) SaveMetrics(ctx context.Context, metrics []models.Metrics, shouldNotify bool) error {
-	tx, err := s.db.Beginx()
+// GetHistogram retrieves the histogram metric from the database
+func (s *DBStorage) GetHistogram(ctx context.Context, name string) (models.Histogram, error) {
+	key := tenant.Key(ctx, name)
+
+	var h models.Histogram
+	err := s.db.QueryRowContext(ctx, "SELECT bounds, buckets, sum, count FROM histograms WHERE name = $1", key).
+		Scan(pq.Array(&h.Bounds), pq.Array(&h.Buckets), &h.Sum, &h.Count)
+	if err != nil {
+		return models.Histogram{}, notFound(err, constants.MetricTypeHistogram, name)
+	}
+	return h, nil
+}
+
+// GetSummary retrieves the summary metric sketch from the database
+func (s *DBStorage) GetSummary(ctx context.Context, name string) (sketch.Sketch, error) {
+	key := tenant.Key(ctx, name)
+
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, "SELECT sketch FROM summaries WHERE name = $1", key).Scan(&data); err != nil {
+		return sketch.Sketch{}, notFound(err, constants.MetricTypeSummary, name)
+	}
+
+	var sk sketch.Sketch
+	if err := json.Unmarshal(data, &sk); err != nil {
+		return sketch.Sketch{}, fmt.Errorf("malformed sketch of summary %s: %w", name, err)
+	}
+	return sk, nil
+}
+
+// GetSet retrieves the set metric sketch from the database
+func (s *DBStorage) GetSet(ctx context.Context, name string) (hll.Sketch, error) {
+	key := tenant.Key(ctx, name)
+
+	var set hll.Sketch
+	if err := s.db.QueryRowContext(ctx, "SELECT registers FROM sets WHERE name = $1", key).Scan(&set.Registers); err != nil {
+		return hll.Sketch{}, notFound(err, constants.MetricTypeSet, name)
+	}
+
+	if err := set.Validate(); err != nil {
+		return hll.Sketch{}, fmt.Errorf("malformed sketch of set %s: %w", name, err)
+	}
+	return set, nil
+}
+
+// mergeSet merges set into the stored sketch within tx, locking the row like mergeHistogram
+// a new row starts with empty registers, which is the empty sketch
+func mergeSet(ctx context.Context, tx *sqlx.Tx, name string, set hll.Sketch) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO sets (name, registers) VALUES ($1, ''::bytea)
+	ON CONFLICT (name) DO NOTHING;
+`, name)
+	if err != nil {
+		return err
+	}
+
+	var stored hll.Sketch
+	if err = tx.QueryRowContext(ctx, "SELECT registers FROM sets WHERE name = $1 FOR UPDATE", name).Scan(&stored.Registers); err != nil {
+		return err
+	}
+	if err = stored.Validate(); err != nil {
+		return fmt.Errorf("malformed sketch of set %s: %w", name, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE sets SET registers = $2 WHERE name = $1", name, stored.Merge(set).Registers)
+	return err
+}
+
+// mergeSummary merges sk into the stored sketch within tx, locking the row like mergeHistogram
+func mergeSummary(ctx context.Context, tx *sqlx.Tx, name string, sk sketch.Sketch) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO summaries (name, sketch) VALUES ($1, '{}')
+	ON CONFLICT (name) DO NOTHING;
+`, name)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if err = tx.QueryRowContext(ctx, "SELECT sketch FROM summaries WHERE name = $1 FOR UPDATE", name).Scan(&data); err != nil {
+		return err
+	}
+
+	var stored sketch.Sketch
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("malformed sketch of summary %s: %w", name, err)
+	}
+
+	merged, err := json.Marshal(stored.Merge(sk))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE summaries SET sketch = $2 WHERE name = $1", name, merged)
+	return err
+}
+
+// mergeHistogram merges h into the stored histogram within tx
+// the row is created first if needed and then locked, so concurrent merges of the same histogram
+// are serialized instead of losing observations
+func mergeHistogram(ctx context.Context, tx *sqlx.Tx, name string, h models.Histogram) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO histograms (name, bounds, buckets, sum, count) VALUES ($1, '{}', '{}', 0, 0)
+	ON CONFLICT (name) DO NOTHING;
+`, name)
+	if err != nil {
+		return err
+	}
+
+	var stored models.Histogram
+	err = tx.QueryRowContext(ctx, "SELECT bounds, buckets, sum, count FROM histograms WHERE name = $1 FOR UPDATE", name).
+		Scan(pq.Array(&stored.Bounds), pq.Array(&stored.Buckets), &stored.Sum, &stored.Count)
+	if err != nil {
+		return err
+	}
+
+	merged := stored.Merge(h)
+	_, err = tx.ExecContext(ctx, "UPDATE histograms SET bounds = $2, buckets = $3, sum = $4, count = $5 WHERE name = $1",
+		name, pq.Array(merged.Bounds), pq.Array(merged.Buckets), merged.Sum, merged.Count)
+	return err
+}
+
+// inTx runs fn in a transaction that is committed if fn succeeds and rolled back otherwise
+func (s *DBStorage) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) (err error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -149,62 +544,251 @@ func (s *DBStorage) SaveMetrics(ctx context.Context, metrics []models.Metrics, s
 			if rbErr := tx.Rollback(); rbErr != nil {
 				err = fmt.Errorf("rollback failed: %v, original error: %w", rbErr, err)
 			}
-		} else {
-			if err = tx.Commit(); err != nil {
-				err = fmt.Errorf("commit failed: %v", err)
-			}
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			err = fmt.Errorf("commit failed: %w", err)
 		}
 	}()
 
-	gaugeStmt, err := tx.PrepareNamedContext(ctx, `
-	INSERT INTO gauges (name, value) VALUES (:name, :value)
-	ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value;
-`)
+	return fn(tx)
+}
+
+// SaveMetrics saves a slice of Metrics in a single transaction
+// duplicates within the batch are aggregated first (counters are summed, the last gauge value wins),
+// so every gauge and counter name is written exactly once with a single multi-row statement per table;
+// histograms, summaries and sets are merged row by row under a row lock, and the new counter totals
+// are recorded for rates and, together with the gauge values, in the history tiers;
+// a batch that would exceed the metric quota of its tenant is rejected as a whole
+func (s *DBStorage) SaveMetrics(ctx context.Context, metrics []models.Metrics, shouldNotify bool) error {
+	updates := metrics
+	metrics = tenant.Metrics(ctx, metrics)
+	gauges, counters, err := aggregateMetrics(metrics)
 	if err != nil {
 		return err
 	}
-	defer gaugeStmt.Close()
+	histograms := aggregateHistograms(metrics)
+	summaries := aggregateSummaries(metrics)
+	sets := aggregateSets(metrics)
+
+	return s.inAuditedTx(ctx, updates, func(tx *sqlx.Tx) error {
+		err := s.admit(ctx, tx, map[string][]string{
+			"gauges":     gauges.names,
+			"counters":   counters.names,
+			"histograms": histograms.names,
+			"summaries":  summaries.names,
+			"sets":       sets.names,
+		})
+		if err != nil {
+			return err
+		}
+		if err := saveBatches(ctx, tx, gauges, counters, histograms); err != nil {
+			return err
+		}
+		now := time.Now()
+		if len(counters.names) > 0 {
+			if err := recordCounterPoints(ctx, tx, counters.names, now, s.ratePoints); err != nil {
+				return err
+			}
+		}
+		if err := recordHistory(ctx, tx, s.tiers, now, gauges, counters.names); err != nil {
+			return err
+		}
+		for i, name := range summaries.names {
+			if err := mergeSummary(ctx, tx, name, summaries.values[i]); err != nil {
+				return err
+			}
+		}
+		for i, name := range sets.names {
+			if err := mergeSet(ctx, tx, name, sets.values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	counterStmt, err := tx.PrepareNamedContext(ctx, `
-	INSERT INTO counters (name, value) VALUES (:name, :value)
+// saveBatches writes aggregated batches within tx
+func saveBatches(ctx context.Context, tx *sqlx.Tx, gauges gaugeBatch, counters counterBatch, histograms histogramBatch) error {
+	if len(gauges.names) > 0 {
+		_, err := tx.ExecContext(ctx, `
+	INSERT INTO gauges (name, value)
+	SELECT * FROM unnest($1::varchar[], $2::double precision[])
+	ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value;
+`, pq.Array(gauges.names), pq.Array(gauges.values))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(counters.names) > 0 {
+		_, err := tx.ExecContext(ctx, `
+	INSERT INTO counters (name, value)
+	SELECT * FROM unnest($1::varchar[], $2::bigint[])
 	ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value;
-`)
-	if err != nil {
-		return err
+`, pq.Array(counters.names), pq.Array(counters.values))
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, name := range histograms.names {
+		if err := mergeHistogram(ctx, tx, name, histograms.values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gaugeBatch holds aggregated gauge values as parallel arrays suitable for unnest
+type gaugeBatch struct {
+	names  []string
+	values []float64
+}
+
+// counterBatch holds aggregated counter deltas as parallel arrays suitable for unnest
+type counterBatch struct {
+	names  []string
+	values []int64
+}
+
+// histogramBatch holds aggregated histograms in name order
+type histogramBatch struct {
+	names  []string
+	values []models.Histogram
+}
+
+// aggregateHistograms merges the histograms of an already validated batch by name
+func aggregateHistograms(metrics []models.Metrics) histogramBatch {
+	histograms := make(map[string]models.Histogram)
+	for _, metric := range metrics {
+		if metric.MType == constants.MetricTypeHistogram {
+			histograms[metric.ID] = histograms[metric.ID].Merge(metric.Histogram())
+		}
+	}
+
+	hb := histogramBatch{
+		names:  make([]string, 0, len(histograms)),
+		values: make([]models.Histogram, 0, len(histograms)),
+	}
+	for name := range histograms {
+		hb.names = append(hb.names, name)
+	}
+	sort.Strings(hb.names)
+	for _, name := range hb.names {
+		hb.values = append(hb.values, histograms[name])
+	}
+
+	return hb
+}
+
+// summaryBatch holds aggregated summary sketches in name order
+type summaryBatch struct {
+	names  []string
+	values []sketch.Sketch
+}
+
+// aggregateSummaries merges the summaries of an already validated batch by name
+func aggregateSummaries(metrics []models.Metrics) summaryBatch {
+	summaries := make(map[string]sketch.Sketch)
+	for _, metric := range metrics {
+		if metric.MType == constants.MetricTypeSummary {
+			summaries[metric.ID] = summaries[metric.ID].Merge(*metric.Sketch)
+		}
+	}
+
+	sb := summaryBatch{
+		names:  make([]string, 0, len(summaries)),
+		values: make([]sketch.Sketch, 0, len(summaries)),
+	}
+	for name := range summaries {
+		sb.names = append(sb.names, name)
+	}
+	sort.Strings(sb.names)
+	for _, name := range sb.names {
+		sb.values = append(sb.values, summaries[name])
+	}
+
+	return sb
+}
+
+// setBatch holds aggregated set sketches in name order
+type setBatch struct {
+	names  []string
+	values []hll.Sketch
+}
+
+// aggregateSets merges the sets of an already validated batch into one sketch per name
+func aggregateSets(metrics []models.Metrics) setBatch {
+	sets := make(map[string]hll.Sketch)
+	for _, metric := range metrics {
+		if metric.MType != constants.MetricTypeSet {
+			continue
+		}
+		sets[metric.ID] = sets[metric.ID].Merge(metric.Set())
+	}
+
+	sb := setBatch{
+		names:  make([]string, 0, len(sets)),
+		values: make([]hll.Sketch, 0, len(sets)),
 	}
-	defer counterStmt.Close()
+	for name := range sets {
+		sb.names = append(sb.names, name)
+	}
+	sort.Strings(sb.names)
+	for _, name := range sb.names {
+		sb.values = append(sb.values, sets[name])
+	}
+
+	return sb
+}
+
+// aggregateMetrics collapses duplicate metric names within a batch
+// counters are summed and gauges keep the last value seen; names are sorted
+// so that concurrent batches lock rows in the same order
+func aggregateMetrics(metrics []models.Metrics) (gaugeBatch, counterBatch, error) {
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
 
 	for _, metric := range metrics {
-		args := map[string]interface{}{
-			"name":  metric.ID,
-			"value": nil,
+		if err := metric.Validate(); err != nil {
+			return gaugeBatch{}, counterBatch{}, err
 		}
 
 		switch metric.MType {
 		case "gauge":
-			if metric.Value == nil {
-				return fmt.Errorf("value not provided for gauge: %s", metric.ID)
-			}
-			args["value"] = *metric.Value
-			_, err = gaugeStmt.ExecContext(ctx, args)
-			if err != nil {
-				return err
-			}
+			gauges[metric.ID] = *metric.Value
 		case "counter":
-			if metric.Delta == nil {
-				return fmt.Errorf("delta not provided for counter: %s", metric.ID)
-			}
-			args["value"] = *metric.Delta
-			_, err = counterStmt.ExecContext(ctx, args)
-			if err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("unknown metric type: %s", metric.MType)
+			counters[metric.ID] += *metric.Delta
 		}
 	}
 
-	return tx.Commit()
+	gb := gaugeBatch{
+		names:  make([]string, 0, len(gauges)),
+		values: make([]float64, 0, len(gauges)),
+	}
+	for name := range gauges {
+		gb.names = append(gb.names, name)
+	}
+	sort.Strings(gb.names)
+	for _, name := range gb.names {
+		gb.values = append(gb.values, gauges[name])
+	}
+
+	cb := counterBatch{
+		names:  make([]string, 0, len(counters)),
+		values: make([]int64, 0, len(counters)),
+	}
+	for name := range counters {
+		cb.names = append(cb.names, name)
+	}
+	sort.Strings(cb.names)
+	for _, name := range cb.names {
+		cb.values = append(cb.values, counters[name])
+	}
+
+	return gb, cb, nil
 }
 
 func (s *DBStorage) String(ctx context.Context) string {
@@ -212,20 +796,30 @@ func (s *DBStorage) String(ctx context.Context) string {
 
 	result.Grow(1024)
 
-	if err := s.fetchAndFormat(ctx, "SELECT name, value FROM gauges", "Gauge values:\n", &result, true); err != nil {
+	if err := s.fetchAndFormat(ctx, "gauges", "Gauge values:\n", &result, true); err != nil {
 		result.WriteString(fmt.Sprintf("Error fetching gauges: %s\n", err.Error()))
 	}
 	result.WriteString("\n")
-	if err := s.fetchAndFormat(ctx, "SELECT name, value FROM counters", "Counter values:\n", &result, false); err != nil {
+	if err := s.fetchAndFormat(ctx, "counters", "Counter values:\n", &result, false); err != nil {
 		result.WriteString(fmt.Sprintf("Error fetching counters: %s\n", err.Error()))
 	}
+	if err := s.formatHistograms(ctx, &result); err != nil {
+		result.WriteString(fmt.Sprintf("Error fetching histograms: %s\n", err.Error()))
+	}
+	if err := s.formatSummaries(ctx, &result); err != nil {
+		result.WriteString(fmt.Sprintf("Error fetching summaries: %s\n", err.Error()))
+	}
+	if err := s.formatSets(ctx, &result); err != nil {
+		result.WriteString(fmt.Sprintf("Error fetching sets: %s\n", err.Error()))
+	}
 
 	return result.String()
 }
 
-// fetch and format metrics
-func (s *DBStorage) fetchAndFormat(ctx context.Context, query, header string, builder io.StringWriter, isFloat bool) error {
-	rows, err := s.db.QueryContext(ctx, query)
+// fetch and format the metrics of the tenant in ctx stored in table
+func (s *DBStorage) fetchAndFormat(ctx context.Context, table, header string, builder io.StringWriter, isFloat bool) error {
+	stmt, arg := tenantSelect(table, "value", tenant.Prefix(ctx))
+	rows, err := s.db.QueryContext(ctx, stmt, arg)
 	if err != nil {
 		return err
 	}
@@ -236,23 +830,23 @@ func (s *DBStorage) fetchAndFormat(ctx context.Context, query, header string, bu
 	}
 
 	for rows.Next() {
-		var name string
+		var name, line string
 		if isFloat {
 			var value float64
 			if err := rows.Scan(&name, &value); err != nil {
 				return err
 			}
-			if _, err := builder.WriteString(fmt.Sprintf("%s: %f\n", name, value)); err != nil {
-				return err
-			}
+			line = fmt.Sprintf("%f", value)
 		} else {
 			var value int64
 			if err := rows.Scan(&name, &value); err != nil {
 				return err
 			}
-			if _, err := builder.WriteString(fmt.Sprintf("%s: %d\n", name, value)); err != nil {
-				return err
-			}
+			line = fmt.Sprintf("%d", value)
+		}
+
+		if _, err := builder.WriteString(fmt.Sprintf("%s: %s\n", name, line)); err != nil {
+			return err
 		}
 	}
 
@@ -262,3 +856,83 @@ func (s *DBStorage) fetchAndFormat(ctx context.Context, query, header string, bu
 
 	return nil
 }
+
+// formatHistograms writes the histograms of the tenant in ctx in name order, nothing is written if there are none
+func (s *DBStorage) formatHistograms(ctx context.Context, builder io.StringWriter) error {
+	stmt, arg := tenantSelect("histograms", "bounds, buckets, sum, count", tenant.Prefix(ctx))
+	rows, err := s.db.QueryContext(ctx, stmt+" ORDER BY name", arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	header := "\nHistogram values:\n"
+	for rows.Next() {
+		var name string
+		var h models.Histogram
+		if err := rows.Scan(&name, pq.Array(&h.Bounds), pq.Array(&h.Buckets), &h.Sum, &h.Count); err != nil {
+			return err
+		}
+		if _, err := builder.WriteString(fmt.Sprintf("%s%s: %s\n", header, name, h)); err != nil {
+			return err
+		}
+		header = ""
+	}
+
+	return rows.Err()
+}
+
+// formatSummaries writes the summaries of the tenant in ctx in name order, nothing is written if there are none
+func (s *DBStorage) formatSummaries(ctx context.Context, builder io.StringWriter) error {
+	stmt, arg := tenantSelect("summaries", "sketch", tenant.Prefix(ctx))
+	rows, err := s.db.QueryContext(ctx, stmt+" ORDER BY name", arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	header := "\nSummary values:\n"
+	for rows.Next() {
+		var name string
+		var data []byte
+		if err := rows.Scan(&name, &data); err != nil {
+			return err
+		}
+		var sk sketch.Sketch
+		if err := json.Unmarshal(data, &sk); err != nil {
+			return fmt.Errorf("malformed sketch of summary %s: %w", name, err)
+		}
+
+		if _, err := builder.WriteString(fmt.Sprintf("%s%s: %s\n", header, name, sk)); err != nil {
+			return err
+		}
+		header = ""
+	}
+
+	return rows.Err()
+}
+
+// formatSets writes the estimated cardinality of the sets of the tenant in ctx in name order, nothing is written if there are none
+func (s *DBStorage) formatSets(ctx context.Context, builder io.StringWriter) error {
+	stmt, arg := tenantSelect("sets", "registers", tenant.Prefix(ctx))
+	rows, err := s.db.QueryContext(ctx, stmt+" ORDER BY name", arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	header := "\nSet values:\n"
+	for rows.Next() {
+		var name string
+		var set hll.Sketch
+		if err := rows.Scan(&name, &set.Registers); err != nil {
+			return err
+		}
+		if _, err := builder.WriteString(fmt.Sprintf("%s%s: %s\n", header, name, set)); err != nil {
+			return err
+		}
+		header = ""
+	}
+
+	return rows.Err()
+}
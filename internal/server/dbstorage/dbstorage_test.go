@@ -0,0 +1,251 @@
+package dbstorage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
+)
+
+// benchDSNEnv names the environment variable holding the DSN of a disposable
+// database used by the benchmarks; they are skipped when it is not set
+const benchDSNEnv = "TEST_DATABASE_DSN"
+
+func gauge(name string, value float64) models.Metrics {
+	return models.Metrics{ID: name, MType: "gauge", Value: &value}
+}
+
+func counter(name string, delta int64) models.Metrics {
+	return models.Metrics{ID: name, MType: "counter", Delta: &delta}
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	testCases := []struct {
+		name     string
+		metrics  []models.Metrics
+		gauges   gaugeBatch
+		counters counterBatch
+		wantErr  bool
+	}{
+		{
+			name: "duplicates are collapsed",
+			metrics: []models.Metrics{
+				counter("PollCount", 1),
+				gauge("Alloc", 1.5),
+				counter("PollCount", 2),
+				gauge("Alloc", 2.5),
+				gauge("HeapSys", 3),
+			},
+			gauges: gaugeBatch{
+				names:  []string{"Alloc", "HeapSys"},
+				values: []float64{2.5, 3},
+			},
+			counters: counterBatch{
+				names:  []string{"PollCount"},
+				values: []int64{3},
+			},
+		},
+		{
+			name:     "empty batch",
+			metrics:  nil,
+			gauges:   gaugeBatch{names: []string{}, values: []float64{}},
+			counters: counterBatch{names: []string{}, values: []int64{}},
+		},
+		{
+			name:    "missing gauge value",
+			metrics: []models.Metrics{{ID: "Alloc", MType: "gauge"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing counter delta",
+			metrics: []models.Metrics{{ID: "PollCount", MType: "counter"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			metrics: []models.Metrics{{ID: "x", MType: "unknown"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gauges, counters, err := aggregateMetrics(tc.metrics)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.gauges, gauges)
+			assert.Equal(t, tc.counters, counters)
+		})
+	}
+}
+
+func TestAggregateHistograms(t *testing.T) {
+	small := models.NewHistogram([]float64{1})
+	small.Observe(0.5)
+	large := models.NewHistogram([]float64{10})
+	large.Observe(20)
+
+	batch := aggregateHistograms([]models.Metrics{
+		models.NewHistogramMetric("b", small),
+		models.NewHistogramMetric("a", small),
+		{ID: "PollCount", MType: "counter"},
+		models.NewHistogramMetric("a", small),
+		models.NewHistogramMetric("b", large),
+	})
+
+	assert.Equal(t, []string{"a", "b"}, batch.names)
+	assert.Equal(t, []models.Histogram{small.Merge(small), large}, batch.values)
+}
+
+func TestAggregateSummaries(t *testing.T) {
+	fine := sketch.New(0.01)
+	fine.Add(0.5)
+	coarse := sketch.New(0.05)
+	coarse.Add(20)
+
+	batch := aggregateSummaries([]models.Metrics{
+		models.NewSummaryMetric("b", fine),
+		models.NewSummaryMetric("a", fine),
+		{ID: "PollCount", MType: "counter"},
+		models.NewSummaryMetric("a", fine),
+		models.NewSummaryMetric("b", coarse),
+	})
+
+	assert.Equal(t, []string{"a", "b"}, batch.names)
+	assert.Equal(t, []sketch.Sketch{fine.Merge(fine), coarse}, batch.values)
+}
+
+func TestAggregateSets(t *testing.T) {
+	batch := aggregateSets([]models.Metrics{
+		{ID: "b", MType: "set", Members: []string{"x"}},
+		{ID: "a", MType: "set", Members: []string{"x", "y"}},
+		{ID: "PollCount", MType: "counter"},
+		{ID: "a", MType: "set", Members: []string{"y", "z"}},
+	})
+
+	a, b := hll.New(), hll.New()
+	for _, member := range []string{"x", "y", "z"} {
+		a.Add(member)
+	}
+	b.Add("x")
+
+	assert.Equal(t, []string{"a", "b"}, batch.names)
+	assert.Equal(t, []hll.Sketch{a, b}, batch.values)
+}
+
+// saveMetricsPerRow is the previous SaveMetrics implementation that executes
+// one prepared statement per metric; it is kept here as a benchmark baseline
+func (s *DBStorage) saveMetricsPerRow(ctx context.Context, metrics []models.Metrics) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	gaugeStmt, err := tx.PreparexContext(ctx, `
+	INSERT INTO gauges (name, value) VALUES ($1, $2)
+	ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value;
+`)
+	if err != nil {
+		return err
+	}
+	defer gaugeStmt.Close()
+
+	counterStmt, err := tx.PreparexContext(ctx, `
+	INSERT INTO counters (name, value) VALUES ($1, $2)
+	ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value;
+`)
+	if err != nil {
+		return err
+	}
+	defer counterStmt.Close()
+
+	for _, metric := range metrics {
+		switch metric.MType {
+		case "gauge":
+			_, err = gaugeStmt.ExecContext(ctx, metric.ID, *metric.Value)
+		case "counter":
+			_, err = counterStmt.ExecContext(ctx, metric.ID, *metric.Delta)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// benchBatch builds a batch resembling an agent report with repeated counters
+func benchBatch(size int) []models.Metrics {
+	batch := make([]models.Metrics, 0, size)
+	for i := 0; i < size; i++ {
+		if i%2 == 0 {
+			batch = append(batch, gauge(fmt.Sprintf("bench_gauge_%d", i%(size/4+1)), float64(i)))
+		} else {
+			batch = append(batch, counter(fmt.Sprintf("bench_counter_%d", i%(size/4+1)), 1))
+		}
+	}
+	return batch
+}
+
+func newBenchStorage(b *testing.B) *DBStorage {
+	dsn := os.Getenv(benchDSNEnv)
+	if dsn == "" {
+		b.Skipf("%s is not set", benchDSNEnv)
+	}
+
+	s, err := NewDBStorage(&config.Config{DBDSN: dsn, MaxOpenConns: 4, MaxIdleConns: 4})
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = s.Close() })
+	require.NoError(b, s.CreateTables(context.Background()))
+
+	return s
+}
+
+func BenchmarkSaveMetrics(b *testing.B) {
+	s := newBenchStorage(b)
+	ctx := context.Background()
+
+	for _, size := range []int{100, 1000, 5000} {
+		batch := benchBatch(size)
+
+		b.Run(fmt.Sprintf("per-row/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := s.saveMetricsPerRow(ctx, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("bulk/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := s.SaveMetrics(ctx, batch, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAggregateMetrics(b *testing.B) {
+	batch := benchBatch(5000)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := aggregateMetrics(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
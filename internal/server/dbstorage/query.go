@@ -0,0 +1,148 @@
+package dbstorage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/query"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+)
+
+// valueTables maps the metric types with a single value to their tables
+var valueTables = map[string]string{
+	constants.MetricTypeGauge:   "gauges",
+	constants.MetricTypeCounter: "counters",
+}
+
+// GetValues fetches the current values of all gauges or the totals of all counters of the tenant in ctx
+func (s *DBStorage) GetValues(ctx context.Context, mtype string) (map[string]float64, error) {
+	table, ok := valueTables[mtype]
+	if !ok {
+		return nil, fmt.Errorf("metric type %s has no single value", mtype)
+	}
+
+	var samples []query.Sample
+	stmt, arg := tenantSelect(table, "value::double precision AS value", tenant.Prefix(ctx))
+	if err := s.db.SelectContext(ctx, &samples, stmt, arg); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float64, len(samples))
+	for _, sample := range samples {
+		values[sample.Name] = sample.Value
+	}
+	return values, nil
+}
+
+// EvalQuery evaluates q over the metrics of the tenant in ctx in the database,
+// so only the selected series or the aggregate leave it; see pushdown for regular expressions
+func (s *DBStorage) EvalQuery(ctx context.Context, q query.Query) (query.Result, error) {
+	pushed, inGo := pushdown(q)
+	stmt, args, err := querySQL(pushed, tenant.Prefix(ctx))
+	if err != nil {
+		return query.Result{}, err
+	}
+
+	if pushed.Func == "" || pushed.Func == "topk" {
+		series := []query.Sample{}
+		if err := s.db.SelectContext(ctx, &series, stmt, args...); err != nil {
+			return query.Result{}, err
+		}
+		if inGo {
+			return query.Apply(q, series), nil
+		}
+		return query.Result{Series: series}, nil
+	}
+
+	var value sql.NullFloat64
+	if err := s.db.QueryRowContext(ctx, stmt, args...).Scan(&value); err != nil {
+		return query.Result{}, err
+	}
+	if !value.Valid {
+		return query.Result{}, nil
+	}
+	return query.Result{Value: &value.Float64}, nil
+}
+
+// pushdown returns the part of q the database evaluates and whether q still has to be applied to its series in Go;
+// Postgres regular expressions differ from Go's, e.g. they do not know '(?i)', so for a query with regular
+// expression matchers the database only selects the series by the other matchers
+func pushdown(q query.Query) (query.Query, bool) {
+	pushed := query.Query{Selector: query.Selector{MType: q.Selector.MType}}
+	for _, m := range q.Selector.Matchers {
+		if m.Op == "=~" || m.Op == "!~" {
+			continue
+		}
+		pushed.Selector.Matchers = append(pushed.Selector.Matchers, m)
+	}
+	if len(pushed.Selector.Matchers) < len(q.Selector.Matchers) {
+		return pushed, true
+	}
+	return q, false
+}
+
+// tenantCondition returns the condition on $1 selecting the keys that start with prefix, the expression of
+// their names without the prefix and the argument to pass as $1; an empty prefix selects the keys without a tenant
+func tenantCondition(prefix string) (cond, name, arg string) {
+	if prefix == "" {
+		return "strpos(name, $1) = 0", "name", tenant.Separator
+	}
+	return "left(name, length($1)) = $1", "substr(name, length($1) + 1)", prefix
+}
+
+// tenantSelect returns the statement selecting the name without the prefix and columns of the rows of table
+// whose keys start with prefix, and the argument to pass as $1
+func tenantSelect(table, columns, prefix string) (string, string) {
+	cond, name, arg := tenantCondition(prefix)
+	return "SELECT " + name + " AS name, " + columns + " FROM " + table + " WHERE " + cond, arg
+}
+
+// querySQL builds the statement evaluating q over the metrics whose keys start with prefix and its arguments;
+// matchers apply to the names without the prefix, and an empty prefix selects the keys without a tenant;
+// regular expression matchers are left to Go, see pushdown
+func querySQL(q query.Query, prefix string) (string, []interface{}, error) {
+	table, ok := valueTables[q.Selector.MType]
+	if !ok {
+		return "", nil, fmt.Errorf("metric type %s has no single value", q.Selector.MType)
+	}
+
+	// $1 selects the keys of the tenant, matchers and the output use the names without the tenant prefix
+	cond, name, arg := tenantCondition(prefix)
+	where := []string{cond}
+	args := []interface{}{arg}
+
+	for _, m := range q.Selector.Matchers {
+		op := m.Op
+		switch m.Op {
+		case "=":
+		case "!=":
+			op = "<>"
+		default:
+			return "", nil, fmt.Errorf("matcher %s cannot be evaluated by the database", m.Op)
+		}
+		args = append(args, m.Value)
+		where = append(where, fmt.Sprintf("%s %s $%d", name, op, len(args)))
+	}
+
+	from := " FROM " + table + " WHERE " + strings.Join(where, " AND ")
+
+	const value = "value::double precision"
+	switch q.Func {
+	case "":
+		return "SELECT " + name + " AS name, " + value + " AS value" + from + " ORDER BY name", args, nil
+	case "topk":
+		args = append(args, q.K)
+		return fmt.Sprintf("SELECT %s AS name, %s AS value%s ORDER BY value DESC, name LIMIT $%d", name, value, from, len(args)), args, nil
+	case "count":
+		return "SELECT count(*)::double precision" + from, args, nil
+	case "sum":
+		return "SELECT COALESCE(sum(" + value + "), 0)" + from, args, nil
+	case "avg", "min", "max":
+		return "SELECT " + q.Func + "(" + value + ")" + from, args, nil
+	default:
+		return "", nil, fmt.Errorf("unknown query function %s", q.Func)
+	}
+}
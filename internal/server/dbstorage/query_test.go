@@ -0,0 +1,117 @@
+package dbstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/query"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+)
+
+func TestQuerySQL(t *testing.T) {
+	const (
+		defaultTenant = "strpos(name, $1) = 0"
+		teamTenant    = "left(name, length($1)) = $1"
+		teamName      = "substr(name, length($1) + 1)"
+	)
+
+	tests := []struct {
+		expr   string
+		prefix string
+		stmt   string
+		args   []interface{}
+	}{
+		{
+			`sum(gauge{name!="Alloc"})`, "",
+			"SELECT COALESCE(sum(value::double precision), 0) FROM gauges WHERE " + defaultTenant + " AND name <> $2",
+			[]interface{}{tenant.Separator, "Alloc"},
+		},
+		{
+			`avg(counter{name!="PollCount", name!="Requests"})`, "",
+			"SELECT avg(value::double precision) FROM counters WHERE " + defaultTenant + " AND name <> $2 AND name <> $3",
+			[]interface{}{tenant.Separator, "PollCount", "Requests"},
+		},
+		{
+			`count(gauge)`, "team" + tenant.Separator,
+			"SELECT count(*)::double precision FROM gauges WHERE " + teamTenant,
+			[]interface{}{"team" + tenant.Separator},
+		},
+		{
+			`topk(3, gauge{name="Alloc"})`, "team" + tenant.Separator,
+			"SELECT " + teamName + " AS name, value::double precision AS value FROM gauges WHERE " + teamTenant +
+				" AND " + teamName + " = $2 ORDER BY value DESC, name LIMIT $3",
+			[]interface{}{"team" + tenant.Separator, "Alloc", 3},
+		},
+		{
+			`counter`, "",
+			"SELECT name AS name, value::double precision AS value FROM counters WHERE " + defaultTenant + " ORDER BY name",
+			[]interface{}{tenant.Separator},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			q, err := query.Parse(tt.expr)
+			require.NoError(t, err)
+
+			stmt, args, err := querySQL(q, tt.prefix)
+			require.NoError(t, err)
+			assert.Equal(t, tt.stmt, stmt)
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
+
+func TestPushdown(t *testing.T) {
+	tests := []struct {
+		expr   string
+		pushed string
+		inGo   bool
+	}{
+		{`sum(gauge{name="Alloc"})`, `sum(gauge{name="Alloc"})`, false},
+		{`topk(2, counter{name!="PollCount"})`, `topk(2, counter{name!="PollCount"})`, false},
+		// Go accepts the flag and Postgres does not, so the database must never see it
+		{`sum(gauge{name=~"(?i)heap.*"})`, `gauge`, true},
+		{`topk(1, counter{name!~"Poll.*", name!="Requests"})`, `counter{name!="Requests"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			q, err := query.Parse(tt.expr)
+			require.NoError(t, err)
+			want, err := query.Parse(tt.pushed)
+			require.NoError(t, err)
+
+			pushed, inGo := pushdown(q)
+			assert.Equal(t, tt.inGo, inGo)
+			assert.Equal(t, want, pushed)
+
+			_, _, err = querySQL(pushed, "")
+			require.NoError(t, err)
+			if tt.inGo {
+				_, _, err = querySQL(q, "")
+				assert.Error(t, err, "regular expressions are not turned into SQL")
+			}
+		})
+	}
+
+	q, err := query.Parse(`sum(gauge{name=~"(?i)heap.*"})`)
+	require.NoError(t, err)
+	series := []query.Sample{{Name: "Alloc", Value: 1}, {Name: "HeapAlloc", Value: 2}, {Name: "heapidle", Value: 3}}
+
+	result := query.Apply(q, series)
+	require.NotNil(t, result.Value)
+	assert.Equal(t, 5.0, *result.Value, "the series selected by the database are filtered with the Go regular expression")
+}
+
+func TestTenantSelect(t *testing.T) {
+	stmt, arg := tenantSelect("sets", "registers", "")
+	assert.Equal(t, "SELECT name AS name, registers FROM sets WHERE strpos(name, $1) = 0", stmt)
+	assert.Equal(t, tenant.Separator, arg)
+
+	stmt, arg = tenantSelect("gauges", "value", "team"+tenant.Separator)
+	assert.Equal(t, "SELECT substr(name, length($1) + 1) AS name, value FROM gauges WHERE left(name, length($1)) = $1", stmt)
+	assert.Equal(t, "team"+tenant.Separator, arg)
+}
@@ -0,0 +1,64 @@
+package dbstorage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+)
+
+// metricTables are the tables holding the current state of metrics, one row per metric
+var metricTables = []string{"gauges", "counters", "histograms", "summaries", "sets"}
+
+// SetQuota makes the storage reject updates that would exceed the metric quota of their tenant,
+// it must be called before the storage is used
+func (s *DBStorage) SetQuota(q *limits.Quota) {
+	s.quota = q
+}
+
+// admit checks within tx that the metrics not stored yet fit into the quota of the tenant in ctx,
+// keys holds the distinct storage keys of the updated metrics per table;
+// concurrent transactions do not see each other's new rows, so concurrent batches may together
+// exceed the quota by the metrics they add
+func (s *DBStorage) admit(ctx context.Context, tx *sqlx.Tx, keys map[string][]string) error {
+	if !s.quota.Enabled() {
+		return nil
+	}
+
+	added := 0
+	for table, names := range keys {
+		if len(names) == 0 {
+			continue
+		}
+
+		var n int
+		err := tx.GetContext(ctx, &n, `
+	SELECT count(*) FROM unnest($1::varchar[]) AS batch(name)
+	WHERE NOT EXISTS (SELECT 1 FROM `+table+` AS stored WHERE stored.name = batch.name);
+`, pq.Array(names))
+		if err != nil {
+			return err
+		}
+		added += n
+	}
+	if added == 0 {
+		return nil
+	}
+
+	cond, _, arg := tenantCondition(tenant.Prefix(ctx))
+	counts := make([]string, len(metricTables))
+	for i, table := range metricTables {
+		counts[i] = "(SELECT count(*) FROM " + table + " WHERE " + cond + ")"
+	}
+
+	var stored int
+	if err := tx.GetContext(ctx, &stored, "SELECT "+strings.Join(counts, " + "), arg); err != nil {
+		return err
+	}
+
+	return s.quota.Check(tenant.FromContext(ctx), stored, added)
+}
@@ -0,0 +1,176 @@
+package events
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+const (
+	// maxBatch is the largest number of queued events handed to a sink at once
+	maxBatch = 100
+	// flushTimeout bounds how long the events still queued at shutdown are delivered
+	flushTimeout = 5 * time.Second
+)
+
+// Event is emitted for every successful update request
+type Event struct {
+	Time    time.Time        `json:"time"`
+	Client  string           `json:"client"`           // IP address of the client
+	Tenant  string           `json:"tenant,omitempty"` // tenant of the bearer token, empty for the default tenant
+	Metrics []models.Metrics `json:"metrics"`          // the accepted metrics as they were sent
+}
+
+// Sink delivers events to a receiver
+type Sink interface {
+	// Name describes the sink in logs
+	Name() string
+
+	// Send delivers a batch of events in their order
+	Send(ctx context.Context, events []Event) error
+
+	// Close releases the resources of the sink
+	Close() error
+}
+
+// subscriber queues the events of a single sink, so that a slow sink only delays its own events
+type subscriber struct {
+	sink    Sink
+	queue   chan Event
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// Publisher fans out events to its sinks in the background; every sink has a bounded queue,
+// and events that do not fit into it are dropped, so publishing never blocks the request;
+// a nil Publisher publishes nothing
+type Publisher struct {
+	sugar *zap.SugaredLogger
+	subs  []*subscriber
+	now   func() time.Time
+	wg    sync.WaitGroup
+}
+
+// NewPublisher creates a publisher queueing up to buffer events per sink,
+// the sinks receive events once Start is called
+func NewPublisher(sugar *zap.SugaredLogger, buffer int, sinks ...Sink) *Publisher {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	p := &Publisher{sugar: sugar, now: time.Now}
+	for _, sink := range sinks {
+		p.subs = append(p.subs, &subscriber{sink: sink, queue: make(chan Event, buffer)})
+	}
+	return p
+}
+
+// Publish queues an event of the metrics accepted from the client of r for every sink,
+// ctx holds the tenant of the request; the event keeps a copy of metrics, so callers may reuse it
+func (p *Publisher) Publish(ctx context.Context, r *http.Request, metrics []models.Metrics) {
+	if p == nil || len(metrics) == 0 {
+		return
+	}
+
+	metrics = append([]models.Metrics(nil), metrics...)
+	e := Event{Time: p.now().UTC(), Client: utils.RemoteIP(r), Tenant: tenant.FromContext(ctx), Metrics: metrics}
+	for _, sub := range p.subs {
+		select {
+		case sub.queue <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Start delivers the queued events until ctx is done, then the events still queued
+// are delivered within flushTimeout and the sinks are closed
+func (p *Publisher) Start(ctx context.Context) {
+	for _, sub := range p.subs {
+		p.wg.Add(1)
+		go func(sub *subscriber) {
+			defer p.wg.Done()
+			p.run(ctx, sub)
+		}(sub)
+	}
+}
+
+// Wait blocks until the sinks are closed after the context of Start is done
+func (p *Publisher) Wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
+
+// run delivers the events of sub in batches until ctx is done
+func (p *Publisher) run(ctx context.Context, sub *subscriber) {
+	for {
+		select {
+		case e := <-sub.queue:
+			p.send(ctx, sub, drain(sub.queue, []Event{e}))
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+			for batch := drain(sub.queue, nil); len(batch) > 0; batch = drain(sub.queue, nil) {
+				p.send(flushCtx, sub, batch)
+			}
+			cancel()
+
+			if err := sub.sink.Close(); err != nil {
+				p.sugar.Errorf("Error while closing the %s event sink: %v", sub.sink.Name(), err)
+			}
+			return
+		}
+	}
+}
+
+// drain appends the events waiting in queue to batch until it holds maxBatch events
+func drain(queue chan Event, batch []Event) []Event {
+	for len(batch) < maxBatch {
+		select {
+		case e := <-queue:
+			batch = append(batch, e)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// send hands batch to the sink of sub, a batch that fails is logged and dropped
+func (p *Publisher) send(ctx context.Context, sub *subscriber, batch []Event) {
+	if err := sub.sink.Send(ctx, batch); err != nil {
+		sub.failed.Add(int64(len(batch)))
+		p.sugar.Errorw("Failed to deliver events", "sink", sub.sink.Name(), "events", len(batch), "err", err)
+	}
+}
+
+// Dropped returns the number of events dropped so far because the queue of a sink was full
+func (p *Publisher) Dropped() int64 {
+	return p.sum(func(sub *subscriber) int64 { return sub.dropped.Load() })
+}
+
+// Failed returns the number of events a sink failed to deliver so far
+func (p *Publisher) Failed() int64 {
+	return p.sum(func(sub *subscriber) int64 { return sub.failed.Load() })
+}
+
+// sum adds up a counter of all subscribers
+func (p *Publisher) sum(counter func(sub *subscriber) int64) int64 {
+	if p == nil {
+		return 0
+	}
+
+	var total int64
+	for _, sub := range p.subs {
+		total += counter(sub)
+	}
+	return total
+}
@@ -0,0 +1,177 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+)
+
+// memorySink collects the events it receives, Send blocks while release is open
+type memorySink struct {
+	release chan struct{}
+	err     error
+	events  []Event
+	closed  bool
+	mu      sync.Mutex
+}
+
+func (s *memorySink) Name() string { return "memory" }
+
+func (s *memorySink) Send(ctx context.Context, events []Event) error {
+	if s.release != nil {
+		<-s.release
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	return s.err
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *memorySink) received() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+func gauge(name string, value float64) models.Metrics {
+	return models.Metrics{ID: name, MType: constants.MetricTypeGauge, Value: &value}
+}
+
+func TestPublisherFanOut(t *testing.T) {
+	fast := &memorySink{}
+	slow := &memorySink{release: make(chan struct{})}
+	p := NewPublisher(zap.NewNop().Sugar(), 2, fast, slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.Start(ctx)
+
+	r := httptest.NewRequest(http.MethodPost, "/updates", nil)
+	r.RemoteAddr = "192.0.2.7:51234"
+	team := tenant.NewContext(context.Background(), "team")
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			p.Publish(team, r, []models.Metrics{gauge("Alloc", float64(i))})
+			// give the fast sink time to keep up, so that it drops nothing
+			time.Sleep(time.Millisecond)
+		}
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a slow sink")
+	}
+
+	assert.Eventually(t, func() bool { return len(fast.received()) == 10 }, time.Second, time.Millisecond)
+	assert.Positive(t, p.Dropped(), "the slow sink must drop the events that do not fit into its queue")
+
+	close(slow.release)
+	cancel()
+	p.Wait()
+
+	assert.True(t, fast.closed)
+	assert.True(t, slow.closed)
+	assert.Equal(t, int64(10), int64(len(slow.received()))+p.Dropped(), "every event is either delivered or dropped")
+
+	e := fast.received()[0]
+	assert.Equal(t, "192.0.2.7", e.Client)
+	assert.Equal(t, "team", e.Tenant)
+	assert.Equal(t, "Alloc", e.Metrics[0].ID)
+}
+
+func TestPublisherFlushesOnShutdown(t *testing.T) {
+	sink := &memorySink{err: errors.New("receiver down")}
+	p := NewPublisher(zap.NewNop().Sugar(), 10, sink)
+
+	r := httptest.NewRequest(http.MethodPost, "/update", nil)
+	metrics := []models.Metrics{gauge("Alloc", 1)}
+	p.Publish(context.Background(), r, metrics)
+	p.Publish(context.Background(), r, metrics)
+	metrics[0] = gauge("Frees", 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Start(ctx)
+	p.Wait()
+
+	received := sink.received()
+	require.Len(t, received, 2, "queued events are delivered at shutdown")
+	assert.Equal(t, "Alloc", received[0].Metrics[0].ID, "events must not alias the published slice")
+	assert.Equal(t, int64(2), p.Failed())
+
+	var disabled *Publisher
+	disabled.Publish(ctx, r, metrics)
+	disabled.Wait()
+	assert.Zero(t, disabled.Dropped())
+}
+
+func TestFileSink(t *testing.T) {
+	path := t.TempDir() + "/events.jsonl"
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+
+	batch := []Event{{Client: "192.0.2.7", Metrics: []models.Metrics{gauge("Alloc", 1)}}, {Client: "192.0.2.8"}}
+	require.NoError(t, sink.Send(context.Background(), batch))
+	require.NoError(t, sink.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var clients []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		clients = append(clients, e.Client)
+	}
+	assert.Equal(t, []string{"192.0.2.7", "192.0.2.8"}, clients)
+}
+
+func TestHTTPSink(t *testing.T) {
+	var received []Event
+	status := http.StatusAccepted
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, constants.ApplicationJSON, r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	sink := NewHTTPSink(ts.URL)
+	defer sink.Close()
+
+	batch := []Event{{Client: "192.0.2.7", Metrics: []models.Metrics{gauge("Alloc", 1)}}}
+	require.NoError(t, sink.Send(context.Background(), batch))
+	require.Len(t, received, 1)
+	assert.Equal(t, "Alloc", received[0].Metrics[0].ID)
+
+	status = http.StatusServiceUnavailable
+	assert.Error(t, sink.Send(context.Background(), batch))
+}
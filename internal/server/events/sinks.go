@@ -0,0 +1,101 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+)
+
+// httpTimeout bounds a single delivery to an HTTP receiver
+const httpTimeout = 10 * time.Second
+
+// FileSink appends events as JSON lines to a local file
+type FileSink struct {
+	file *os.File
+}
+
+// NewFileSink opens the file at path for appending
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Name describes the sink in logs
+func (s *FileSink) Name() string {
+	return "file " + s.file.Name()
+}
+
+// Send appends the events with a single write
+func (s *FileSink) Send(ctx context.Context, events []Event) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.file.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// HTTPSink posts batches of events as JSON arrays to a URL
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSink creates a sink posting to url
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{url: url, client: &http.Client{Timeout: httpTimeout}}
+}
+
+// Name describes the sink in logs
+func (s *HTTPSink) Name() string {
+	return "HTTP " + s.url
+}
+
+// Send posts the events, any response but 2xx is an error
+func (s *HTTPSink) Send(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", constants.ApplicationJSON)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received non-2xx response: %s", resp.Status)
+	}
+	return nil
+}
+
+// Close releases idle connections
+func (s *HTTPSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
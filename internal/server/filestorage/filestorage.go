@@ -7,13 +7,20 @@ import (
 	"time"
 
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/selfmetrics"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/storage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 	"go.uber.org/zap"
 )
 
 type SerializedMetrics struct {
-	Gauges  map[string]float64 `json:"gauges"`
-	Counter map[string]int64   `json:"counter"`
+	Gauges     map[string]float64          `json:"gauges"`
+	Counter    map[string]int64            `json:"counter"`
+	Histograms map[string]models.Histogram `json:"histograms,omitempty"`
+	Summaries  map[string]sketch.Sketch    `json:"summaries,omitempty"`
+	Sets       map[string]hll.Sketch       `json:"sets,omitempty"`
 }
 
 // SaveToFile saves metrics to a file. Directories are created if they do not exist
@@ -25,8 +32,11 @@ func SaveToFile(cfg *config.Config, storage storage.Interface) error {
 	gauges, counters := storage.GetMetricsData()
 
 	data := SerializedMetrics{
-		Gauges:  gauges,
-		Counter: counters,
+		Gauges:     gauges,
+		Counter:    counters,
+		Histograms: storage.GetHistogramsData(),
+		Summaries:  storage.GetSummariesData(),
+		Sets:       storage.GetSetsData(),
 	}
 
 	jsonData, err := json.Marshal(data)
@@ -58,6 +68,9 @@ func LoadFromFile(storage *storage.InMemoryStorage, filename string) error {
 	}
 
 	storage.SetMetricsData(data.Gauges, data.Counter)
+	storage.SetHistogramsData(data.Histograms)
+	storage.SetSummariesData(data.Summaries)
+	storage.SetSetsData(data.Sets)
 	return nil
 }
 
@@ -69,27 +82,35 @@ func RestoreData(sugar *zap.SugaredLogger, storage *storage.InMemoryStorage, cfg
 	}
 }
 
+// save saves metrics to a file and records how long it took in reg, which may be nil
+func save(sugar *zap.SugaredLogger, cfg *config.Config, storage *storage.InMemoryStorage, reg *selfmetrics.Registry) {
+	start := time.Now()
+	err := SaveToFile(cfg, storage)
+	reg.ObserveSnapshot(time.Since(start), err)
+	if err != nil {
+		sugar.Errorf("Error when saving a file: %v", err)
+	}
+}
+
 // StartSyncSave starts a goroutine that saves metrics to a file whenever an update occurs
-func StartSyncSave(sugar *zap.SugaredLogger, cfg *config.Config, storage *storage.InMemoryStorage) {
+// the saves are recorded in reg, which may be nil
+func StartSyncSave(sugar *zap.SugaredLogger, cfg *config.Config, storage *storage.InMemoryStorage, reg *selfmetrics.Registry) {
 	go func() {
 		for range storage.GetUpdateChannel() {
-			if err := SaveToFile(cfg, storage); err != nil {
-				sugar.Errorf("Error when saving a file: %v", err)
-			}
+			save(sugar, cfg, storage, reg)
 		}
 	}()
 }
 
 // StartPeriodicSave starts a goroutine that saves metrics to a file at regular intervals
-func StartPeriodicSave(sugar *zap.SugaredLogger, cfg *config.Config, storage *storage.InMemoryStorage) {
+// the saves are recorded in reg, which may be nil
+func StartPeriodicSave(sugar *zap.SugaredLogger, cfg *config.Config, storage *storage.InMemoryStorage, reg *selfmetrics.Registry) {
 	go func() {
 		ticker := time.NewTicker(cfg.StoreInterval)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			if err := SaveToFile(cfg, storage); err != nil {
-				sugar.Errorf("Error when saving a file: %v", err)
-			}
+			save(sugar, cfg, storage, reg)
 		}
 	}()
 }
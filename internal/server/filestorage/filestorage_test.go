@@ -1,12 +1,16 @@
 package filestorage
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/storage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -116,3 +120,61 @@ func TestSaveAndLoadFromFile(t *testing.T) {
 		})
 	}
 }
+
+func TestSaveAndLoadHistograms(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := &config.Config{Restore: true, FileStoragePath: filePath}
+
+	h := models.NewHistogram([]float64{0.5, 1})
+	h.Observe(0.7)
+
+	s := storage.NewInMemoryStorage()
+	require.NoError(t, s.UpdateHistogram(context.TODO(), "Latency", h, false))
+	require.NoError(t, SaveToFile(cfg, s))
+
+	restored := storage.NewInMemoryStorage()
+	require.NoError(t, LoadFromFile(restored, filePath))
+
+	got, err := restored.GetHistogram(context.TODO(), "Latency")
+	require.NoError(t, err)
+	assert.Equal(t, h, got)
+}
+
+func TestSaveAndLoadSummaries(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := &config.Config{Restore: true, FileStoragePath: filePath}
+
+	sk := sketch.New(sketch.DefaultAlpha)
+	sk.Add(0.7)
+	sk.Add(-1.5)
+	sk.Add(0)
+
+	s := storage.NewInMemoryStorage()
+	require.NoError(t, s.UpdateSummary(context.TODO(), "Latency", sk, false))
+	require.NoError(t, SaveToFile(cfg, s))
+
+	restored := storage.NewInMemoryStorage()
+	require.NoError(t, LoadFromFile(restored, filePath))
+
+	got, err := restored.GetSummary(context.TODO(), "Latency")
+	require.NoError(t, err)
+	assert.Equal(t, sk, got)
+}
+
+func TestSaveAndLoadSets(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := &config.Config{Restore: true, FileStoragePath: filePath}
+
+	s := storage.NewInMemoryStorage()
+	require.NoError(t, s.UpdateSet(context.TODO(), "Users", []string{"alice", "bob"}, false))
+	require.NoError(t, SaveToFile(cfg, s))
+
+	restored := storage.NewInMemoryStorage()
+	require.NoError(t, LoadFromFile(restored, filePath))
+
+	expected, err := s.GetSet(context.TODO(), "Users")
+	require.NoError(t, err)
+	got, err := restored.GetSet(context.TODO(), "Users")
+	require.NoError(t, err)
+	assert.Equal(t, expected, got)
+}
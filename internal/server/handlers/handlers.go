@@ -3,118 +3,163 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/events"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/query"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
 	"github.com/go-chi/chi/v5"
 )
 
-// extractMetrics takes an HTTP request and returns metric details extracted from it
-// it handles both JSON and URL parameter formats to retrieve metric type, name, value, and delta
-// returns an error if unable to decode the request body or URL parameters
-func extractMetrics(r *http.Request) (string, string, *float64, *int64, error) {
-	contentType := r.Header.Get("Content-Type")
-
-	var metricType string
-	var metricName string
-	var metricValue *float64
-	var metricDelta *int64
-
-	if strings.TrimSpace(contentType) == constants.ApplicationJSON {
-		dec := json.NewDecoder(r.Body)
-		var req models.Metrics
-
-		if err := dec.Decode(&req); err != nil {
-			return "", "", nil, nil, err
+// extractMetrics takes an HTTP request and returns the metric extracted from it
+// it handles both JSON and URL parameter formats; histograms and summaries can only be sent as JSON,
+// a URL value adds a single member to a set, and a URL value that cannot be parsed for the metric type
+// leaves Value and Delta unset
+// returns an error if unable to decode the request body
+func extractMetrics(r *http.Request) (models.Metrics, error) {
+	var metric models.Metrics
+
+	if strings.TrimSpace(r.Header.Get("Content-Type")) == constants.ApplicationJSON {
+		if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+			return models.Metrics{}, err
 		}
+		return metric, nil
+	}
 
-		metricType = req.MType
-		metricName = req.ID
-		metricValue = req.Value
-		metricDelta = req.Delta
-
-	} else {
-		metricType = chi.URLParam(r, "type")
-		metricName = chi.URLParam(r, "name")
+	metric.MType = chi.URLParam(r, "type")
+	metric.ID = chi.URLParam(r, "name")
 
-		valueStr := chi.URLParam(r, "value")
+	valueStr := chi.URLParam(r, "value")
 
-		switch metricType {
-		case constants.MetricTypeGauge:
-			if value, err := utils.ParseFloat(valueStr); err == nil {
-				metricValue = &value
-				metricDelta = nil
-			}
-		case constants.MetricTypeCounter:
-			if delta, err := utils.ParseInt(valueStr); err == nil {
-				metricValue = nil
-				metricDelta = &delta
-			}
+	switch metric.MType {
+	case constants.MetricTypeGauge:
+		if value, err := utils.ParseFloat(valueStr); err == nil {
+			metric.Value = &value
+		}
+	case constants.MetricTypeCounter:
+		if delta, err := utils.ParseInt(valueStr); err == nil {
+			metric.Delta = &delta
+		}
+	case constants.MetricTypeSet:
+		if valueStr != "" {
+			metric.Members = []string{valueStr}
 		}
 	}
 
-	return metricType, metricName, metricValue, metricDelta, nil
+	return metric, nil
 }
 
 // HandleUpdateMetric is an HTTP handler that updates a metric in the storage
 // it extracts metric information from the request and uses it to update the metric in storage
+// and publishes an event of the accepted metric to pub, which may be nil
 // responds with an HTTP status and, in case of JSON content type, a JSON-encoded response
-func HandleUpdateMetric(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface, shouldNotify bool) http.HandlerFunc {
+func HandleUpdateMetric(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface, pub *events.Publisher, shouldNotify bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		metricType, metricName, metricValue, metricDelta, err := extractMetrics(r)
+		ctx := audit.Scope(tenant.Scope(ctx, r), r)
+		metric, err := extractMetrics(r)
 
 		if err != nil {
 			sugar.Errorw("Error when extracting metrics", err)
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			status := decodeErrorStatus(err)
+			http.Error(w, http.StatusText(status), status)
 			return
 		}
 
-		switch metricType {
+		switch metric.MType {
 		case constants.MetricTypeGauge:
-			if metricValue != nil {
-				err = storage.UpdateGauge(ctx, metricName, *metricValue, shouldNotify)
+			if metric.Value != nil {
+				err = storage.UpdateGauge(ctx, metric.ID, *metric.Value, shouldNotify)
 			} else {
 				http.Error(w, "Missing 'value' for gauge", http.StatusBadRequest)
 				return
 			}
 		case constants.MetricTypeCounter:
-			if metricDelta != nil {
-				err = storage.UpdateCounter(ctx, metricName, *metricDelta, shouldNotify)
+			if metric.Delta != nil {
+				err = storage.UpdateCounter(ctx, metric.ID, *metric.Delta, shouldNotify)
 			} else {
 				http.Error(w, "Missing 'delta' for counter", http.StatusBadRequest)
 				return
 			}
+		case constants.MetricTypeHistogram:
+			if validateErr := metric.Validate(); validateErr == nil {
+				err = storage.UpdateHistogram(ctx, metric.ID, metric.Histogram(), shouldNotify)
+			} else {
+				http.Error(w, validateErr.Error(), http.StatusBadRequest)
+				return
+			}
+		case constants.MetricTypeSummary:
+			if validateErr := metric.Validate(); validateErr == nil {
+				err = storage.UpdateSummary(ctx, metric.ID, *metric.Sketch, shouldNotify)
+			} else {
+				http.Error(w, validateErr.Error(), http.StatusBadRequest)
+				return
+			}
+		case constants.MetricTypeSet:
+			if len(metric.Members) > 0 {
+				err = storage.UpdateSet(ctx, metric.ID, metric.Members, shouldNotify)
+			} else {
+				http.Error(w, "Missing 'members' for set", http.StatusBadRequest)
+				return
+			}
 		default:
 			http.Error(w, "Invalid metric type", http.StatusBadRequest)
 			return
 		}
 
+		if errors.Is(err, limits.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
 		if err != nil {
 			sugar.Errorf("Failed to update metric: %v", err)
 			http.Error(w, "Failed to update metric", http.StatusInternalServerError)
 			return
 		}
+		pub.Publish(ctx, r, []models.Metrics{metric})
 
 		if r.Header.Get("Content-Type") == constants.ApplicationJSON {
 			response := map[string]interface{}{
-				"type": metricType,
-				"name": metricName,
+				"type": metric.MType,
+				"name": metric.ID,
+			}
+
+			if metric.Value != nil {
+				response["value"] = metric.Value
+			}
+
+			if metric.Delta != nil {
+				response["delta"] = metric.Delta
 			}
 
-			if metricValue != nil {
-				response["value"] = metricValue
+			if metric.MType == constants.MetricTypeHistogram {
+				response["bounds"] = metric.Bounds
+				response["buckets"] = metric.Buckets
+				response["sum"] = metric.Sum
+				response["count"] = metric.Count
 			}
 
-			if metricDelta != nil {
-				response["delta"] = metricDelta
+			if metric.Sketch != nil {
+				response["sketch"] = metric.Sketch
+			}
+
+			if metric.Members != nil {
+				response["members"] = metric.Members
 			}
 
 			w.Header().Set("Content-Type", constants.ApplicationJSON)
@@ -132,18 +177,25 @@ func HandleUpdateMetric(ctx context.Context, sugar *zap.SugaredLogger, storage m
 
 // HandleGetMetric is an HTTP handler that retrieves a metric from the storage
 // it extracts metric information from the request and uses it to fetch the metric from storage
-// responds with the metric value in either JSON format or as a plain string based on the request's Content-Type header
+// responds with the metric value in either JSON format or as a plain string based on the request's Content-Type header;
+// a histogram has no single value, so it is always returned as JSON with its bounds, buckets, sum and count;
+// a summary is returned as JSON with its sketch, unless a quantile is requested with '?q=0.99',
+// in which case the estimated value at that quantile is returned as a plain string;
+// for a set the estimated number of distinct members is returned;
+// a JSON counter response also carries the per-second rate when a window is requested with '?window=1m'
 func HandleGetMetric(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface) http.HandlerFunc {
-	var v interface{}
-
 	return func(w http.ResponseWriter, r *http.Request) {
-		metricType, metricName, _, _, err := extractMetrics(r)
+		ctx := tenant.Scope(ctx, r)
+		var v interface{}
+
+		metric, err := extractMetrics(r)
 
 		if err != nil {
 			sugar.Errorw("Error when extracting metrics", err)
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 			return
 		}
+		metricType, metricName := metric.MType, metric.ID
 
 		switch metricType {
 		case constants.MetricTypeGauge:
@@ -152,17 +204,48 @@ func HandleGetMetric(ctx context.Context, sugar *zap.SugaredLogger, storage mode
 		case constants.MetricTypeCounter:
 			v, err = storage.GetCounter(ctx, metricName)
 
+		case constants.MetricTypeHistogram:
+			v, err = storage.GetHistogram(ctx, metricName)
+
+		case constants.MetricTypeSummary:
+			v, err = storage.GetSummary(ctx, metricName)
+
+		case constants.MetricTypeSet:
+			var set hll.Sketch
+			if set, err = storage.GetSet(ctx, metricName); err == nil {
+				v = int64(set.Estimate())
+			}
+
 		default:
 			http.Error(w, "Invalid metric type", http.StatusBadRequest)
 			return
 		}
 
 		if err != nil {
-			http.Error(w, "Not found", http.StatusNotFound)
+			writeGetError(w, sugar, err)
 			return
 		}
 
-		if r.Header.Get("Content-Type") == constants.ApplicationJSON {
+		if qStr := r.URL.Query().Get("q"); metricType == constants.MetricTypeSummary && qStr != "" {
+			s, ok := v.(sketch.Sketch)
+			if !ok {
+				sugar.Errorw("Unexpected type for summary", "received", v)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			q, parseErr := utils.ParseFloat(qStr)
+			if parseErr != nil {
+				http.Error(w, "Invalid quantile", http.StatusBadRequest)
+				return
+			}
+
+			if v, err = s.Quantile(q); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if r.Header.Get("Content-Type") == constants.ApplicationJSON ||
+			metricType == constants.MetricTypeHistogram || metricType == constants.MetricTypeSummary {
 			resp := models.Metrics{
 				ID:    metricName,
 				MType: metricType,
@@ -186,6 +269,47 @@ func HandleGetMetric(ctx context.Context, sugar *zap.SugaredLogger, storage mode
 					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 					return
 				}
+
+				if r.URL.Query().Has("window") {
+					window, windowErr := parseWindow(r)
+					if windowErr != nil {
+						http.Error(w, windowErr.Error(), http.StatusBadRequest)
+						return
+					}
+					rate, rateErr := storage.GetCounterRate(ctx, metricName, window)
+					if rateErr != nil {
+						writeGetError(w, sugar, rateErr)
+						return
+					}
+					resp.Rate = &rate
+				}
+
+			case constants.MetricTypeHistogram:
+				if h, ok := v.(models.Histogram); ok {
+					resp = models.NewHistogramMetric(metricName, h)
+				} else {
+					sugar.Errorw("Unexpected type for histogram", "received", v)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+
+			case constants.MetricTypeSummary:
+				if s, ok := v.(sketch.Sketch); ok {
+					resp = models.NewSummaryMetric(metricName, s)
+				} else {
+					sugar.Errorw("Unexpected type for summary", "received", v)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+
+			case constants.MetricTypeSet:
+				if value, ok := v.(int64); ok {
+					resp.Unique = &value
+				} else {
+					sugar.Errorw("Unexpected type for set estimate", "received", v)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
 			}
 
 			w.Header().Set("Content-Type", "application/json")
@@ -206,33 +330,433 @@ func HandleGetMetric(ctx context.Context, sugar *zap.SugaredLogger, storage mode
 	}
 }
 
-// HandleSaveMetrics is an HTTP handler that saves a batch of metrics in the storage
-func HandleSaveMetrics(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface, shouldNotify bool) http.HandlerFunc {
+// defaultRateWindow is the rate window used when a rate is requested without one
+const defaultRateWindow = time.Minute
+
+// parseWindow reads the rate window from the 'window' query parameter, either a duration such as '5m'
+// or a number of seconds; the default window is used if the parameter is absent
+func parseWindow(r *http.Request) (time.Duration, error) {
+	windowStr := r.URL.Query().Get("window")
+	if windowStr == "" {
+		return defaultRateWindow, nil
+	}
+
+	window, err := time.ParseDuration(windowStr)
+	if err != nil {
+		seconds, secondsErr := utils.ParseInt(windowStr)
+		if secondsErr != nil {
+			return 0, fmt.Errorf("invalid rate window %q", windowStr)
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+	if window <= 0 {
+		return 0, fmt.Errorf("rate window %q must be positive", windowStr)
+	}
+
+	return window, nil
+}
+
+// HandleGetRate is an HTTP handler that returns the per-second rate of a counter over a window
+// as a plain string, e.g. 'GET /rate/counter/PollCount?window=1m'; only counters have a rate
+func HandleGetRate(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var metrics []models.Metrics
+		ctx := tenant.Scope(ctx, r)
+		if chi.URLParam(r, "type") != constants.MetricTypeCounter {
+			http.Error(w, "Rates are only available for counters", http.StatusBadRequest)
+			return
+		}
 
-		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&metrics)
+		window, err := parseWindow(r)
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		err = storage.SaveMetrics(ctx, metrics, shouldNotify)
+		rate, err := storage.GetCounterRate(ctx, chi.URLParam(r, "name"), window)
 		if err != nil {
-			sugar.Errorw("Failed to save metrics", err)
-			http.Error(w, fmt.Sprintf("Failed to save metrics: %s", err.Error()), http.StatusBadRequest)
+			writeGetError(w, sugar, err)
 			return
 		}
 
-		if r.Header.Get("Content-Type") == "application/json" {
-			w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.WriteString(w, fmt.Sprint(rate)); err != nil {
+			sugar.Errorw("Cannot write to response body", err)
+		}
+	}
+}
+
+// defaultHistoryRange is the span of history returned when neither 'from' nor 'range' is given
+const defaultHistoryRange = time.Hour
+
+// historyResponse is the JSON body returned by HandleGetHistory
+type historyResponse struct {
+	ID     string          `json:"id"`
+	MType  string          `json:"type"`
+	Tier   string          `json:"tier"`   // 'raw' or the resolution of the rollup tier the points come from
+	Points []history.Point `json:"points"` // points in time order
+}
+
+// parseTime parses a query time given in RFC 3339 or as unix seconds
+func parseTime(s string) (time.Time, error) {
+	if seconds, err := utils.ParseInt(s); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// historySpan reads the queried span from the 'from', 'to' and 'range' query parameters
+// 'to' defaults to now and 'from' to 'to' minus 'range', which defaults to an hour
+func historySpan(r *http.Request, now time.Time) (from, to time.Time, err error) {
+	query := r.URL.Query()
+
+	to = now
+	if toStr := query.Get("to"); toStr != "" {
+		if to, err = parseTime(toStr); err != nil {
+			return from, to, fmt.Errorf("invalid 'to' time %q", toStr)
+		}
+	}
+
+	if fromStr := query.Get("from"); fromStr != "" {
+		if from, err = parseTime(fromStr); err != nil {
+			return from, to, fmt.Errorf("invalid 'from' time %q", fromStr)
+		}
+	} else {
+		span := defaultHistoryRange
+		if rangeStr := query.Get("range"); rangeStr != "" {
+			if span, err = time.ParseDuration(rangeStr); err != nil || span <= 0 {
+				return from, to, fmt.Errorf("invalid range %q", rangeStr)
+			}
+		}
+		from = to.Add(-span)
+	}
+
+	if from.After(to) {
+		return from, to, errors.New("'from' is after 'to'")
+	}
+	return from, to, nil
+}
+
+// HandleGetHistory is an HTTP handler that returns the recorded history of a gauge or counter as JSON,
+// e.g. 'GET /history/gauge/Alloc?range=24h'; the storage picks the finest tier that reaches back to 'from',
+// so recent spans return raw samples and older ones minute or hour rollups with min, max, avg and last
+func HandleGetHistory(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tenant.Scope(ctx, r)
+		metricType, metricName := chi.URLParam(r, "type"), chi.URLParam(r, "name")
+		if metricType != constants.MetricTypeGauge && metricType != constants.MetricTypeCounter {
+			http.Error(w, "History is only kept for gauges and counters", http.StatusBadRequest)
+			return
+		}
+
+		from, to, err := historySpan(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tier, points, err := storage.GetHistory(ctx, metricType, metricName, from, to)
+		if errors.Is(err, history.ErrDisabled) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			sugar.Errorf("Failed to fetch metric history: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if points == nil {
+			points = []history.Point{}
+		}
+
+		w.Header().Set("Content-Type", constants.ApplicationJSON)
+		w.WriteHeader(http.StatusOK)
+		resp := historyResponse{ID: metricName, MType: metricType, Tier: tier.Name(), Points: points}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			sugar.Errorw("Cannot encode response JSON body", err)
+		}
+	}
+}
+
+// queryResponse is the JSON body returned by HandleQuery
+type queryResponse struct {
+	Expr string `json:"expr"`
+	query.Result
+}
+
+// HandleQuery is an HTTP handler that evaluates the expression in the 'expr' query parameter
+// over the current values of gauges or counters and returns the result as JSON,
+// e.g. 'GET /query?expr=sum(gauge{name=~"Heap.*"})' or 'GET /query?expr=topk(3, counter)'
+func HandleQuery(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tenant.Scope(ctx, r)
+		expr := r.URL.Query().Get("expr")
+		q, err := query.Parse(expr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := query.Eval(ctx, storage, q)
+		if err != nil {
+			sugar.Errorf("Failed to evaluate query %q: %v", expr, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", constants.ApplicationJSON)
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(queryResponse{Expr: expr, Result: result}); err != nil {
+			sugar.Errorw("Cannot encode response JSON body", err)
+		}
+	}
+}
+
+const (
+	// defaultAuditLimit is the number of audit entries returned when no 'limit' is given
+	defaultAuditLimit = 1000
+	// maxAuditLimit is the largest number of audit entries returned at once
+	maxAuditLimit = 10000
+)
+
+// auditFilter reads the audit filter from the 'name', 'since', 'after' and 'limit' query parameters
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	query := r.URL.Query()
+	f := audit.Filter{Name: query.Get("name"), Limit: defaultAuditLimit}
+
+	if sinceStr := query.Get("since"); sinceStr != "" {
+		since, err := parseTime(sinceStr)
+		if err != nil {
+			return f, fmt.Errorf("invalid 'since' time %q", sinceStr)
+		}
+		f.Since = since
+	}
+
+	if afterStr := query.Get("after"); afterStr != "" {
+		after, err := utils.ParseInt(afterStr)
+		if err != nil || after < 0 {
+			return f, fmt.Errorf("invalid 'after' id %q", afterStr)
+		}
+		f.After = after
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := utils.ParseInt(limitStr)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			return f, fmt.Errorf("limit %q must be between 1 and %d", limitStr, maxAuditLimit)
+		}
+		f.Limit = int(limit)
+	}
+
+	return f, nil
+}
+
+// HandleGetAudit is an HTTP handler that returns the audited updates of the tenant as a JSON array, oldest first,
+// e.g. 'GET /audit?name=Alloc&since=2024-01-02T15:04:05Z&limit=100'; all parameters are optional,
+// and clients page through the log by passing the id of the last entry as the next 'after',
+// which returns every entry exactly once even though the entries of a batch share their time
+func HandleGetAudit(ctx context.Context, sugar *zap.SugaredLogger, log *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tenant.Scope(ctx, r)
+		f, err := auditFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries, err := log.Read(ctx, f)
+		if err != nil {
+			sugar.Errorf("Failed to read audit log: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", constants.ApplicationJSON)
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			sugar.Errorw("Cannot encode response JSON body", err)
+		}
+	}
+}
+
+const (
+	// saveChunkSize is the number of metrics handed to the storage at once in partial mode
+	saveChunkSize = 500
+
+	// batchModeAtomic applies a batch only if every element is valid
+	batchModeAtomic = "atomic"
+	// batchModePartial applies the valid elements of a batch and reports the rejected ones
+	batchModePartial = "partial"
+)
+
+// decodeMetricsStream reads a JSON array of metrics token by token and calls visit for every element,
+// so the request body is never held in memory; an element whose fields have the wrong JSON type
+// is passed to visit together with the decoding error, any other decoding error stops the stream
+func decodeMetricsStream(r io.Reader, visit func(index int, metric models.Metrics, err error)) error {
+	dec := json.NewDecoder(r)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("expected a JSON array of metrics")
+	}
+
+	for index := 0; dec.More(); index++ {
+		var metric models.Metrics
+		err := dec.Decode(&metric)
+
+		var typeErr *json.UnmarshalTypeError
+		if err != nil && !errors.As(err, &typeErr) {
+			return err
+		}
+
+		visit(index, metric, err)
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+// writeGetError responds to a failed read of a metric, metrics and rates the storage does not have
+// are reported as 404 and other failures as 500
+func writeGetError(w http.ResponseWriter, sugar *zap.SugaredLogger, err error) {
+	if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrNoRate) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	sugar.Errorw("Failed to fetch metric", "err", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// decodeErrorStatus maps an error returned while reading a request body to an HTTP status,
+// bodies exceeding the configured size limit are reported as 413
+func decodeErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// writeBatchReport writes the per-item batch report as a JSON response
+func writeBatchReport(w http.ResponseWriter, sugar *zap.SugaredLogger, status int, report *models.BatchReport) {
+	w.Header().Set("Content-Type", constants.ApplicationJSON)
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		sugar.Errorw("Cannot encode response JSON body", "err", err)
+	}
+}
+
+// HandleSaveMetrics is an HTTP handler that saves a batch of metrics in the storage
+// the batch is decoded as a stream and every element is validated;
+// in the default atomic mode the batch is applied only if all elements are valid, otherwise it is
+// rejected with a 400 report listing the invalid elements;
+// with '?mode=partial' valid elements are applied in chunks as they are read and the response
+// is a report of which elements were accepted or rejected and why, if the stream breaks off
+// the elements read so far are still applied and reported along with the error;
+// a batch that would exceed the metric quota of the tenant is rejected with 429 Too Many Requests;
+// an event of the applied metrics is published to pub, which may be nil, once per request
+// in atomic mode and once per applied chunk in partial mode
+func HandleSaveMetrics(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface, pub *events.Publisher, shouldNotify bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := audit.Scope(tenant.Scope(ctx, r), r)
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = batchModeAtomic
+		}
+		if mode != batchModeAtomic && mode != batchModePartial {
+			http.Error(w, fmt.Sprintf("Invalid batch mode: %s", mode), http.StatusBadRequest)
+			return
+		}
+		partial := mode == batchModePartial
+
+		report := &models.BatchReport{Items: []models.ItemResult{}}
+		var pending []models.Metrics
+		var pendingIndexes []int
+
+		flush := func() {
+			err := storage.SaveMetrics(ctx, pending, shouldNotify)
+			if err != nil {
+				sugar.Errorw("Failed to save metrics", "err", err)
+			}
+			for i, metric := range pending {
+				if err != nil {
+					report.Reject(pendingIndexes[i], metric, err)
+				} else {
+					report.Accept(pendingIndexes[i], metric)
+				}
+			}
+			if err == nil {
+				pub.Publish(ctx, r, pending)
+			}
+			pending, pendingIndexes = pending[:0], pendingIndexes[:0]
+		}
+
+		err := decodeMetricsStream(r.Body, func(index int, metric models.Metrics, err error) {
+			if err == nil {
+				err = metric.Validate()
+			}
+			if err != nil {
+				report.Reject(index, metric, err)
+				return
+			}
+
+			pending = append(pending, metric)
+			pendingIndexes = append(pendingIndexes, index)
+			if partial && len(pending) == saveChunkSize {
+				flush()
+			}
+		})
+
+		if partial {
+			// the valid elements read before a stream error are applied like every other chunk
+			if len(pending) > 0 {
+				flush()
+			}
+
+			status := http.StatusOK
+			if err != nil {
+				sugar.Errorw("Failed to read metrics batch", "err", err)
+				status = decodeErrorStatus(err)
+				report.Error = err.Error()
+			}
+			writeBatchReport(w, sugar, status, report)
+			return
+		}
+
+		if err != nil {
+			sugar.Errorw("Failed to read metrics batch", "err", err)
+			http.Error(w, fmt.Sprintf("Failed to save metrics: %s", err.Error()), decodeErrorStatus(err))
+			return
+		}
+
+		if report.Rejected > 0 {
+			writeBatchReport(w, sugar, http.StatusBadRequest, report)
+			return
+		}
+
+		if err := storage.SaveMetrics(ctx, pending, shouldNotify); err != nil {
+			sugar.Errorw("Failed to save metrics", "err", err)
+			status := http.StatusBadRequest
+			if errors.Is(err, limits.ErrQuotaExceeded) {
+				status = http.StatusTooManyRequests
+			}
+			http.Error(w, fmt.Sprintf("Failed to save metrics: %s", err.Error()), status)
+			return
+		}
+		pub.Publish(ctx, r, pending)
+
+		if r.Header.Get("Content-Type") == constants.ApplicationJSON {
+			w.Header().Set("Content-Type", constants.ApplicationJSON)
 			w.WriteHeader(http.StatusOK)
 
 			jsonData := struct {
 				Zero []models.Metrics `json:"0"`
 			}{
-				Zero: metrics,
+				Zero: pending,
 			}
 
 			if err := json.NewEncoder(w).Encode(jsonData); err != nil {
@@ -250,6 +774,7 @@ func HandleSaveMetrics(ctx context.Context, sugar *zap.SugaredLogger, storage mo
 // responds with an HTML page containing the metrics
 func HandleMetricsHTML(ctx context.Context, sugar *zap.SugaredLogger, storage models.GeneralStorageInterface) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tenant.Scope(ctx, r)
 		metricsString := storage.String(ctx)
 		html := "<html><head><title>Metrics</title>" +
 			"<style>body { background-color: black; color: white; font-size: 1.2rem; line-height: 1.5rem }</style>" +
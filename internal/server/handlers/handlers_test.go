@@ -2,16 +2,30 @@ package handlers_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/events"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/handlers"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/storage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -22,7 +36,7 @@ func TestHandleUpdateAndGetMetrics(t *testing.T) {
 	r := chi.NewRouter()
 	sugar := zap.NewExample().Sugar()
 
-	r.HandleFunc("/update", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, false))
+	r.HandleFunc("/update", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
 	r.HandleFunc("/value", handlers.HandleGetMetric(context.TODO(), sugar, storage))
 
 	ts := httptest.NewServer(r)
@@ -110,3 +124,763 @@ func TestHandleMetricsHTML(t *testing.T) {
 	assert.Contains(t, string(body), "testGauge: 42.2")
 	assert.Contains(t, string(body), "testCounter: 42")
 }
+
+func TestHandleSaveMetrics(t *testing.T) {
+	sugar := zap.NewExample().Sugar()
+
+	testCases := []struct {
+		name           string
+		body           string
+		maxBodySize    int64
+		expectedStatus int
+		expectedGauge  float64
+		expectedDelta  int64
+	}{
+		{
+			name:           "Valid batch",
+			body:           `[{"id":"g","type":"gauge","value":1.5},{"id":"c","type":"counter","delta":2},{"id":"c","type":"counter","delta":3}]`,
+			maxBodySize:    1 << 20,
+			expectedStatus: http.StatusOK,
+			expectedGauge:  1.5,
+			expectedDelta:  5,
+		},
+		{
+			name:           "Not an array",
+			body:           `{"id":"g","type":"gauge","value":1.5}`,
+			maxBodySize:    1 << 20,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Malformed element",
+			body:           `[{"id":"g","type":"gauge","value":"x"}]`,
+			maxBodySize:    1 << 20,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Missing counter delta",
+			body:           `[{"id":"c","type":"counter"}]`,
+			maxBodySize:    1 << 20,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Atomic batch with an invalid element is not applied",
+			body:           `[{"id":"g","type":"gauge","value":1.5},{"id":"c","type":"counter","value":2}]`,
+			maxBodySize:    1 << 20,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Body too large",
+			body:           `[` + strings.Repeat(`{"id":"g","type":"gauge","value":1},`, 100) + `{"id":"g","type":"gauge","value":1}]`,
+			maxBodySize:    256,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := storage.NewInMemoryStorage()
+			r := chi.NewRouter()
+			r.Use(middleware.RequestSize(tc.maxBodySize))
+			r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			resp, err := http.Post(ts.URL+"/updates", "application/json", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tc.expectedStatus, resp.StatusCode)
+
+			if tc.expectedStatus == http.StatusOK {
+				gauge, err := storage.GetGauge(context.TODO(), "g")
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectedGauge, gauge)
+
+				counter, err := storage.GetCounter(context.TODO(), "c")
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectedDelta, counter)
+			} else {
+				_, err := storage.GetGauge(context.TODO(), "g")
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestHandleSaveMetricsPartial(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewExample().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	body := `[
+		{"id":"g","type":"gauge","value":1.5},
+		{"id":"c","type":"counter","value":2},
+		{"id":"h","type":"gauge","value":"x"},
+		{"id":"c","type":"counter","delta":3},
+		{"id":"u","type":"unknown"}
+	]`
+
+	resp, err := http.Post(ts.URL+"/updates?mode=partial", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report models.BatchReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+
+	assert.Equal(t, 2, report.Accepted)
+	assert.Equal(t, 3, report.Rejected)
+
+	statuses := make(map[int]string)
+	for _, item := range report.Items {
+		statuses[item.Index] = item.Status
+		if item.Status == models.ItemRejected {
+			assert.NotEmpty(t, item.Error)
+		}
+	}
+	assert.Equal(t, map[int]string{
+		0: models.ItemAccepted,
+		1: models.ItemRejected,
+		2: models.ItemRejected,
+		3: models.ItemAccepted,
+		4: models.ItemRejected,
+	}, statuses)
+
+	gauge, err := storage.GetGauge(context.TODO(), "g")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, gauge)
+
+	counter, err := storage.GetCounter(context.TODO(), "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), counter)
+
+	resp, err = http.Post(ts.URL+"/updates?mode=partial", "application/json", strings.NewReader(`[{"id":"t","type":"gauge","value":7},{"id":`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	report = models.BatchReport{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.NotEmpty(t, report.Error)
+	assert.Equal(t, 1, report.Accepted, "elements read before the stream broke off are reported")
+
+	gauge, err = storage.GetGauge(context.TODO(), "t")
+	require.NoError(t, err, "elements read before the stream broke off are applied")
+	assert.Equal(t, 7.0, gauge)
+}
+
+func TestHandleHistogram(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+	r.Post("/value", handlers.HandleGetMetric(context.TODO(), sugar, storage))
+	r.Get("/value/{type}/{name}", handlers.HandleGetMetric(context.TODO(), sugar, storage))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	status, _ := post("/update", `{"id":"Latency","type":"histogram","bounds":[0.1,1],"buckets":[1,2,0],"sum":1.1,"count":3}`)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = post("/updates", `[{"id":"Latency","type":"histogram","bounds":[0.1,1],"buckets":[0,0,1],"sum":5,"count":1}]`)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = post("/update", `{"id":"Latency","type":"histogram","bounds":[0.1,1],"buckets":[0,0,1],"sum":5,"count":2}`)
+	assert.Equal(t, http.StatusBadRequest, status, "count must match the buckets")
+
+	expected := `{"id":"Latency","type":"histogram","bounds":[0.1,1],"buckets":[1,2,1],"sum":6.1,"count":4}`
+
+	status, body := post("/value", `{"id":"Latency","type":"histogram"}`)
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, expected, body)
+
+	resp, err := http.Get(ts.URL + "/value/histogram/Latency")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, expected, string(data))
+}
+
+// failingStorage fails every read of a gauge the way an unreachable database does
+type failingStorage struct {
+	models.GeneralStorageInterface
+}
+
+func (failingStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestHandleGetMetricErrors(t *testing.T) {
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Get("/value/{type}/{name}", handlers.HandleGetMetric(context.TODO(), sugar, storage.NewInMemoryStorage()))
+	r.Get("/failing/{type}/{name}", handlers.HandleGetMetric(context.TODO(), sugar, failingStorage{storage.NewInMemoryStorage()}))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for path, status := range map[string]int{
+		"/value/gauge/Missing":   http.StatusNotFound,
+		"/failing/gauge/Missing": http.StatusInternalServerError,
+	} {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, path)
+	}
+}
+
+func TestHandleSummary(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+	r.Get("/value/{type}/{name}", handlers.HandleGetMetric(context.TODO(), sugar, storage))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	encode := func(from, to int) string {
+		s := sketch.New(sketch.DefaultAlpha)
+		for i := from; i <= to; i++ {
+			s.Add(float64(i))
+		}
+		data, err := json.Marshal(models.NewSummaryMetric("Latency", s))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	resp, err := http.Post(ts.URL+"/update", "application/json", strings.NewReader(encode(1, 50)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/updates", "application/json", strings.NewReader("["+encode(51, 100)+"]"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/update", "application/json", strings.NewReader(`{"id":"Latency","type":"summary","sketch":{"alpha":0.01,"count":1}}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "count must match the bins")
+
+	status, body := get("/value/summary/Latency?q=0.99")
+	require.Equal(t, http.StatusOK, status)
+	p99, err := strconv.ParseFloat(body, 64)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 99, p99, sketch.DefaultAlpha)
+
+	status, _ = get("/value/summary/Latency?q=1.5")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = get("/value/summary/Latency?q=abc")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = get("/value/summary/Missing?q=0.5")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = get("/value/summary/Latency")
+	require.Equal(t, http.StatusOK, status)
+	var metric models.Metrics
+	require.NoError(t, json.Unmarshal([]byte(body), &metric))
+	require.NotNil(t, metric.Sketch)
+	assert.Equal(t, int64(100), metric.Sketch.Count)
+	assert.Equal(t, 5050.0, metric.Sketch.Sum)
+}
+
+func TestHandleSet(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+	r.Post("/value", handlers.HandleGetMetric(context.TODO(), sugar, storage))
+	r.Get("/value/{type}/{name}", handlers.HandleGetMetric(context.TODO(), sugar, storage))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	post := func(path, contentType, body string) (int, string) {
+		resp, err := http.Post(ts.URL+path, contentType, strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	status, _ := post("/update", "application/json", `{"id":"Users","type":"set","members":["alice","bob"]}`)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = post("/updates", "application/json", `[{"id":"Users","type":"set","members":["bob","carol"]}]`)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = post("/update/set/Users/dave", "text/plain", "")
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = post("/update", "application/json", `{"id":"Users","type":"set","members":[]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	resp, err := http.Get(ts.URL + "/value/set/Users")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "4", string(data))
+
+	status, body := post("/value", "application/json", `{"id":"Users","type":"set"}`)
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"id":"Users","type":"set","unique":4}`, body)
+}
+
+func TestHandleCounterRate(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/value", handlers.HandleGetMetric(context.TODO(), sugar, storage))
+	r.Get("/rate/{type}/{name}", handlers.HandleGetRate(context.TODO(), sugar, storage))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, path := range []string{"/update/counter/Requests/5", "/update/gauge/Load/1"} {
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/rate/counter/Requests?window=1m", http.StatusOK},
+		{"/rate/counter/Requests?window=60", http.StatusOK},
+		{"/rate/counter/Requests", http.StatusOK},
+		{"/rate/counter/Requests?window=soon", http.StatusBadRequest},
+		{"/rate/counter/Requests?window=-1m", http.StatusBadRequest},
+		{"/rate/gauge/Load", http.StatusBadRequest},
+		{"/rate/counter/Missing", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equal(t, tt.status, resp.StatusCode)
+			if tt.status == http.StatusOK {
+				_, err := strconv.ParseFloat(string(data), 64)
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	resp, err := http.Post(ts.URL+"/value?window=1m", "application/json", strings.NewReader(`{"id":"Requests","type":"counter"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var metric models.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metric))
+	require.NotNil(t, metric.Delta)
+	assert.Equal(t, int64(5), *metric.Delta)
+	assert.NotNil(t, metric.Rate)
+}
+
+func TestHandleGetHistory(t *testing.T) {
+	tiers, err := history.ParseTiers("raw:1d,1m:30d")
+	require.NoError(t, err)
+
+	withHistory := storage.NewInMemoryStorage()
+	withHistory.SetHistoryTiers(tiers)
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, withHistory, nil, false))
+	r.Get("/history/{type}/{name}", handlers.HandleGetHistory(context.TODO(), sugar, withHistory))
+	r.Get("/disabled/{type}/{name}", handlers.HandleGetHistory(context.TODO(), sugar, storage.NewInMemoryStorage()))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, path := range []string{"/update/gauge/Load/1", "/update/gauge/Load/3", "/update/counter/Requests/5"} {
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		tier   string
+		points int
+	}{
+		{"/history/gauge/Load", http.StatusOK, "raw", 2},
+		// both updates fall into one minute unless they straddle a minute boundary
+		{"/history/gauge/Load?range=720h", http.StatusOK, "1m0s", -1},
+		{"/history/counter/Requests?range=10m", http.StatusOK, "raw", 1},
+		{"/history/gauge/Missing", http.StatusOK, "raw", 0},
+		{"/history/gauge/Load?range=soon", http.StatusBadRequest, "", 0},
+		{"/history/gauge/Load?from=2030-01-01T00:00:00Z&to=2020-01-01T00:00:00Z", http.StatusBadRequest, "", 0},
+		{"/history/summary/Latency", http.StatusBadRequest, "", 0},
+		{"/disabled/gauge/Load", http.StatusNotImplemented, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.status, resp.StatusCode)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Tier   string          `json:"tier"`
+				Points []history.Point `json:"points"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, tt.tier, body.Tier)
+			if tt.points >= 0 {
+				assert.Len(t, body.Points, tt.points)
+			} else {
+				assert.NotEmpty(t, body.Points)
+			}
+		})
+	}
+}
+
+func TestHandleQuery(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Get("/query", handlers.HandleQuery(context.TODO(), sugar, storage))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, path := range []string{"/update/gauge/HeapAlloc/10", "/update/gauge/HeapIdle/5", "/update/gauge/Alloc/1", "/update/counter/PollCount/3"} {
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	tests := []struct {
+		expr   string
+		status int
+		want   string
+	}{
+		{`sum(gauge{name=~"Heap.*"})`, http.StatusOK, `{"expr":"sum(gauge{name=~\"Heap.*\"})","value":15}`},
+		{`count(gauge)`, http.StatusOK, `{"expr":"count(gauge)","value":3}`},
+		{`max(counter)`, http.StatusOK, `{"expr":"max(counter)","value":3}`},
+		{`avg(gauge{name="Missing"})`, http.StatusOK, `{"expr":"avg(gauge{name=\"Missing\"})"}`},
+		{`topk(1, gauge)`, http.StatusOK, `{"expr":"topk(1, gauge)","series":[{"name":"HeapAlloc","value":10}]}`},
+		{`sum(histogram)`, http.StatusBadRequest, ""},
+		{`median(gauge)`, http.StatusBadRequest, ""},
+		{``, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + "/query?expr=" + url.QueryEscape(tt.expr))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equal(t, tt.status, resp.StatusCode)
+			if tt.status == http.StatusOK {
+				assert.JSONEq(t, tt.want, string(data))
+			}
+		})
+	}
+}
+
+func TestHandleTenants(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewNop().Sugar()
+	tokens := tenant.Tokens{tenant.Hash("team-token"): "team", tenant.Hash("ops-token"): "ops"}
+
+	r := chi.NewRouter()
+	r.Use(tenant.WithAuth(sugar, tokens, nil))
+	r.Get("/", handlers.HandleMetricsHTML(context.TODO(), sugar, storage))
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+	r.Get("/value/{type}/{name}", handlers.HandleGetMetric(context.TODO(), sugar, storage))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	do := func(method, path, token, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	status, _ := do(http.MethodPost, "/update/gauge/TeamLoad/1.5", "team-token", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = do(http.MethodPost, "/updates", "ops-token", `[{"id":"OpsLoad","type":"gauge","value":7}]`)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = do(http.MethodPost, "/update/gauge/TeamLoad/2", "", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, body := do(http.MethodGet, "/value/gauge/TeamLoad", "team-token", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "1.5", body)
+	status, _ = do(http.MethodGet, "/value/gauge/TeamLoad", "ops-token", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	_, page := do(http.MethodGet, "/", "ops-token", "")
+	assert.Contains(t, page, "OpsLoad")
+	assert.NotContains(t, page, "TeamLoad")
+}
+
+func TestHandleQuotaExceeded(t *testing.T) {
+	storage := storage.NewInMemoryStorage()
+	storage.SetQuota(limits.NewQuota(1))
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/update/gauge/Alloc/1", "", http.StatusOK},
+		{"/update/gauge/Alloc/2", "", http.StatusOK},
+		{"/update/gauge/Frees/1", "", http.StatusTooManyRequests},
+		{"/updates", `[{"id":"Alloc","type":"gauge","value":3},{"id":"Frees","type":"gauge","value":1}]`, http.StatusTooManyRequests},
+		{"/updates", `[{"id":"Alloc","type":"gauge","value":3}]`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Post(ts.URL+tt.path, "text/plain", strings.NewReader(tt.body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, tt.path+" "+tt.body)
+	}
+}
+
+func TestHandleGetAudit(t *testing.T) {
+	sink, err := audit.NewFileSink(t.TempDir()+"/audit.jsonl", 0, 0)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	storage := storage.NewInMemoryStorage()
+	auditLog := audit.NewLog(zap.NewNop().Sugar(), sink)
+	storage.SetAudit(auditLog)
+	sugar := zap.NewNop().Sugar()
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, nil, false))
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, nil, false))
+	r.Get("/audit", handlers.HandleGetAudit(context.TODO(), sugar, auditLog))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, update := range []struct{ path, body string }{
+		{"/update/gauge/Alloc/1", ""},
+		{"/update/counter/PollCount/2", ""},
+		{"/updates", `[{"id":"Alloc","type":"gauge","value":3}]`},
+	} {
+		resp, err := http.Post(ts.URL+update.path, "text/plain", strings.NewReader(update.body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, update.path)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		names  []string
+	}{
+		{"", http.StatusOK, []string{"Alloc", "PollCount", "Alloc"}},
+		{"?name=Alloc", http.StatusOK, []string{"Alloc", "Alloc"}},
+		{"?limit=1", http.StatusOK, []string{"Alloc"}},
+		{"?since=" + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10), http.StatusOK, nil},
+		{"?since=yesterday", http.StatusBadRequest, nil},
+		{"?limit=0", http.StatusBadRequest, nil},
+		{"?after=1", http.StatusOK, []string{"PollCount", "Alloc"}},
+		{"?after=-1", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(ts.URL + "/audit" + tt.query)
+		require.NoError(t, err)
+
+		var entries []audit.Entry
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+		}
+		resp.Body.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, tt.query)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+			assert.Equal(t, "127.0.0.1", e.Client)
+		}
+		assert.Equal(t, tt.names, names, tt.query)
+	}
+}
+
+func TestHandleUpdatesPublishEvents(t *testing.T) {
+	path := t.TempDir() + "/events.jsonl"
+	sink, err := events.NewFileSink(path)
+	require.NoError(t, err)
+
+	storage := storage.NewInMemoryStorage()
+	sugar := zap.NewNop().Sugar()
+	pub := events.NewPublisher(sugar, 10, sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	pub.Start(ctx)
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", handlers.HandleUpdateMetric(context.TODO(), sugar, storage, pub, false))
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage, pub, false))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, update := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/update/gauge/Alloc/1", "", http.StatusOK},
+		{"/update/gauge/Alloc/none", "", http.StatusBadRequest},
+		{"/updates", `[{"id":"Alloc","type":"gauge","value":2},{"id":"PollCount","type":"counter","delta":3}]`, http.StatusOK},
+		{"/updates", `[{"id":"Alloc","type":"gauge"}]`, http.StatusBadRequest},
+		{"/updates?mode=partial", `[{"id":"Frees","type":"gauge","value":4},{"id":"Alloc","type":"gauge"}]`, http.StatusOK},
+		{"/updates?mode=partial", `[{"id":"Mallocs","type":"gauge","value":5},{"id":`, http.StatusBadRequest},
+	} {
+		resp, err := http.Post(ts.URL+update.path, "text/plain", strings.NewReader(update.body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, update.status, resp.StatusCode, update.path+" "+update.body)
+	}
+
+	cancel()
+	pub.Wait()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var ids [][]string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e events.Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		assert.Equal(t, "127.0.0.1", e.Client)
+
+		var eventIDs []string
+		for _, metric := range e.Metrics {
+			eventIDs = append(eventIDs, metric.ID)
+		}
+		ids = append(ids, eventIDs)
+	}
+	assert.Equal(t, [][]string{{"Alloc"}, {"Alloc", "PollCount"}, {"Frees"}, {"Mallocs"}}, ids, "only successful requests emit events, with the applied metrics")
+}
+
+func TestHandleUpdatesPartialPublishesChunks(t *testing.T) {
+	path := t.TempDir() + "/events.jsonl"
+	sink, err := events.NewFileSink(path)
+	require.NoError(t, err)
+
+	sugar := zap.NewNop().Sugar()
+	pub := events.NewPublisher(sugar, 10, sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	pub.Start(ctx)
+
+	r := chi.NewRouter()
+	r.Post("/updates", handlers.HandleSaveMetrics(context.TODO(), sugar, storage.NewInMemoryStorage(), pub, false))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// one metric more than a chunk, so the batch is applied in two chunks
+	metrics := make([]string, 501)
+	for i := range metrics {
+		metrics[i] = `{"id":"m` + strconv.Itoa(i) + `","type":"gauge","value":1}`
+	}
+	resp, err := http.Post(ts.URL+"/updates?mode=partial", "application/json", strings.NewReader("["+strings.Join(metrics, ",")+"]"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+	pub.Wait()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var sizes []int
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e events.Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		sizes = append(sizes, len(e.Metrics))
+	}
+	assert.Equal(t, []int{500, 1}, sizes, "every applied chunk is published as its own event")
+}
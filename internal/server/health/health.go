@@ -0,0 +1,211 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// checkTimeout bounds every readiness check, a check that takes longer fails
+const checkTimeout = 2 * time.Second
+
+var (
+	// ErrNotRestored is reported until the storage has restored its saved metrics
+	ErrNotRestored = errors.New("restore has not finished")
+	// ErrDraining is reported once the server is shutting down
+	ErrDraining = errors.New("server is shutting down")
+)
+
+// CheckFunc reports whether a component is usable, ctx is done once the check timed out
+type CheckFunc func(ctx context.Context) error
+
+// check is a named readiness check
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker decides whether the server is ready for traffic: every component check must pass,
+// the storage must have restored its metrics and the server must not be shutting down;
+// it is safe for concurrent use
+type Checker struct {
+	checks   []check
+	restored atomic.Bool
+	draining atomic.Bool
+	mu       sync.RWMutex
+}
+
+// NewChecker creates a checker that is not ready until MarkRestored is called
+func NewChecker() *Checker {
+	c := &Checker{}
+	c.Add("restore", func(context.Context) error {
+		if !c.restored.Load() {
+			return ErrNotRestored
+		}
+		return nil
+	})
+	c.Add("shutdown", func(context.Context) error {
+		if c.draining.Load() {
+			return ErrDraining
+		}
+		return nil
+	})
+	return c
+}
+
+// Add registers a readiness check of a component
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// MarkRestored records that the storage has restored its saved metrics
+func (c *Checker) MarkRestored() {
+	c.restored.Store(true)
+}
+
+// Drain makes the server report that it is not ready anymore, so that no new traffic is sent to it
+func (c *Checker) Drain() {
+	if c != nil {
+		c.draining.Store(true)
+	}
+}
+
+// Pinger is implemented by storages that can check their connection cheaply
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// StorageCheck returns a check that store is reachable, storages that are not Pingers read their gauges,
+// which also catches a storage whose lock is stuck
+func StorageCheck(store models.GeneralStorageInterface) CheckFunc {
+	return func(ctx context.Context) error {
+		if pinger, ok := store.(Pinger); ok {
+			return pinger.PingContext(ctx)
+		}
+		_, err := store.GetValues(ctx, constants.MetricTypeGauge)
+		return err
+	}
+}
+
+// Result is the outcome of a single check
+type Result struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Check runs all checks concurrently and reports whether all of them passed, results are in registration order
+func (c *Checker) Check(ctx context.Context) (bool, []Result) {
+	c.mu.RLock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, ch := range checks {
+		wg.Add(1)
+		go func(i int, ch check) {
+			defer wg.Done()
+			results[i] = run(ctx, ch)
+		}(i, ch)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, result := range results {
+		ready = ready && result.OK
+	}
+	return ready, results
+}
+
+// run runs a single check, a check that ignores ctx is abandoned once ctx is done
+func run(ctx context.Context, ch check) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{Name: ch.name, OK: err == nil, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// response is the JSON body of the detail mode
+type response struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// HandleLive is an HTTP handler for liveness probes, it succeeds as long as the process serves requests;
+// with '?detail' the status is returned as JSON
+func HandleLive(sugar *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		write(w, r, sugar, true, []Result{})
+	}
+}
+
+// HandleReady is an HTTP handler for readiness probes, it responds with 503 Service Unavailable
+// if any check of c fails; with '?detail' every check is listed with its outcome and latency as JSON
+func HandleReady(sugar *zap.SugaredLogger, c *Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, results := c.Check(r.Context())
+		if !ready {
+			for _, result := range results {
+				if !result.OK {
+					sugar.Debugf("Readiness check %s failed: %s", result.Name, result.Error)
+				}
+			}
+		}
+		write(w, r, sugar, ready, results)
+	}
+}
+
+// write responds with the overall status, as plain text or as JSON in the detail mode
+func write(w http.ResponseWriter, r *http.Request, sugar *zap.SugaredLogger, ok bool, results []Result) {
+	status, text := http.StatusOK, "ok"
+	if !ok {
+		status, text = http.StatusServiceUnavailable, "unavailable"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !r.URL.Query().Has("detail") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if _, err := w.Write([]byte(text + "\n")); err != nil {
+			sugar.Errorw("Cannot write to response body", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", constants.ApplicationJSON)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response{Status: text, Checks: results}); err != nil {
+		sugar.Errorw("Cannot encode response JSON body", err)
+	}
+}
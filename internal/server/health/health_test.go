@@ -0,0 +1,95 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/storage"
+)
+
+func TestChecker(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(c *Checker)
+		ready    bool
+		failures []string
+	}{
+		{"before restore", func(c *Checker) {}, false, []string{"restore"}},
+		{"ready", func(c *Checker) { c.MarkRestored() }, true, nil},
+		{"draining", func(c *Checker) { c.MarkRestored(); c.Drain() }, false, []string{"shutdown"}},
+		{"failing component", func(c *Checker) {
+			c.MarkRestored()
+			c.Add("storage", func(context.Context) error { return errors.New("connection refused") })
+		}, false, []string{"storage"}},
+		{"stuck component", func(c *Checker) {
+			c.MarkRestored()
+			c.Add("storage", func(context.Context) error { select {} })
+		}, false, []string{"storage"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecker()
+			tt.setup(c)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			ready, results := c.Check(ctx)
+			assert.Equal(t, tt.ready, ready)
+
+			var failures []string
+			for _, result := range results {
+				if !result.OK {
+					failures = append(failures, result.Name)
+					assert.NotEmpty(t, result.Error)
+				}
+			}
+			assert.Equal(t, tt.failures, failures)
+		})
+	}
+}
+
+func TestStorageCheck(t *testing.T) {
+	assert.NoError(t, StorageCheck(storage.NewInMemoryStorage())(context.Background()))
+}
+
+func TestHandleReady(t *testing.T) {
+	sugar := zap.NewNop().Sugar()
+	c := NewChecker()
+	c.Add("storage", StorageCheck(storage.NewInMemoryStorage()))
+	c.MarkRestored()
+	handler := HandleReady(sugar, c)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok\n", w.Body.String())
+
+	c.Drain()
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/readyz?detail", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var resp response
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "unavailable", resp.Status)
+	require.Len(t, resp.Checks, 3)
+	for _, check := range resp.Checks {
+		assert.Equal(t, check.Name != "shutdown", check.OK, check.Name)
+		assert.GreaterOrEqual(t, check.LatencyMS, 0.0)
+	}
+
+	w = httptest.NewRecorder()
+	HandleLive(sugar)(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "a draining server is still alive")
+}
@@ -0,0 +1,33 @@
+package history
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Compactor is implemented by storages that keep metric history
+type Compactor interface {
+	// CompactHistory removes the history that is past the retention of its tier as of now
+	CompactHistory(ctx context.Context, now time.Time) error
+}
+
+// StartCompaction starts a goroutine that compacts the history of c every interval until ctx is done
+func StartCompaction(ctx context.Context, sugar *zap.SugaredLogger, c Compactor, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := c.CompactHistory(ctx, now); err != nil && ctx.Err() == nil {
+					sugar.Errorf("Error when compacting metric history: %v", err)
+				}
+			}
+		}
+	}()
+}
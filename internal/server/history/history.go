@@ -0,0 +1,149 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+// ErrDisabled is returned for history queries when no tiers are configured
+var ErrDisabled = errors.New("metric history is disabled")
+
+// Tier is a level of stored history: samples at Resolution, kept for Retention
+// a zero Resolution is the raw tier, which keeps every sample as it was written
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// Name returns 'raw' for the raw tier and the resolution otherwise, e.g. '1m0s'
+func (t Tier) Name() string {
+	if t.Resolution == 0 {
+		return "raw"
+	}
+	return t.Resolution.String()
+}
+
+// Bucket returns the start of the tier interval containing at, for the raw tier at itself
+func (t Tier) Bucket(at time.Time) time.Time {
+	if t.Resolution == 0 {
+		return at
+	}
+	return at.Truncate(t.Resolution)
+}
+
+// Tiers are the configured history tiers ordered from the finest resolution to the coarsest
+type Tiers []Tier
+
+// ParseTiers parses a comma separated list of 'resolution:retention' pairs, e.g. 'raw:1d,1m:30d,1h:365d'
+// the resolution is 'raw' or a duration, durations also accept a 'd' suffix for days;
+// every resolution may only appear once and an empty list disables history
+func ParseTiers(list string) (Tiers, error) {
+	var tiers Tiers
+	for _, entry := range utils.SplitList(list) {
+		resStr, retStr, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("history tier %q is not 'resolution:retention'", entry)
+		}
+
+		var tier Tier
+		if resStr != "raw" {
+			res, err := parseDuration(resStr)
+			if err != nil || res <= 0 {
+				return nil, fmt.Errorf("invalid resolution of history tier %q", entry)
+			}
+			tier.Resolution = res
+		}
+
+		ret, err := parseDuration(retStr)
+		if err != nil || ret <= 0 {
+			return nil, fmt.Errorf("invalid retention of history tier %q", entry)
+		}
+		tier.Retention = ret
+
+		tiers = append(tiers, tier)
+	}
+
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Resolution < tiers[j].Resolution })
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].Resolution == tiers[i-1].Resolution {
+			return nil, fmt.Errorf("history tier %s is configured twice", tiers[i].Name())
+		}
+	}
+
+	return tiers, nil
+}
+
+// parseDuration parses a duration as time.ParseDuration does, additionally accepting whole days like '30d'
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := utils.ParseInt(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Pick returns the finest tier that still holds the history starting at from,
+// or the tier with the longest retention if none reaches back that far
+func (t Tiers) Pick(now, from time.Time) (Tier, bool) {
+	if len(t) == 0 {
+		return Tier{}, false
+	}
+
+	longest := t[0]
+	for _, tier := range t {
+		if !from.Before(now.Add(-tier.Retention)) {
+			return tier, true
+		}
+		if tier.Retention > longest.Retention {
+			longest = tier
+		}
+	}
+	return longest, true
+}
+
+// Point is a sample of the raw tier or the aggregate of all samples in an interval of a rollup tier
+type Point struct {
+	Time  time.Time `json:"time"`  // time of the sample, or start of the interval
+	Min   float64   `json:"min"`   // smallest sample
+	Max   float64   `json:"max"`   // largest sample
+	Avg   float64   `json:"avg"`   // mean of the samples, filled in by queries
+	Last  float64   `json:"last"`  // latest sample
+	Sum   float64   `json:"-"`     // sum of the samples, Avg is derived from it
+	Count int64     `json:"count"` // number of samples
+}
+
+// NewPoint returns the point of a single sample
+func NewPoint(at time.Time, value float64) Point {
+	return Point{Time: at, Min: value, Max: value, Sum: value, Last: value, Count: 1}
+}
+
+// Add folds a later sample into the point
+func (p *Point) Add(value float64) {
+	if value < p.Min {
+		p.Min = value
+	}
+	if value > p.Max {
+		p.Max = value
+	}
+	p.Sum += value
+	p.Last = value
+	p.Count++
+}
+
+// WithAvg returns the points with Avg computed from Sum and Count
+func WithAvg(points []Point) []Point {
+	for i := range points {
+		if points[i].Count > 0 {
+			points[i].Avg = points[i].Sum / float64(points[i].Count)
+		}
+	}
+	return points
+}
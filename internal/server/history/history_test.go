@@ -0,0 +1,94 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := ParseTiers("1h:365d, raw:1d,1m:30d")
+	require.NoError(t, err)
+	assert.Equal(t, Tiers{
+		{Resolution: 0, Retention: 24 * time.Hour},
+		{Resolution: time.Minute, Retention: 30 * 24 * time.Hour},
+		{Resolution: time.Hour, Retention: 365 * 24 * time.Hour},
+	}, tiers)
+
+	tiers, err = ParseTiers("")
+	require.NoError(t, err)
+	assert.Empty(t, tiers)
+
+	for _, invalid := range []string{"raw", "raw:0s", "fast:1d", "-1m:1d", "1m:1d,60s:2d", "raw:xd"} {
+		_, err := ParseTiers(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPick(t *testing.T) {
+	tiers, err := ParseTiers("raw:1d,1m:30d,1h:365d")
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		from time.Duration
+		want string
+	}{
+		{time.Hour, "raw"},
+		{24 * time.Hour, "raw"},
+		{7 * 24 * time.Hour, "1m0s"},
+		{90 * 24 * time.Hour, "1h0m0s"},
+		{1000 * 24 * time.Hour, "1h0m0s"},
+	}
+	for _, tt := range tests {
+		tier, ok := tiers.Pick(now, now.Add(-tt.from))
+		require.True(t, ok)
+		assert.Equal(t, tt.want, tier.Name(), "from now-%s", tt.from)
+	}
+
+	_, ok := Tiers(nil).Pick(now, now)
+	assert.False(t, ok)
+}
+
+func TestMemoryRecordQueryCompact(t *testing.T) {
+	tiers, err := ParseTiers("raw:10m,1m:1h")
+	require.NoError(t, err)
+	m := NewMemory(tiers)
+
+	t0 := time.Unix(1700000000, 0).Truncate(time.Minute)
+	for i, v := range []float64{5, 1, 3, 10} {
+		m.Record("gauge", "Load", t0.Add(time.Duration(i)*20*time.Second), v)
+	}
+	// a late sample is still folded into its minute
+	m.Record("gauge", "Load", t0.Add(10*time.Second), 2)
+
+	now := t0.Add(2 * time.Minute)
+	tier, points, err := m.Query("gauge", "Load", t0, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, "raw", tier.Name())
+	assert.Len(t, points, 5)
+	assert.Equal(t, 2.0, points[1].Last, "raw points are kept in time order")
+
+	tier, points, err = m.Query("gauge", "Load", now.Add(-30*time.Minute), now, now)
+	require.NoError(t, err)
+	assert.Equal(t, "1m0s", tier.Name())
+	require.Len(t, points, 2)
+	assert.Equal(t, Point{Time: t0, Min: 1, Max: 5, Avg: 11.0 / 4, Last: 2, Sum: 11, Count: 4}, points[0])
+	assert.Equal(t, Point{Time: t0.Add(time.Minute), Min: 10, Max: 10, Avg: 10, Last: 10, Sum: 10, Count: 1}, points[1])
+
+	m.Compact(t0.Add(30 * time.Minute))
+	_, points, err = m.Query("gauge", "Load", t0, now, t0.Add(5*time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, points, "raw points past their retention are removed")
+	_, points, err = m.Query("gauge", "Load", t0, now, t0.Add(30*time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, points, 2, "rollups are kept longer")
+
+	m.Compact(t0.Add(2 * time.Hour))
+	assert.Empty(t, m.series)
+
+	_, _, err = NewMemory(nil).Query("gauge", "Load", t0, now, now)
+	assert.ErrorIs(t, err, ErrDisabled)
+}
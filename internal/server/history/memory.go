@@ -0,0 +1,122 @@
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// seriesKey identifies the history of a single metric
+type seriesKey struct {
+	mtype string
+	name  string
+}
+
+// Memory keeps the history of metrics in memory, one time ordered slice of points per tier and metric
+// rollup points are updated as samples are recorded, so compaction only has to drop expired points;
+// it is safe for concurrent use
+type Memory struct {
+	tiers  Tiers
+	series map[seriesKey][][]Point // points per tier, in the order of tiers
+	mu     sync.Mutex
+}
+
+// NewMemory creates an empty in-memory history with the given tiers
+func NewMemory(tiers Tiers) *Memory {
+	return &Memory{
+		tiers:  tiers,
+		series: make(map[seriesKey][][]Point),
+	}
+}
+
+// Record adds a sample of a metric taken at 'at' to every tier
+func (m *Memory) Record(mtype, name string, at time.Time, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := seriesKey{mtype: mtype, name: name}
+	tiers, ok := m.series[key]
+	if !ok {
+		tiers = make([][]Point, len(m.tiers))
+		m.series[key] = tiers
+	}
+
+	for i, tier := range m.tiers {
+		tiers[i] = record(tiers[i], tier.Bucket(at), value)
+	}
+}
+
+// record folds a sample into the point of its bucket, keeping points in time order
+// samples normally arrive in order, so the search starts at the newest point
+func record(points []Point, bucket time.Time, value float64) []Point {
+	i := len(points)
+	for i > 0 && points[i-1].Time.After(bucket) {
+		i--
+	}
+
+	if i > 0 && points[i-1].Time.Equal(bucket) {
+		points[i-1].Add(value)
+		return points
+	}
+
+	points = append(points, Point{})
+	copy(points[i+1:], points[i:])
+	points[i] = NewPoint(bucket, value)
+	return points
+}
+
+// Query returns the points of a metric between from and to inclusive from the tier picked for from
+func (m *Memory) Query(mtype, name string, from, to, now time.Time) (Tier, []Point, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tier, ok := m.tiers.Pick(now, from)
+	if !ok {
+		return Tier{}, nil, ErrDisabled
+	}
+
+	index := 0
+	for i := range m.tiers {
+		if m.tiers[i] == tier {
+			index = i
+		}
+	}
+
+	points := m.series[seriesKey{mtype: mtype, name: name}]
+	if points == nil {
+		return tier, nil, nil
+	}
+
+	all := points[index]
+	start := sort.Search(len(all), func(i int) bool { return !all[i].Time.Before(tier.Bucket(from)) })
+	end := sort.Search(len(all), func(i int) bool { return all[i].Time.After(to) })
+	if start >= end {
+		return tier, nil, nil
+	}
+
+	return tier, WithAvg(append([]Point(nil), all[start:end]...)), nil
+}
+
+// Compact removes the points that are past the retention of their tier and forgets metrics without points
+func (m *Memory) Compact(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, tiers := range m.series {
+		empty := true
+		for i, tier := range m.tiers {
+			cutoff := now.Add(-tier.Retention)
+			points := tiers[i]
+			expired := sort.Search(len(points), func(j int) bool { return !points[j].Time.Before(cutoff) })
+			if expired > 0 {
+				tiers[i] = append([]Point(nil), points[expired:]...)
+			}
+			if len(tiers[i]) > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			delete(m.series, key)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package limits
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
+)
+
+// sweepInterval is how often buckets that have refilled completely are forgotten
+const sweepInterval = time.Minute
+
+// bucket is the token bucket of a single client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter limits the request rate of every client with a token bucket,
+// buckets hold up to burst tokens and refill at rate tokens per second;
+// it is safe for concurrent use
+type Limiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+	rejected  atomic.Int64
+	mu        sync.Mutex
+}
+
+// NewLimiter creates a limiter allowing rate requests per second per client with bursts of up to burst requests
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of a client and reports whether there was one,
+// if not it also returns how long it takes until the next token is available
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	l.rejected.Add(1)
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// refill returns the tokens in b at now
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// sweep forgets the buckets that are full again, a new bucket starts full anyway;
+// the caller must hold the lock
+func (l *Limiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Rejected returns the number of requests rejected so far
+func (l *Limiter) Rejected() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.rejected.Load()
+}
+
+// ClientKey identifies the client of a request by its authenticated tenant, or by its IP address without one,
+// so that made-up tokens cannot open new buckets; proxy headers are not trusted, so clients behind a shared proxy
+// share a bucket
+func ClientKey(r *http.Request) string {
+	if name := tenant.FromContext(r.Context()); name != "" {
+		return "tenant:" + name
+	}
+
+	return "ip:" + utils.RemoteIP(r)
+}
+
+// WithRateLimit is a middleware that rejects requests of clients that exceed their rate, it must run
+// after authentication to limit tenants rather than addresses,
+// with 429 Too Many Requests and a Retry-After header in whole seconds
+func WithRateLimit(sugar *zap.SugaredLogger, l *Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := l.Allow(ClientKey(r))
+			if !ok {
+				sugar.Debugf("Rate limited request to %s from %s", r.URL.Path, r.RemoteAddr)
+				w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package limits
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	l := NewLimiter(2, 3)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		require.True(t, ok, "request %d of the burst", i)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = l.Allow("b")
+	assert.True(t, ok, "clients have separate buckets")
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok, "a token is added every half second")
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), l.Rejected())
+
+	now = now.Add(time.Hour)
+	ok, _ = l.Allow("c")
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1, "full buckets are forgotten")
+}
+
+func TestClientKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("Authorization", "Bearer unknown")
+	assert.Equal(t, "ip:10.0.0.1", ClientKey(req), "unauthenticated requests are keyed by their address")
+
+	req = req.WithContext(tenant.NewContext(req.Context(), "team"))
+	assert.Equal(t, "tenant:team", ClientKey(req))
+}
+
+func TestRateLimitAfterAuth(t *testing.T) {
+	sugar := zap.NewNop().Sugar()
+	rateLimit := WithRateLimit(sugar, NewLimiter(0.5, 1))
+	handler := tenant.WithAuth(sugar, tenant.Tokens{tenant.Hash("secret"): "team"}, rateLimit)(
+		rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	send := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("random-1"))
+	assert.Equal(t, http.StatusTooManyRequests, send("random-2"), "made-up tokens share the bucket of their address")
+	assert.Equal(t, http.StatusOK, send("secret"), "the tenant has its own bucket")
+	assert.Equal(t, http.StatusTooManyRequests, send("secret"))
+}
+
+func TestWithRateLimit(t *testing.T) {
+	l := NewLimiter(0.5, 1)
+	handler := WithRateLimit(zap.NewNop().Sugar(), l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+}
+
+func TestQuota(t *testing.T) {
+	q := NewQuota(3)
+	assert.NoError(t, q.Check("team", 1, 2))
+	assert.NoError(t, q.Check("team", 5, 0), "stored metrics can always be updated")
+
+	err := q.Check("team", 2, 2)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.Equal(t, int64(1), q.Rejected())
+
+	assert.NoError(t, NewQuota(0).Check("team", 100, 100))
+	var disabled *Quota
+	assert.False(t, disabled.Enabled())
+	assert.NoError(t, disabled.Check("team", 100, 100))
+}
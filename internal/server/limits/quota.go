@@ -0,0 +1,78 @@
+package limits
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+)
+
+// ErrQuotaExceeded is returned by storages for updates that would create more metrics than the quota of a tenant allows
+var ErrQuotaExceeded = errors.New("metric quota exceeded")
+
+// Quota caps the number of distinct metrics of every tenant, a metric being a name of a type;
+// updates of stored metrics are always accepted, so lowering the cap does not lock tenants out
+type Quota struct {
+	max      int
+	rejected atomic.Int64
+}
+
+// NewQuota creates a quota of max metrics per tenant, max <= 0 is unlimited
+func NewQuota(max int) *Quota {
+	return &Quota{max: max}
+}
+
+// Enabled reports whether the quota limits anything
+func (q *Quota) Enabled() bool {
+	return q != nil && q.max > 0
+}
+
+// Check returns ErrQuotaExceeded if a tenant with stored metrics may not add added new ones
+func (q *Quota) Check(tenant string, stored, added int) error {
+	if !q.Enabled() || added == 0 || stored+added <= q.max {
+		return nil
+	}
+
+	q.rejected.Add(1)
+	if tenant == "" {
+		tenant = "default"
+	}
+	return fmt.Errorf("%w: tenant %s has %d metrics and cannot add %d more, at most %d are allowed", ErrQuotaExceeded, tenant, stored, added, q.max)
+}
+
+// Rejected returns the number of updates rejected so far
+func (q *Quota) Rejected() int64 {
+	if q == nil {
+		return 0
+	}
+	return q.rejected.Load()
+}
+
+// QuotaSetter is implemented by storages that enforce a metric quota
+type QuotaSetter interface {
+	// SetQuota makes the storage reject updates that exceed q
+	SetQuota(q *Quota)
+}
+
+// statsResponse is the JSON body returned by HandleStats
+type statsResponse struct {
+	RateLimited   int64 `json:"rate_limited"`   // requests rejected by the rate limiter
+	QuotaExceeded int64 `json:"quota_exceeded"` // updates rejected by the metric quota
+}
+
+// HandleStats is an HTTP handler that returns how many requests and updates were rejected, either may be nil
+func HandleStats(sugar *zap.SugaredLogger, l *Limiter, q *Quota) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", constants.ApplicationJSON)
+		w.WriteHeader(http.StatusOK)
+		resp := statsResponse{RateLimited: l.Rejected(), QuotaExceeded: q.Rejected()}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			sugar.Errorw("Cannot encode response JSON body", err)
+		}
+	}
+}
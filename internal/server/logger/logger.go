@@ -2,8 +2,6 @@ package logger
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -12,7 +10,6 @@ import (
 
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
-	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -42,40 +39,49 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode
 }
 
+// bodyCapture wraps a request body and keeps a copy of at most limit bytes
+// as the handler reads it, so the body can be logged without reading it twice
+type bodyCapture struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Read reads from the original body and copies the head of the data into the buffer
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+
+	if room := c.limit - c.buf.Len(); n > room {
+		c.buf.Write(p[:room])
+		c.truncated = true
+	} else {
+		c.buf.Write(p[:n])
+	}
+
+	return n, err
+}
+
+// String returns the captured part of the body, marking it if the body was longer
+func (c *bodyCapture) String() string {
+	if c.truncated {
+		return c.buf.String() + "...(truncated)"
+	}
+	return c.buf.String()
+}
+
 // WithLogging returns an HTTP handler that adds logging
-func WithLogging(sugar *zap.SugaredLogger) func(http.Handler) http.Handler {
+// up to bodyLimit bytes of JSON request bodies are logged as they are consumed by the handler,
+// a bodyLimit of 0 disables body logging
+func WithLogging(sugar *zap.SugaredLogger, bodyLimit int) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 
-			var formattedBody []byte
-			if r.Header.Get("Content-Type") == constants.ApplicationJSON {
-				bodyBytes, err := io.ReadAll(r.Body)
-				if err != nil {
-					sugar.Errorw("Cannot read request body", "err", err)
-				}
-
-				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-
-				var raw json.RawMessage
-				if err = json.Unmarshal(bodyBytes, &raw); err != nil {
-					sugar.Errorw("Cannot unmarshal request body", "err", err)
-				}
-
-				var singleMetric models.Metrics
-				var sliceMetrics []models.Metrics
-
-				if err = json.Unmarshal(raw, &singleMetric); err == nil {
-					formattedBody, err = json.Marshal(singleMetric)
-				} else if err = json.Unmarshal(raw, &sliceMetrics); err == nil {
-					formattedBody, err = json.Marshal(sliceMetrics)
-				} else {
-					sugar.Errorw("Unknown type of metrics", "type", fmt.Sprintf("%T", raw))
-				}
-
-				if err != nil {
-					sugar.Errorw("Cannot marshal request body", "err", err)
-				}
+			var capture *bodyCapture
+			if bodyLimit > 0 && r.Header.Get("Content-Type") == constants.ApplicationJSON {
+				capture = &bodyCapture{ReadCloser: r.Body, limit: bodyLimit}
+				r.Body = capture
 			}
 
 			responseData := &responseData{
@@ -90,15 +96,19 @@ func WithLogging(sugar *zap.SugaredLogger) func(http.Handler) http.Handler {
 
 			duration := time.Since(start)
 
-			sugar.Infow("HTTP request info",
+			fields := []interface{}{
 				"timestamp", start.Format("2006-01-02 15:04:05"),
 				"uri", r.RequestURI,
 				"method", r.Method,
 				"status", responseData.status,
 				"duration", duration,
 				"size", responseData.size,
-				"body", string(formattedBody),
-			)
+			}
+			if capture != nil {
+				fields = append(fields, "body", capture.String())
+			}
+
+			sugar.Infow("HTTP request info", fields...)
 		})
 	}
 }
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWithLogging(t *testing.T) {
+	body := `[{"id":"g","type":"gauge","value":1.5}]`
+
+	testCases := []struct {
+		name         string
+		bodyLimit    int
+		contentType  string
+		expectedBody interface{}
+	}{
+		{"Full body", 1024, "application/json", body},
+		{"Truncated body", 10, "application/json", body[:10] + "...(truncated)"},
+		{"Body logging disabled", 0, "application/json", nil},
+		{"Non-JSON body", 1024, "text/plain", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			sugar := zap.New(core).Sugar()
+
+			var handlerBody string
+			handler := WithLogging(sugar, tc.bodyLimit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				handlerBody = string(b)
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+			req.Header.Set("Content-Type", tc.contentType)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, body, handlerBody)
+
+			entries := logs.FilterMessage("HTTP request info").All()
+			require.Len(t, entries, 1)
+
+			logged, ok := entries[0].ContextMap()["body"]
+			if tc.expectedBody == nil {
+				assert.False(t, ok)
+				return
+			}
+			assert.Equal(t, tc.expectedBody, logged)
+		})
+	}
+}
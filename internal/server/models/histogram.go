@@ -0,0 +1,154 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Histogram is a distribution of observed values over fixed buckets
+// Buckets[i] counts the observations v with Bounds[i-1] < v <= Bounds[i], the last bucket counts
+// the observations above the highest bound, so there is always one bucket more than there are bounds
+type Histogram struct {
+	Bounds  []float64 `json:"bounds"`
+	Buckets []int64   `json:"buckets"`
+	Sum     float64   `json:"sum"`
+	Count   int64     `json:"count"`
+}
+
+// NewHistogram creates an empty histogram with the given ascending upper bucket bounds
+func NewHistogram(bounds []float64) Histogram {
+	return Histogram{
+		Bounds:  append([]float64(nil), bounds...),
+		Buckets: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds a single value to the histogram
+func (h *Histogram) Observe(value float64) {
+	i := 0
+	for i < len(h.Bounds) && value > h.Bounds[i] {
+		i++
+	}
+
+	h.Buckets[i]++
+	h.Sum += value
+	h.Count++
+}
+
+// Validate checks that the bounds are finite and strictly ascending, that there is a bucket
+// for every bound plus one, and that Count is the total of the buckets
+func (h Histogram) Validate() error {
+	for i, bound := range h.Bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("histogram bound %d is not finite", i)
+		}
+		if i > 0 && bound <= h.Bounds[i-1] {
+			return errors.New("histogram bounds are not strictly ascending")
+		}
+	}
+
+	if len(h.Buckets) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram has %d buckets for %d bounds, expected %d", len(h.Buckets), len(h.Bounds), len(h.Bounds)+1)
+	}
+
+	var total int64
+	for _, n := range h.Buckets {
+		if n < 0 {
+			return errors.New("histogram bucket counts must not be negative")
+		}
+		total += n
+	}
+	if total != h.Count {
+		return fmt.Errorf("histogram count %d does not match the bucket total %d", h.Count, total)
+	}
+
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return errors.New("histogram sum is not finite")
+	}
+
+	return nil
+}
+
+// SameBounds reports whether h and other use the same buckets
+func (h Histogram) SameBounds(other Histogram) bool {
+	if len(h.Bounds) != len(other.Bounds) {
+		return false
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns the sum of h and other
+// histograms with different bounds cannot be combined, in that case the bucket layout has changed
+// and other replaces h entirely; merging into an empty Histogram{} returns a copy of other
+func (h Histogram) Merge(other Histogram) Histogram {
+	if !h.SameBounds(other) || len(h.Buckets) != len(other.Buckets) {
+		return other.Clone()
+	}
+
+	merged := h.Clone()
+	for i, n := range other.Buckets {
+		merged.Buckets[i] += n
+	}
+	merged.Sum += other.Sum
+	merged.Count += other.Count
+
+	return merged
+}
+
+// Clone returns a deep copy of h
+func (h Histogram) Clone() Histogram {
+	return Histogram{
+		Bounds:  append([]float64(nil), h.Bounds...),
+		Buckets: append([]int64(nil), h.Buckets...),
+		Sum:     h.Sum,
+		Count:   h.Count,
+	}
+}
+
+// String formats the histogram as 'count=N sum=S le=B:n ...', the last bucket is labelled +Inf
+func (h Histogram) String() string {
+	var result strings.Builder
+	fmt.Fprintf(&result, "count=%d sum=%f", h.Count, h.Sum)
+
+	for i, n := range h.Buckets {
+		bound := "+Inf"
+		if i < len(h.Bounds) {
+			bound = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(&result, " le=%s:%d", bound, n)
+	}
+
+	return result.String()
+}
+
+// ParseBounds parses a comma separated list of ascending histogram bucket bounds, e.g. '0.1,0.5,1'
+func ParseBounds(list string) ([]float64, error) {
+	var bounds []float64
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		bound, err := strconv.ParseFloat(entry, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram bound %q: %w", entry, err)
+		}
+		bounds = append(bounds, bound)
+	}
+
+	h := NewHistogram(bounds)
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+
+	return bounds, nil
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramObserveAndMerge(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+	assert.Equal(t, []int64{2, 1, 1}, h.Buckets)
+	assert.Equal(t, int64(4), h.Count)
+	assert.InDelta(t, 3.65, h.Sum, 1e-9)
+	require.NoError(t, h.Validate())
+
+	merged := h.Merge(h)
+	assert.Equal(t, []int64{4, 2, 2}, merged.Buckets)
+	assert.Equal(t, int64(8), merged.Count)
+	assert.Equal(t, []int64{2, 1, 1}, h.Buckets, "merge must not modify its operands")
+
+	other := NewHistogram([]float64{5})
+	other.Observe(1)
+	assert.Equal(t, other, h.Merge(other), "different bounds replace the histogram")
+	assert.Equal(t, h, Histogram{}.Merge(h))
+
+	assert.Equal(t, "count=4 sum=3.650000 le=0.1:2 le=1:1 le=+Inf:1", h.String())
+}
+
+func TestHistogramValidate(t *testing.T) {
+	testCases := []struct {
+		name string
+		h    Histogram
+	}{
+		{name: "unsorted bounds", h: Histogram{Bounds: []float64{1, 0.5}, Buckets: []int64{0, 0, 0}}},
+		{name: "missing bucket", h: Histogram{Bounds: []float64{1}, Buckets: []int64{1}, Count: 1}},
+		{name: "negative bucket", h: Histogram{Buckets: []int64{-1}, Count: -1}},
+		{name: "count mismatch", h: Histogram{Bounds: []float64{1}, Buckets: []int64{1, 1}, Count: 3}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Error(t, tc.h.Validate())
+		})
+	}
+}
+
+func TestHistogramMetric(t *testing.T) {
+	h := NewHistogram([]float64{1})
+	h.Observe(2)
+
+	m := NewHistogramMetric("Latency", h)
+	require.NoError(t, m.Validate())
+	assert.Equal(t, h, m.Histogram())
+
+	m.Sum = nil
+	assert.Error(t, m.Validate())
+}
+
+func TestParseBounds(t *testing.T) {
+	bounds, err := ParseBounds(" 0.1, 0.5,1 ,")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.1, 0.5, 1}, bounds)
+
+	_, err = ParseBounds("1,abc")
+	assert.Error(t, err)
+	_, err = ParseBounds("1,0.5")
+	assert.Error(t, err)
+}
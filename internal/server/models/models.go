@@ -2,15 +2,150 @@ package models
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 )
 
 type Metrics struct {
-	Value *float64 `json:"value,omitempty"` // metric value when type is 'gauge'
-	Delta *int64   `json:"delta,omitempty"` // metric value when type is 'counter'
-	ID    string   `json:"id"`              // metric name
-	MType string   `json:"type"`            // parameter that takes the value 'gauge' or 'counter'
+	Value   *float64       `json:"value,omitempty"`   // metric value when type is 'gauge'
+	Delta   *int64         `json:"delta,omitempty"`   // metric value when type is 'counter'
+	Sum     *float64       `json:"sum,omitempty"`     // sum of the observed values when type is 'histogram'
+	Count   *int64         `json:"count,omitempty"`   // number of observed values when type is 'histogram'
+	Sketch  *sketch.Sketch `json:"sketch,omitempty"`  // quantile sketch of the observed values when type is 'summary'
+	ID      string         `json:"id"`                // metric name
+	MType   string         `json:"type"`              // parameter that takes the value 'gauge', 'counter', 'histogram', 'summary' or 'set'
+	Bounds  []float64      `json:"bounds,omitempty"`  // ascending upper bucket bounds when type is 'histogram'
+	Buckets []int64        `json:"buckets,omitempty"` // per bucket counts when type is 'histogram', one more than there are bounds
+	Members []string       `json:"members,omitempty"` // members added to the set when type is 'set'
+	Unique  *int64         `json:"unique,omitempty"`  // estimated number of distinct members of a 'set' in responses
+	Rate    *float64       `json:"rate,omitempty"`    // per-second increase of a 'counter' in responses when a rate window is requested
+
+	// Registers are HyperLogLog registers merged into the set when type is 'set', agents send them
+	// instead of members so that a set has a fixed size; they are accepted in batches only
+	Registers []byte `json:"registers,omitempty"`
+}
+
+// NewHistogramMetric returns a histogram metric carrying a copy of h
+func NewHistogramMetric(name string, h Histogram) Metrics {
+	h = h.Clone()
+	return Metrics{ID: name, MType: constants.MetricTypeHistogram, Bounds: h.Bounds, Buckets: h.Buckets, Sum: &h.Sum, Count: &h.Count}
+}
+
+// NewSummaryMetric returns a summary metric carrying a copy of s
+func NewSummaryMetric(name string, s sketch.Sketch) Metrics {
+	s = s.Clone()
+	return Metrics{ID: name, MType: constants.MetricTypeSummary, Sketch: &s}
+}
+
+// Set returns the sketch of a set metric, its registers with its members added
+func (m Metrics) Set() hll.Sketch {
+	set := hll.Sketch{Registers: m.Registers}.Clone()
+	for _, member := range m.Members {
+		set.Add(member)
+	}
+	return set
+}
+
+// Histogram returns the histogram fields of a histogram metric, missing fields are left zero
+func (m Metrics) Histogram() Histogram {
+	h := Histogram{Bounds: m.Bounds, Buckets: m.Buckets}
+	if m.Sum != nil {
+		h.Sum = *m.Sum
+	}
+	if m.Count != nil {
+		h.Count = *m.Count
+	}
+	return h.Clone()
+}
+
+// Validate checks that the metric has a name, a known type and the field required by that type
+func (m Metrics) Validate() error {
+	if m.ID == "" {
+		return errors.New("metric id is empty")
+	}
+
+	switch m.MType {
+	case constants.MetricTypeGauge:
+		if m.Value == nil {
+			return fmt.Errorf("value not provided for gauge: %s", m.ID)
+		}
+	case constants.MetricTypeCounter:
+		if m.Delta == nil {
+			return fmt.Errorf("delta not provided for counter: %s", m.ID)
+		}
+	case constants.MetricTypeHistogram:
+		if m.Sum == nil || m.Count == nil || m.Buckets == nil {
+			return fmt.Errorf("buckets, sum and count are required for histogram: %s", m.ID)
+		}
+		if err := m.Histogram().Validate(); err != nil {
+			return fmt.Errorf("invalid histogram %s: %w", m.ID, err)
+		}
+	case constants.MetricTypeSummary:
+		if m.Sketch == nil {
+			return fmt.Errorf("sketch not provided for summary: %s", m.ID)
+		}
+		if err := m.Sketch.Validate(); err != nil {
+			return fmt.Errorf("invalid summary %s: %w", m.ID, err)
+		}
+	case constants.MetricTypeSet:
+		if len(m.Members) == 0 && len(m.Registers) == 0 {
+			return fmt.Errorf("members not provided for set: %s", m.ID)
+		}
+		if len(m.Registers) > 0 {
+			if err := (hll.Sketch{Registers: m.Registers}).Validate(); err != nil {
+				return fmt.Errorf("invalid set %s: %w", m.ID, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown metric type: %s", m.MType)
+	}
+
+	return nil
+}
+
+const (
+	ItemAccepted = "accepted"
+	ItemRejected = "rejected"
+)
+
+// ItemResult describes the outcome for a single element of a batch update
+type ItemResult struct {
+	ID     string `json:"id,omitempty"`    // metric name, if it could be decoded
+	MType  string `json:"type,omitempty"`  // metric type, if it could be decoded
+	Status string `json:"status"`          // 'accepted' or 'rejected'
+	Error  string `json:"error,omitempty"` // reason the element was rejected
+	Index  int    `json:"index"`           // position of the element in the request array
+}
+
+// BatchReport is the per-item report returned for batch updates
+type BatchReport struct {
+	Error    string       `json:"error,omitempty"` // set when the batch could not be read to the end
+	Items    []ItemResult `json:"items"`
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
 }
 
+// Accept records that the element at index was applied
+func (r *BatchReport) Accept(index int, m Metrics) {
+	r.Accepted++
+	r.Items = append(r.Items, ItemResult{Index: index, ID: m.ID, MType: m.MType, Status: ItemAccepted})
+}
+
+// Reject records that the element at index was not applied and why
+func (r *BatchReport) Reject(index int, m Metrics, err error) {
+	r.Rejected++
+	r.Items = append(r.Items, ItemResult{Index: index, ID: m.ID, MType: m.MType, Status: ItemRejected, Error: err.Error()})
+}
+
+// ErrNotFound is returned by storages for metrics that are not stored
+var ErrNotFound = errors.New("metric not found")
+
 type GeneralStorageInterface interface {
 	// UpdateGauge sets a new value for a gauge metric identified by its name
 	// the function returns an error if the operation fails
@@ -22,17 +157,63 @@ type GeneralStorageInterface interface {
 	// if 'shouldNotify' is true, an update notification is triggered
 	UpdateCounter(ctx context.Context, name string, value int64, shouldNotify bool) error
 
+	// UpdateHistogram merges the observations in h into a histogram metric identified by its name
+	// a histogram with different bounds than the stored one replaces it
+	// the function returns an error if the operation fails
+	// if 'shouldNotify' is true, an update notification is triggered
+	UpdateHistogram(ctx context.Context, name string, h Histogram, shouldNotify bool) error
+
+	// UpdateSummary merges the values in s into a summary metric identified by its name
+	// a sketch with a different accuracy than the stored one replaces it
+	// the function returns an error if the operation fails
+	// if 'shouldNotify' is true, an update notification is triggered
+	UpdateSummary(ctx context.Context, name string, s sketch.Sketch, shouldNotify bool) error
+
+	// UpdateSet adds members to a set metric identified by its name, only their estimated number is kept
+	// the function returns an error if the operation fails
+	// if 'shouldNotify' is true, an update notification is triggered
+	UpdateSet(ctx context.Context, name string, members []string, shouldNotify bool) error
+
 	// GetGauge fetches the current value of a gauge metric by its name
-	// returns the fetched value along with an error if the operation fails
+	// returns the fetched value along with an error wrapping ErrNotFound if it is not stored, or if the operation fails
 	GetGauge(ctx context.Context, name string) (float64, error)
 
 	// GetCounter fetches the current value of a counter metric by its name
-	// returns the fetched value along with an error if the operation fails
+	// returns the fetched value along with an error wrapping ErrNotFound if it is not stored, or if the operation fails
 	GetCounter(ctx context.Context, name string) (int64, error)
 
+	// GetHistogram fetches the current state of a histogram metric by its name
+	// returns the fetched histogram along with an error wrapping ErrNotFound if it is not stored, or if the operation fails
+	GetHistogram(ctx context.Context, name string) (Histogram, error)
+
+	// GetSummary fetches the current sketch of a summary metric by its name
+	// returns the fetched sketch along with an error wrapping ErrNotFound if it is not stored, or if the operation fails
+	GetSummary(ctx context.Context, name string) (sketch.Sketch, error)
+
+	// GetSet fetches the current sketch of a set metric by its name
+	// returns the fetched sketch along with an error wrapping ErrNotFound if it is not stored, or if the operation fails
+	GetSet(ctx context.Context, name string) (hll.Sketch, error)
+
+	// GetValues fetches the current values of all gauges, or the totals of all counters, keyed by name
+	// returns the values along with an error if the type is neither 'gauge' nor 'counter' or the operation fails
+	GetValues(ctx context.Context, mtype string) (map[string]float64, error)
+
+	// GetCounterRate computes the per-second increase of a counter metric over the window ending now
+	// from the recent totals kept for it, see CounterRate
+	// returns the rate along with an error wrapping ErrNotFound if the counter is unknown, ErrNoRate if its totals
+	// do not span any time yet, or an error if the operation fails
+	GetCounterRate(ctx context.Context, name string, window time.Duration) (float64, error)
+
+	// GetHistory fetches the recorded values of a gauge or the totals of a counter between from and to
+	// from the finest history tier that still reaches back to from
+	// returns the tier and its points along with an error if history is disabled or the operation fails
+	GetHistory(ctx context.Context, mtype, name string, from, to time.Time) (history.Tier, []history.Point, error)
+
 	// String returns a stringified representation of the metrics stored
 	// this is primarily useful for debugging or logging purposes
 	String(ctx context.Context) string
 
+	// SaveMetrics applies a batch of metrics atomically
+	// if any metric in the batch is invalid nothing is applied and an error is returned
 	SaveMetrics(ctx context.Context, metrics []Metrics, shouldNotify bool) error
 }
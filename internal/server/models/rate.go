@@ -0,0 +1,67 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultRatePoints is the number of points kept per counter when none is configured
+const DefaultRatePoints = 120
+
+// ErrNoRate is returned for a counter whose points do not span any time yet
+var ErrNoRate = errors.New("not enough counter history for a rate")
+
+// CounterPoint is the total of a counter right after an update
+type CounterPoint struct {
+	Time  time.Time `json:"time"`
+	Total int64     `json:"total"`
+}
+
+// AppendPoint adds p to the points of a counter and keeps at most keep of the newest ones,
+// a point recorded at the same time as the last one replaces it
+func AppendPoint(points []CounterPoint, p CounterPoint, keep int) []CounterPoint {
+	if n := len(points); n > 0 && points[n-1].Time.Equal(p.Time) {
+		points[n-1] = p
+		return points
+	}
+
+	points = append(points, p)
+	if keep < 2 {
+		keep = 2
+	}
+	if len(points) > keep {
+		points = append(points[:0:0], points[len(points)-keep:]...)
+	}
+	return points
+}
+
+// CounterRate returns the per-second increase of a counter over the window ending at now
+// points must be in time order; a total only changes at a point, so the total at the start of the window
+// is exactly that of the last point at or before it; if the window starts before the oldest kept point,
+// the rate is computed over the time since that point instead
+func CounterRate(points []CounterPoint, now time.Time, window time.Duration) (float64, error) {
+	if window <= 0 {
+		return 0, errors.New("rate window must be positive")
+	}
+	if len(points) == 0 {
+		return 0, fmt.Errorf("counter has no recorded points: %w", ErrNotFound)
+	}
+
+	start := now.Add(-window)
+	base := points[0]
+	from := base.Time
+	for _, p := range points {
+		if p.Time.After(start) {
+			break
+		}
+		base, from = p, start
+	}
+
+	elapsed := now.Sub(from).Seconds()
+	if elapsed <= 0 {
+		return 0, ErrNoRate
+	}
+
+	return float64(points[len(points)-1].Total-base.Total) / elapsed, nil
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendPoint(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+
+	var points []CounterPoint
+	for i := 0; i < 5; i++ {
+		points = AppendPoint(points, CounterPoint{Time: t0.Add(time.Duration(i) * time.Second), Total: int64(i)}, 3)
+	}
+	assert.Equal(t, []int64{2, 3, 4}, totals(points))
+
+	points = AppendPoint(points, CounterPoint{Time: t0.Add(4 * time.Second), Total: 10}, 3)
+	assert.Equal(t, []int64{2, 3, 10}, totals(points), "a point at the same time replaces the last one")
+}
+
+func totals(points []CounterPoint) []int64 {
+	result := make([]int64, 0, len(points))
+	for _, p := range points {
+		result = append(result, p.Total)
+	}
+	return result
+}
+
+func TestCounterRate(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	points := []CounterPoint{
+		{Time: t0, Total: 10},
+		{Time: t0.Add(30 * time.Second), Total: 40},
+		{Time: t0.Add(90 * time.Second), Total: 160},
+	}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		window  time.Duration
+		want    float64
+		wantErr bool
+	}{
+		{"window covers the last update", t0.Add(120 * time.Second), time.Minute, 2, false},
+		{"window starts between points", t0.Add(100 * time.Second), time.Minute, 2, false},
+		{"window longer than the history", t0.Add(100 * time.Second), time.Hour, 1.5, false},
+		{"idle counter", t0.Add(200 * time.Second), time.Minute, 0, false},
+		{"zero window", t0.Add(100 * time.Second), 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CounterRate(points, tt.now, tt.window)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, tt.want, got, 1e-9)
+		})
+	}
+
+	_, err := CounterRate(nil, t0, time.Minute)
+	assert.Error(t, err)
+}
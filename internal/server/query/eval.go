@@ -0,0 +1,100 @@
+package query
+
+import (
+	"context"
+	"sort"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// Sample is the current value of a single metric
+type Sample struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// Result is the outcome of a query: Value for aggregations, Series for bare selectors and topk
+// avg, min and max of no metrics have no value, sum and count of no metrics are 0
+type Result struct {
+	Value  *float64 `json:"value,omitempty"`
+	Series []Sample `json:"series,omitempty"`
+}
+
+// Evaluator is implemented by storages that evaluate queries themselves instead of returning every value
+type Evaluator interface {
+	// EvalQuery evaluates q over the current values of the metrics in storage
+	EvalQuery(ctx context.Context, q Query) (Result, error)
+}
+
+// Eval evaluates q over the current values in store, pushing it down to the storage if it is an Evaluator
+func Eval(ctx context.Context, store models.GeneralStorageInterface, q Query) (Result, error) {
+	if e, ok := store.(Evaluator); ok {
+		return e.EvalQuery(ctx, q)
+	}
+
+	values, err := store.GetValues(ctx, q.Selector.MType)
+	if err != nil {
+		return Result{}, err
+	}
+
+	samples := make([]Sample, 0, len(values))
+	for name, value := range values {
+		samples = append(samples, Sample{Name: name, Value: value})
+	}
+
+	return Apply(q, samples), nil
+}
+
+// Apply evaluates q over samples of the selected type
+// series are ordered by name, topk series by descending value and then by name
+func Apply(q Query, samples []Sample) Result {
+	var selected []Sample
+	for _, sample := range samples {
+		if q.Selector.Matches(sample.Name) {
+			selected = append(selected, sample)
+		}
+	}
+
+	switch q.Func {
+	case "":
+		sort.Slice(selected, func(i, j int) bool { return selected[i].Name < selected[j].Name })
+		return Result{Series: selected}
+	case "topk":
+		sort.Slice(selected, func(i, j int) bool {
+			if selected[i].Value != selected[j].Value {
+				return selected[i].Value > selected[j].Value
+			}
+			return selected[i].Name < selected[j].Name
+		})
+		if len(selected) > q.K {
+			selected = selected[:q.K]
+		}
+		return Result{Series: selected}
+	case "count":
+		count := float64(len(selected))
+		return Result{Value: &count}
+	}
+
+	var sum float64
+	for _, sample := range selected {
+		sum += sample.Value
+	}
+	if q.Func == "sum" {
+		return Result{Value: &sum}
+	}
+	if len(selected) == 0 {
+		return Result{}
+	}
+
+	value := selected[0].Value
+	for _, sample := range selected[1:] {
+		if q.Func == "min" && sample.Value < value || q.Func == "max" && sample.Value > value {
+			value = sample.Value
+		}
+	}
+	if q.Func == "avg" {
+		value = sum / float64(len(selected))
+	}
+
+	return Result{Value: &value}
+}
@@ -0,0 +1,246 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+)
+
+// aggregations are the functions that reduce the selected values to a single value
+var aggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+
+// Matcher compares metric names with Value using Op, one of '=', '!=', '=~' and '!~'
+// regular expressions must match the whole name
+type Matcher struct {
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// Matches reports whether name satisfies the matcher
+func (m Matcher) Matches(name string) bool {
+	switch m.Op {
+	case "=":
+		return name == m.Value
+	case "!=":
+		return name != m.Value
+	case "=~":
+		return m.re.MatchString(name)
+	default:
+		return !m.re.MatchString(name)
+	}
+}
+
+// Selector selects the current values of the metrics of one type whose names satisfy all matchers
+type Selector struct {
+	MType    string
+	Matchers []Matcher
+}
+
+// Matches reports whether name satisfies all matchers of the selector
+func (s Selector) Matches(name string) bool {
+	for _, m := range s.Matchers {
+		if !m.Matches(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Query is a parsed expression: a bare selector, an aggregation of it, or topk of it
+type Query struct {
+	Func     string // empty for a bare selector, 'sum', 'avg', 'min', 'max', 'count' or 'topk'
+	K        int    // number of series returned by topk
+	Selector Selector
+}
+
+// Parse parses an expression such as 'sum(gauge{name=~"Heap.*"})', 'topk(3, counter)' or 'gauge{name="Alloc"}'
+func Parse(expr string) (Query, error) {
+	p := &parser{input: expr}
+
+	q, err := p.query()
+	if err != nil {
+		return Query{}, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return Query{}, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	return q, nil
+}
+
+// parser is a recursive descent parser over the expression string
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query: at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// ident reads a name made of letters, digits and underscores
+func (p *parser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := rune(p.input[p.pos])
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// consume skips token if it is next and reports whether it was
+func (p *parser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(token string) error {
+	if !p.consume(token) {
+		return p.errorf("expected %q", token)
+	}
+	return nil
+}
+
+func (p *parser) query() (Query, error) {
+	start := p.pos
+	name := p.ident()
+
+	if !aggregations[name] && name != "topk" {
+		p.pos = start
+		sel, err := p.selector()
+		return Query{Selector: sel}, err
+	}
+
+	q := Query{Func: name}
+	if err := p.expect("("); err != nil {
+		return Query{}, err
+	}
+
+	if name == "topk" {
+		p.skipSpace()
+		digits := p.pos
+		for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+			p.pos++
+		}
+		k, err := strconv.Atoi(p.input[digits:p.pos])
+		if err != nil || k <= 0 {
+			return Query{}, p.errorf("topk needs a positive number of series")
+		}
+		q.K = k
+		if err := p.expect(","); err != nil {
+			return Query{}, err
+		}
+	}
+
+	sel, err := p.selector()
+	if err != nil {
+		return Query{}, err
+	}
+	q.Selector = sel
+
+	return q, p.expect(")")
+}
+
+func (p *parser) selector() (Selector, error) {
+	mtype := p.ident()
+	if mtype != constants.MetricTypeGauge && mtype != constants.MetricTypeCounter {
+		return Selector{}, p.errorf("expected 'gauge' or 'counter', got %q", mtype)
+	}
+
+	sel := Selector{MType: mtype}
+	if !p.consume("{") {
+		return sel, nil
+	}
+	if p.consume("}") {
+		return sel, nil
+	}
+
+	for {
+		m, err := p.matcher()
+		if err != nil {
+			return Selector{}, err
+		}
+		sel.Matchers = append(sel.Matchers, m)
+
+		if p.consume("}") {
+			return sel, nil
+		}
+		if err := p.expect(","); err != nil {
+			return Selector{}, err
+		}
+	}
+}
+
+func (p *parser) matcher() (Matcher, error) {
+	if label := p.ident(); label != "name" {
+		return Matcher{}, p.errorf("only 'name' can be matched, got %q", label)
+	}
+
+	var m Matcher
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if p.consume(op) {
+			m.Op = op
+			break
+		}
+	}
+	if m.Op == "" {
+		return Matcher{}, p.errorf("expected one of '=', '!=', '=~' or '!~'")
+	}
+
+	value, err := p.str()
+	if err != nil {
+		return Matcher{}, err
+	}
+	m.Value = value
+
+	if m.Op == "=~" || m.Op == "!~" {
+		if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return Matcher{}, p.errorf("invalid regular expression %q: %v", value, err)
+		}
+	}
+
+	return m, nil
+}
+
+// str reads a double quoted string with Go escapes
+func (p *parser) str() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '"' {
+		return "", p.errorf("expected a quoted string")
+	}
+
+	for end := p.pos + 1; end < len(p.input); end++ {
+		switch p.input[end] {
+		case '\\':
+			end++
+		case '"':
+			s, err := strconv.Unquote(p.input[p.pos : end+1])
+			if err != nil {
+				return "", p.errorf("invalid string %s", p.input[p.pos:end+1])
+			}
+			p.pos = end + 1
+			return s, nil
+		}
+	}
+
+	return "", p.errorf("unterminated string")
+}
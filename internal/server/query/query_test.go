@@ -0,0 +1,84 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		fn      string
+		k       int
+		mtype   string
+		matches []string
+		skips   []string
+	}{
+		{`sum(gauge{name=~"Heap.*"})`, "sum", 0, "gauge", []string{"HeapAlloc", "Heap"}, []string{"Alloc", "TotalHeap"}},
+		{` topk ( 3 , counter ) `, "topk", 3, "counter", []string{"PollCount"}, nil},
+		{`gauge{name="Alloc"}`, "", 0, "gauge", []string{"Alloc"}, []string{"HeapAlloc"}},
+		{`gauge{}`, "", 0, "gauge", []string{"Alloc"}, nil},
+		{`count(gauge{name!~"Heap.*", name!="Alloc"})`, "count", 0, "gauge", []string{"Frees"}, []string{"HeapIdle", "Alloc"}},
+		{`max(gauge{name=~"a\\.b|c"})`, "max", 0, "gauge", []string{"a.b", "c"}, []string{"axb"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			q, err := Parse(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.fn, q.Func)
+			assert.Equal(t, tt.k, q.K)
+			assert.Equal(t, tt.mtype, q.Selector.MType)
+			for _, name := range tt.matches {
+				assert.True(t, q.Selector.Matches(name), name)
+			}
+			for _, name := range tt.skips {
+				assert.False(t, q.Selector.Matches(name), name)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		"", "sum", "sum(gauge", "sum(gauge))", "median(gauge)", "sum(histogram)", "topk(gauge)", "topk(0, gauge)",
+		`gauge{type="gauge"}`, `gauge{name~"x"}`, `gauge{name="x"`, `gauge{name=x}`, `gauge{name=~"("}`, `gauge{name="x}`,
+	} {
+		_, err := Parse(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestApply(t *testing.T) {
+	samples := []Sample{{"HeapIdle", 5}, {"HeapAlloc", 10}, {"Alloc", 1}, {"HeapInuse", 10}}
+
+	tests := []struct {
+		expr   string
+		value  *float64
+		series []Sample
+	}{
+		{`sum(gauge{name=~"Heap.*"})`, ptr(25), nil},
+		{`avg(gauge)`, ptr(6.5), nil},
+		{`min(gauge{name=~"Heap.*"})`, ptr(5), nil},
+		{`max(gauge)`, ptr(10), nil},
+		{`count(gauge{name=~"Heap.*"})`, ptr(3), nil},
+		{`sum(gauge{name="Missing"})`, ptr(0), nil},
+		{`count(gauge{name="Missing"})`, ptr(0), nil},
+		{`avg(gauge{name="Missing"})`, nil, nil},
+		{`topk(2, gauge)`, nil, []Sample{{"HeapAlloc", 10}, {"HeapInuse", 10}}},
+		{`topk(10, gauge{name!~"Heap.*"})`, nil, []Sample{{"Alloc", 1}}},
+		{`gauge{name=~".*Alloc"}`, nil, []Sample{{"Alloc", 1}, {"HeapAlloc", 10}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			q, err := Parse(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, Result{Value: tt.value, Series: tt.series}, Apply(q, samples))
+		})
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
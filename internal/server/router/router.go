@@ -2,32 +2,82 @@ package router
 
 import (
 	"context"
+	"net/http"
 
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/gzip"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/dbhandlers"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/dbstorage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/events"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/handlers"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/health"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/logger"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/selfmetrics"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 )
 
-func SetupRouter(ctx context.Context, sugar *zap.SugaredLogger, store models.GeneralStorageInterface, shouldNotify bool) *chi.Mux {
+// SetupRouter creates the server routes, with tokens every route but /ping, /limits and the probes requires a bearer token
+// and reads and writes the metrics of its tenant; with a limiter the metric routes are rate limited per tenant, or per address without tokens;
+// /audit is only served with an audit log; with a registry requests and the storage operations of the metric routes are recorded in it
+func SetupRouter(ctx context.Context, cfg *config.Config, sugar *zap.SugaredLogger, store models.GeneralStorageInterface, tokens tenant.Tokens, limiter *limits.Limiter, quota *limits.Quota, auditLog *audit.Log, pub *events.Publisher, checker *health.Checker, reg *selfmetrics.Registry, shouldNotify bool) *chi.Mux {
 	r := chi.NewRouter()
 
+	if reg != nil {
+		r.Use(selfmetrics.WithMetrics(reg))
+	}
+
 	r.Use(gzip.WithCompression(sugar))
-	r.Use(logger.WithLogging(sugar))
+	// the limit is applied after decompression so that small gzip bodies cannot expand without bound
+	r.Use(middleware.RequestSize(cfg.MaxBodySize))
+	r.Use(logger.WithLogging(sugar, cfg.LogBodyLimit))
+
+	if s, ok := store.(dbstorage.Interface); ok {
+		r.Get("/ping", dbhandlers.PingHandler(sugar, s))
+	} else {
+		sugar.Warn("Store does not support /ping route")
+	}
+	r.Get("/limits", limits.HandleStats(sugar, limiter, quota))
+	r.Get("/healthz", health.HandleLive(sugar))
+	r.Get("/readyz", health.HandleReady(sugar, checker))
+
+	r.Group(func(r chi.Router) {
+		// tenants are limited once they are authenticated, requests with bad tokens are limited by their address
+		var rateLimit func(http.Handler) http.Handler
+		if limiter != nil {
+			rateLimit = limits.WithRateLimit(sugar, limiter)
+		}
+		if tokens != nil {
+			r.Use(tenant.WithAuth(sugar, tokens, rateLimit))
+		}
+		if rateLimit != nil {
+			r.Use(rateLimit)
+		}
+		setupMetricRoutes(ctx, r, sugar, selfmetrics.Instrument(store, reg), pub, shouldNotify)
+		if auditLog.Enabled() {
+			r.Get("/audit", handlers.HandleGetAudit(ctx, sugar, auditLog))
+		}
+	})
 
+	return r
+}
+
+// setupMetricRoutes creates the routes that read and write metrics, successful updates are published to pub
+func setupMetricRoutes(ctx context.Context, r chi.Router, sugar *zap.SugaredLogger, store models.GeneralStorageInterface, pub *events.Publisher, shouldNotify bool) {
 	r.Get("/", handlers.HandleMetricsHTML(ctx, sugar, store))
 
 	r.Route("/update", func(r chi.Router) {
-		r.Post("/{type}/{name}/{value}", handlers.HandleUpdateMetric(ctx, sugar, store, shouldNotify))
-		r.Post("/", handlers.HandleUpdateMetric(ctx, sugar, store, shouldNotify))
+		r.Post("/{type}/{name}/{value}", handlers.HandleUpdateMetric(ctx, sugar, store, pub, shouldNotify))
+		r.Post("/", handlers.HandleUpdateMetric(ctx, sugar, store, pub, shouldNotify))
 	})
 
 	r.Route("/updates", func(r chi.Router) {
-		r.Post("/", handlers.HandleSaveMetrics(ctx, sugar, store, shouldNotify))
+		r.Post("/", handlers.HandleSaveMetrics(ctx, sugar, store, pub, shouldNotify))
 	})
 
 	r.Route("/value", func(r chi.Router) {
@@ -35,11 +85,7 @@ func SetupRouter(ctx context.Context, sugar *zap.SugaredLogger, store models.Gen
 		r.Post("/", handlers.HandleGetMetric(ctx, sugar, store))
 	})
 
-	if s, ok := store.(dbstorage.Interface); ok {
-		r.Get("/ping", dbhandlers.PingHandler(sugar, s))
-	} else {
-		sugar.Warn("Store does not support /ping route")
-	}
-
-	return r
+	r.Get("/rate/{type}/{name}", handlers.HandleGetRate(ctx, sugar, store))
+	r.Get("/history/{type}/{name}", handlers.HandleGetHistory(ctx, sugar, store))
+	r.Get("/query", handlers.HandleQuery(ctx, sugar, store))
 }
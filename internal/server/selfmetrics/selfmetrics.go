@@ -0,0 +1,296 @@
+package selfmetrics
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// namespace prefixes the names of all exposed metrics
+const namespace = "metrics_server_"
+
+// latencyBounds are the upper bucket bounds of all duration histograms, in seconds
+var latencyBounds = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// labelEscaper escapes label values for the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// histogramVec holds a histogram per set of label values, keyed by the rendered labels
+type histogramVec map[string]*models.Histogram
+
+// observe adds value to the histogram of labels
+func (v histogramVec) observe(labels string, value float64) {
+	h, ok := v[labels]
+	if !ok {
+		created := models.NewHistogram(latencyBounds)
+		h = &created
+		v[labels] = h
+	}
+	h.Observe(value)
+}
+
+// funcMetric is a metric whose value is read from a component when the metrics are exposed
+type funcMetric struct {
+	name string
+	help string
+	kind string // Prometheus type: counter or gauge
+	fn   func() float64
+}
+
+// Registry collects operational metrics of the server and exposes them in the Prometheus text format;
+// all methods are safe for concurrent use and do nothing on a nil *Registry
+type Registry struct {
+	requests       histogramVec     // durations of HTTP requests by route, method and status code
+	storage        histogramVec     // durations of storage operations by operation
+	storageErrors  map[string]int64 // failed storage operations by operation
+	snapshots      histogramVec     // durations of saving the metrics to the file
+	snapshotErrors int64
+	funcs          []funcMetric
+	mu             sync.Mutex
+}
+
+// New creates an empty registry
+func New() *Registry {
+	return &Registry{
+		requests:      make(histogramVec),
+		storage:       make(histogramVec),
+		storageErrors: make(map[string]int64),
+		snapshots:     make(histogramVec),
+	}
+}
+
+// ObserveRequest records an HTTP request served by route, which is the pattern it matched
+func (r *Registry) ObserveRequest(route, method string, status int, d time.Duration) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	labels := fmt.Sprintf(`route="%s",method="%s",code="%d"`, labelEscaper.Replace(route), labelEscaper.Replace(method), status)
+	r.requests.observe(labels, d.Seconds())
+}
+
+// ObserveStorage records a storage operation and whether it failed, lookups of unknown metrics count as failures
+func (r *Registry) ObserveStorage(op string, d time.Duration, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	labels := fmt.Sprintf(`op="%s"`, labelEscaper.Replace(op))
+	r.storage.observe(labels, d.Seconds())
+	if err != nil {
+		r.storageErrors[labels]++
+	}
+}
+
+// ObserveSnapshot records saving the metrics to the file and whether it failed
+func (r *Registry) ObserveSnapshot(d time.Duration, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.snapshots.observe("", d.Seconds())
+	if err != nil {
+		r.snapshotErrors++
+	}
+}
+
+// AddCounter exposes a monotonic count read from fn, name is prefixed with the namespace
+func (r *Registry) AddCounter(name, help string, fn func() float64) {
+	r.add(funcMetric{name: name, help: help, kind: "counter", fn: fn})
+}
+
+// AddGauge exposes a value read from fn, name is prefixed with the namespace
+func (r *Registry) AddGauge(name, help string, fn func() float64) {
+	r.add(funcMetric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// add registers a metric read from a component
+func (r *Registry) add(m funcMetric) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.funcs = append(r.funcs, m)
+}
+
+// AddDBStats exposes the connection pool statistics returned by stats
+func (r *Registry) AddDBStats(stats func() sql.DBStats) {
+	r.AddGauge("db_max_open_connections", "Maximum number of open connections to the database.", func() float64 {
+		return float64(stats().MaxOpenConnections)
+	})
+	r.AddGauge("db_open_connections", "Number of established connections to the database.", func() float64 {
+		return float64(stats().OpenConnections)
+	})
+	r.AddGauge("db_in_use_connections", "Number of connections currently in use.", func() float64 {
+		return float64(stats().InUse)
+	})
+	r.AddGauge("db_idle_connections", "Number of idle connections.", func() float64 {
+		return float64(stats().Idle)
+	})
+	r.AddCounter("db_wait_count_total", "Number of connections waited for.", func() float64 {
+		return float64(stats().WaitCount)
+	})
+	r.AddCounter("db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", func() float64 {
+		return stats().WaitDuration.Seconds()
+	})
+}
+
+// statusWriter records the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes data, an implicit status is 200 OK
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// WithMetrics returns a middleware recording the duration and status of every request in r,
+// requests are labeled with the route pattern they matched rather than their path, so that
+// metric names in paths do not create a series each; unmatched requests are labeled 'other'
+func WithMetrics(r *Registry) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			h.ServeHTTP(sw, req)
+
+			route := "other"
+			if rctx := chi.RouteContext(req.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			r.ObserveRequest(route, req.Method, status, time.Since(start))
+		})
+	}
+}
+
+// Handler is an HTTP handler that exposes the metrics of r in the Prometheus text format
+func Handler(sugar *zap.SugaredLogger, r *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		r.write(&buf)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			sugar.Errorw("Cannot write to response body", err)
+		}
+	}
+}
+
+// write renders all metrics, series of a metric are ordered by their labels
+func (r *Registry) write(buf *bytes.Buffer) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	writeHistograms(buf, "http_request_duration_seconds", "Duration of HTTP requests by matched route.", r.requests)
+	writeHistograms(buf, "storage_operation_duration_seconds", "Duration of storage operations.", r.storage)
+	writeCounters(buf, "storage_errors_total", "Failed storage operations.", r.storageErrors)
+	writeHistograms(buf, "snapshot_duration_seconds", "Duration of saving the metrics to the file.", r.snapshots)
+	writeCounters(buf, "snapshot_errors_total", "Failed saves of the metrics to the file.", map[string]int64{"": r.snapshotErrors})
+
+	for _, m := range r.funcs {
+		writeHeader(buf, m.name, m.help, m.kind)
+		fmt.Fprintf(buf, "%s%s %s\n", namespace, m.name, formatFloat(m.fn()))
+	}
+}
+
+// writeHeader writes the help and type lines of a metric
+func writeHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s%s %s\n# TYPE %s%s %s\n", namespace, name, help, namespace, name, kind)
+}
+
+// writeCounters writes a counter per set of labels
+func writeCounters(buf *bytes.Buffer, name, help string, counters map[string]int64) {
+	writeHeader(buf, name, help, "counter")
+	for _, labels := range sortedKeys(counters) {
+		fmt.Fprintf(buf, "%s%s%s %d\n", namespace, name, braced(labels), counters[labels])
+	}
+}
+
+// writeHistograms writes a histogram per set of labels with cumulative buckets
+func writeHistograms(buf *bytes.Buffer, name, help string, vec histogramVec) {
+	writeHeader(buf, name, help, "histogram")
+	for _, labels := range sortedKeys(vec) {
+		h := vec[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+
+		var cumulative int64
+		for i, bound := range h.Bounds {
+			cumulative += h.Buckets[i]
+			fmt.Fprintf(buf, "%s%s_bucket{%sle=\"%s\"} %d\n", namespace, name, prefix, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(buf, "%s%s_bucket{%sle=\"+Inf\"} %d\n", namespace, name, prefix, h.Count)
+		fmt.Fprintf(buf, "%s%s_sum%s %s\n", namespace, name, braced(labels), formatFloat(h.Sum))
+		fmt.Fprintf(buf, "%s%s_count%s %d\n", namespace, name, braced(labels), h.Count)
+	}
+}
+
+// braced wraps rendered labels in braces, no labels are rendered as nothing
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// formatFloat formats v in the shortest form that parses back to it
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
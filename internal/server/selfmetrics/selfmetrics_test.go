@@ -0,0 +1,112 @@
+package selfmetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/query"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/storage"
+)
+
+// scrape returns the metrics of r as exposed by Handler
+func scrape(t *testing.T, r *Registry) string {
+	w := httptest.NewRecorder()
+	Handler(zap.NewNop().Sugar(), r)(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestWithMetrics(t *testing.T) {
+	reg := New()
+	r := chi.NewRouter()
+	r.Use(WithMetrics(reg))
+	r.Get("/value/{type}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.Post("/update/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	for _, path := range []string{"/value/gauge/Alloc", "/value/gauge/Frees"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/update/", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	body := scrape(t, reg)
+	assert.Contains(t, body, "# TYPE metrics_server_http_request_duration_seconds histogram\n")
+	assert.Contains(t, body, `metrics_server_http_request_duration_seconds_count{route="/value/{type}/{name}",method="GET",code="404"} 2`)
+	assert.Contains(t, body, `metrics_server_http_request_duration_seconds_count{route="/update",method="POST",code="200"} 1`)
+	assert.Contains(t, body, `metrics_server_http_request_duration_seconds_count{route="other",method="GET",code="404"} 1`)
+	assert.Contains(t, body, `metrics_server_http_request_duration_seconds_bucket{route="/update",method="POST",code="200",le="+Inf"} 1`)
+	assert.NotContains(t, body, "Alloc", "paths must not become labels")
+}
+
+func TestInstrument(t *testing.T) {
+	reg := New()
+	store := Instrument(storage.NewInMemoryStorage(), reg)
+	ctx := context.Background()
+
+	require.NoError(t, store.UpdateGauge(ctx, "Alloc", 1, false))
+	_, err := store.GetGauge(ctx, "Frees")
+	require.ErrorIs(t, err, models.ErrNotFound)
+	_, err = store.GetValues(ctx, "histogram")
+	require.Error(t, err)
+
+	q, err := query.Parse("sum(gauge)")
+	require.NoError(t, err)
+	result, err := store.(query.Evaluator).EvalQuery(ctx, q)
+	require.NoError(t, err)
+	require.NotNil(t, result.Value)
+	assert.Equal(t, 1.0, *result.Value)
+
+	body := scrape(t, reg)
+	assert.Contains(t, body, `metrics_server_storage_operation_duration_seconds_count{op="UpdateGauge"} 1`)
+	assert.Contains(t, body, `metrics_server_storage_operation_duration_seconds_count{op="EvalQuery"} 1`)
+	assert.Contains(t, body, `metrics_server_storage_operation_duration_seconds_count{op="GetGauge"} 1`)
+	assert.NotContains(t, body, `metrics_server_storage_errors_total{op="GetGauge"}`, "a missing metric is not a storage error")
+	assert.Contains(t, body, `metrics_server_storage_errors_total{op="GetValues"} 1`)
+	assert.NotContains(t, body, `metrics_server_storage_errors_total{op="UpdateGauge"}`)
+
+	inner := storage.NewInMemoryStorage()
+	assert.Same(t, inner, Instrument(inner, nil), "without a registry the storage is not wrapped")
+}
+
+func TestRegistry(t *testing.T) {
+	reg := New()
+	reg.ObserveSnapshot(3*time.Millisecond, nil)
+	reg.ObserveSnapshot(2*time.Second, errors.New("disk full"))
+	reg.AddCounter("events_dropped_total", "Dropped events.", func() float64 { return 7 })
+	reg.AddGauge("db_open_connections", "Open connections.", func() float64 { return 2 })
+
+	body := scrape(t, reg)
+	assert.Contains(t, body, "metrics_server_snapshot_duration_seconds_bucket{le=\"0.005\"} 1\n")
+	assert.Contains(t, body, "metrics_server_snapshot_duration_seconds_bucket{le=\"2.5\"} 2\n")
+	assert.Contains(t, body, "metrics_server_snapshot_duration_seconds_count 2\n")
+	assert.Contains(t, body, "metrics_server_snapshot_errors_total 1\n")
+	assert.Contains(t, body, "# TYPE metrics_server_events_dropped_total counter\nmetrics_server_events_dropped_total 7\n")
+	assert.Contains(t, body, "# TYPE metrics_server_db_open_connections gauge\nmetrics_server_db_open_connections 2\n")
+
+	var disabled *Registry
+	disabled.ObserveRequest("/", http.MethodGet, http.StatusOK, time.Second)
+	disabled.ObserveStorage("GetGauge", time.Second, nil)
+	disabled.ObserveSnapshot(time.Second, nil)
+	disabled.AddGauge("db_open_connections", "Open connections.", func() float64 { return 2 })
+	assert.Empty(t, scrape(t, disabled))
+}
+
+func TestLabelEscaping(t *testing.T) {
+	reg := New()
+	reg.ObserveRequest(`/a"b`, http.MethodGet, http.StatusOK, time.Millisecond)
+	assert.Contains(t, scrape(t, reg), `route="/a\"b",method="GET"`)
+}
@@ -0,0 +1,151 @@
+package selfmetrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/query"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
+)
+
+// store records the duration and outcome of every operation of the storage it wraps
+type store struct {
+	models.GeneralStorageInterface
+	reg *Registry
+}
+
+// Instrument returns s recording its operations in r, s itself if r is nil;
+// queries are still pushed down to storages that evaluate them, other optional
+// capabilities of s are hidden, so only handlers should be given the result
+func Instrument(s models.GeneralStorageInterface, r *Registry) models.GeneralStorageInterface {
+	if r == nil {
+		return s
+	}
+	return &store{GeneralStorageInterface: s, reg: r}
+}
+
+// observe records an operation that started at start; missing metrics, rates and history
+// are answers to the request rather than failures of the storage, so they are recorded as successes
+func (s *store) observe(op string, start time.Time, err error) {
+	if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrNoRate) || errors.Is(err, history.ErrDisabled) {
+		err = nil
+	}
+	s.reg.ObserveStorage(op, time.Since(start), err)
+}
+
+func (s *store) UpdateGauge(ctx context.Context, name string, value float64, shouldNotify bool) error {
+	start := time.Now()
+	err := s.GeneralStorageInterface.UpdateGauge(ctx, name, value, shouldNotify)
+	s.observe("UpdateGauge", start, err)
+	return err
+}
+
+func (s *store) UpdateCounter(ctx context.Context, name string, value int64, shouldNotify bool) error {
+	start := time.Now()
+	err := s.GeneralStorageInterface.UpdateCounter(ctx, name, value, shouldNotify)
+	s.observe("UpdateCounter", start, err)
+	return err
+}
+
+func (s *store) UpdateHistogram(ctx context.Context, name string, h models.Histogram, shouldNotify bool) error {
+	start := time.Now()
+	err := s.GeneralStorageInterface.UpdateHistogram(ctx, name, h, shouldNotify)
+	s.observe("UpdateHistogram", start, err)
+	return err
+}
+
+func (s *store) UpdateSummary(ctx context.Context, name string, sk sketch.Sketch, shouldNotify bool) error {
+	start := time.Now()
+	err := s.GeneralStorageInterface.UpdateSummary(ctx, name, sk, shouldNotify)
+	s.observe("UpdateSummary", start, err)
+	return err
+}
+
+func (s *store) UpdateSet(ctx context.Context, name string, members []string, shouldNotify bool) error {
+	start := time.Now()
+	err := s.GeneralStorageInterface.UpdateSet(ctx, name, members, shouldNotify)
+	s.observe("UpdateSet", start, err)
+	return err
+}
+
+func (s *store) GetGauge(ctx context.Context, name string) (float64, error) {
+	start := time.Now()
+	value, err := s.GeneralStorageInterface.GetGauge(ctx, name)
+	s.observe("GetGauge", start, err)
+	return value, err
+}
+
+func (s *store) GetCounter(ctx context.Context, name string) (int64, error) {
+	start := time.Now()
+	value, err := s.GeneralStorageInterface.GetCounter(ctx, name)
+	s.observe("GetCounter", start, err)
+	return value, err
+}
+
+func (s *store) GetHistogram(ctx context.Context, name string) (models.Histogram, error) {
+	start := time.Now()
+	h, err := s.GeneralStorageInterface.GetHistogram(ctx, name)
+	s.observe("GetHistogram", start, err)
+	return h, err
+}
+
+func (s *store) GetSummary(ctx context.Context, name string) (sketch.Sketch, error) {
+	start := time.Now()
+	sk, err := s.GeneralStorageInterface.GetSummary(ctx, name)
+	s.observe("GetSummary", start, err)
+	return sk, err
+}
+
+func (s *store) GetSet(ctx context.Context, name string) (hll.Sketch, error) {
+	start := time.Now()
+	set, err := s.GeneralStorageInterface.GetSet(ctx, name)
+	s.observe("GetSet", start, err)
+	return set, err
+}
+
+func (s *store) GetValues(ctx context.Context, mtype string) (map[string]float64, error) {
+	start := time.Now()
+	values, err := s.GeneralStorageInterface.GetValues(ctx, mtype)
+	s.observe("GetValues", start, err)
+	return values, err
+}
+
+func (s *store) GetCounterRate(ctx context.Context, name string, window time.Duration) (float64, error) {
+	start := time.Now()
+	rate, err := s.GeneralStorageInterface.GetCounterRate(ctx, name, window)
+	s.observe("GetCounterRate", start, err)
+	return rate, err
+}
+
+func (s *store) GetHistory(ctx context.Context, mtype, name string, from, to time.Time) (history.Tier, []history.Point, error) {
+	start := time.Now()
+	tier, points, err := s.GeneralStorageInterface.GetHistory(ctx, mtype, name, from, to)
+	s.observe("GetHistory", start, err)
+	return tier, points, err
+}
+
+func (s *store) String(ctx context.Context) string {
+	start := time.Now()
+	result := s.GeneralStorageInterface.String(ctx)
+	s.observe("String", start, nil)
+	return result
+}
+
+func (s *store) SaveMetrics(ctx context.Context, metrics []models.Metrics, shouldNotify bool) error {
+	start := time.Now()
+	err := s.GeneralStorageInterface.SaveMetrics(ctx, metrics, shouldNotify)
+	s.observe("SaveMetrics", start, err)
+	return err
+}
+
+// EvalQuery evaluates q with the wrapped storage, which keeps queries pushed down to storages that evaluate them
+func (s *store) EvalQuery(ctx context.Context, q query.Query) (query.Result, error) {
+	start := time.Now()
+	result, err := query.Eval(ctx, s.GeneralStorageInterface, q)
+	s.observe("EvalQuery", start, err)
+	return result, err
+}
@@ -3,10 +3,19 @@ package storage
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/utils"
 )
 
@@ -16,6 +25,12 @@ type Interface interface {
 	models.GeneralStorageInterface
 	GetMetricsData() (map[string]float64, map[string]int64)
 	SetMetricsData(gauges map[string]float64, counters map[string]int64)
+	GetHistogramsData() map[string]models.Histogram
+	SetHistogramsData(histograms map[string]models.Histogram)
+	GetSummariesData() map[string]sketch.Sketch
+	SetSummariesData(summaries map[string]sketch.Sketch)
+	GetSetsData() map[string]hll.Sketch
+	SetSetsData(sets map[string]hll.Sketch)
 	GetUpdateChannel() chan struct{}
 	notifyUpdate(shouldNotify bool)
 }
@@ -27,6 +42,16 @@ type InMemoryStorage struct {
 	updateChan chan struct{} // Channel to notify about updates
 	gauges     map[string]float64
 	counter    map[string]int64
+	histograms map[string]models.Histogram
+	summaries  map[string]sketch.Sketch
+	sets       map[string]hll.Sketch
+	points     map[string][]models.CounterPoint // recent totals of every counter, for rates
+	now        func() time.Time
+	ratePoints int
+	hist       *history.Memory // recorded gauge values and counter totals, nil if history is disabled
+	quota      *limits.Quota   // cap on the number of metrics of every tenant, nil if unlimited
+	counts     map[string]int  // number of stored metrics of every tenant, checked against the quota
+	audit      *audit.Log      // log of accepted updates, nil if auditing is disabled
 	mu         sync.Mutex
 }
 
@@ -35,38 +60,291 @@ func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
 		counter:    make(map[string]int64),
 		gauges:     make(map[string]float64),
+		histograms: make(map[string]models.Histogram),
+		summaries:  make(map[string]sketch.Sketch),
+		sets:       make(map[string]hll.Sketch),
+		points:     make(map[string][]models.CounterPoint),
+		counts:     make(map[string]int),
+		now:        time.Now,
+		ratePoints: models.DefaultRatePoints,
 		updateChan: make(chan struct{}, 1),
 	}
 }
 
 // UpdateGauge sets the current value of a gauge metric identified by its name
 func (s *InMemoryStorage) UpdateGauge(ctx context.Context, name string, value float64, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.admit(ctx, []models.Metrics{{ID: key, MType: constants.MetricTypeGauge}}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	entries := s.auditEntries(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeGauge, Value: &value}})
 
-	s.gauges[name] = value
+	s.gauges[key] = value
+	s.recordHistory(constants.MetricTypeGauge, key, s.now(), value)
 	s.notifyUpdate(shouldNotify)
+	s.mu.Unlock()
+
+	s.audit.Record(ctx, entries)
 	return nil
 }
 
 // UpdateCounter increments the value of a counter metric identified by its name
 func (s *InMemoryStorage) UpdateCounter(ctx context.Context, name string, value int64, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	s.mu.Lock()
+	if err := s.admit(ctx, []models.Metrics{{ID: key, MType: constants.MetricTypeCounter}}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	entries := s.auditEntries(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeCounter, Delta: &value}})
+
+	s.counter[key] += value
+	now := s.now()
+	s.recordPoint(key, now)
+	s.recordHistory(constants.MetricTypeCounter, key, now, float64(s.counter[key]))
+	s.notifyUpdate(shouldNotify)
+	s.mu.Unlock()
+
+	s.audit.Record(ctx, entries)
+	return nil
+}
+
+// SetRatePoints sets the number of recent totals kept per counter for rates, at least 2 are kept
+func (s *InMemoryStorage) SetRatePoints(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ratePoints = n
+}
+
+// recordPoint records the current total of a counter, the caller must hold the lock
+func (s *InMemoryStorage) recordPoint(name string, now time.Time) {
+	s.points[name] = models.AppendPoint(s.points[name], models.CounterPoint{Time: now, Total: s.counter[name]}, s.ratePoints)
+}
+
+// SetQuota makes the storage reject updates that would exceed the metric quota of their tenant
+func (s *InMemoryStorage) SetQuota(q *limits.Quota) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.quota = q
+}
+
+// admit checks that the metrics of a batch that are not stored yet fit into the quota of the tenant in ctx
+// and counts them as stored, so it must be the last check before the batch is applied;
+// metrics are identified by their storage keys; the caller must hold the lock
+func (s *InMemoryStorage) admit(ctx context.Context, metrics []models.Metrics) error {
+	added := make(map[string]bool)
+	for _, metric := range metrics {
+		if !s.has(metric.MType, metric.ID) {
+			added[metric.MType+"/"+metric.ID] = true
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	owner := tenant.FromContext(ctx)
+	if s.quota.Enabled() {
+		if err := s.quota.Check(owner, s.counts[owner], len(added)); err != nil {
+			return err
+		}
+	}
+	s.counts[owner] += len(added)
+	return nil
+}
+
+// recount rebuilds the number of stored metrics of every tenant after the maps were replaced,
+// the caller must hold the lock
+func (s *InMemoryStorage) recount() {
+	counts := make(map[string]int)
+	countKeys(counts, s.gauges)
+	countKeys(counts, s.counter)
+	countKeys(counts, s.histograms)
+	countKeys(counts, s.summaries)
+	countKeys(counts, s.sets)
+	s.counts = counts
+}
+
+// has reports whether a metric is stored, the caller must hold the lock
+func (s *InMemoryStorage) has(mtype, key string) bool {
+	var ok bool
+	switch mtype {
+	case constants.MetricTypeGauge:
+		_, ok = s.gauges[key]
+	case constants.MetricTypeCounter:
+		_, ok = s.counter[key]
+	case constants.MetricTypeHistogram:
+		_, ok = s.histograms[key]
+	case constants.MetricTypeSummary:
+		_, ok = s.summaries[key]
+	case constants.MetricTypeSet:
+		_, ok = s.sets[key]
+	}
+	return ok
+}
+
+// SetAudit makes the storage record accepted updates in l
+func (s *InMemoryStorage) SetAudit(l *audit.Log) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audit = l
+}
+
+// auditEntries returns the audit entries of updates that are about to be applied, nil if auditing is disabled;
+// they are recorded after the lock is released, so that writing the sink does not block the storage;
+// the updates name their metrics without the tenant; the caller must hold the lock, so that the old values
+// are the ones the updates replace
+func (s *InMemoryStorage) auditEntries(ctx context.Context, updates []models.Metrics) []audit.Entry {
+	if !s.audit.Enabled() {
+		return nil
+	}
+
+	old := make(map[string]float64)
+	for _, metric := range updates {
+		if value, ok := s.gauges[tenant.Key(ctx, metric.ID)]; ok && metric.MType == constants.MetricTypeGauge {
+			old[metric.ID] = value
+		}
+	}
+	return audit.Entries(updates, old)
+}
+
+// SetHistoryTiers enables the history of gauge values and counter totals with the given tiers,
+// no tiers disable it; history is not persisted to the storage file
+func (s *InMemoryStorage) SetHistoryTiers(tiers history.Tiers) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.counter[name] += value
+	s.hist = nil
+	if len(tiers) > 0 {
+		s.hist = history.NewMemory(tiers)
+	}
+}
+
+// recordHistory records a sample if history is enabled, the caller must hold the lock
+func (s *InMemoryStorage) recordHistory(mtype, name string, at time.Time, value float64) {
+	if s.hist != nil {
+		s.hist.Record(mtype, name, at, value)
+	}
+}
+
+// GetHistory fetches the recorded points of a gauge or counter between from and to
+func (s *InMemoryStorage) GetHistory(ctx context.Context, mtype, name string, from, to time.Time) (history.Tier, []history.Point, error) {
+	key := tenant.Key(ctx, name)
+
+	s.mu.Lock()
+	hist, now := s.hist, s.now()
+	s.mu.Unlock()
+
+	if hist == nil {
+		return history.Tier{}, nil, history.ErrDisabled
+	}
+	return hist.Query(mtype, key, from, to, now)
+}
+
+// CompactHistory removes the history that is past the retention of its tier
+func (s *InMemoryStorage) CompactHistory(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	hist := s.hist
+	s.mu.Unlock()
+
+	if hist != nil {
+		hist.Compact(now)
+	}
+	return nil
+}
+
+// UpdateHistogram merges h into the histogram metric identified by its name
+func (s *InMemoryStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.admit(ctx, []models.Metrics{{ID: key, MType: constants.MetricTypeHistogram}}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	entries := s.auditEntries(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeHistogram}})
+
+	s.histograms[key] = s.histograms[key].Merge(h)
 	s.notifyUpdate(shouldNotify)
+	s.mu.Unlock()
+
+	s.audit.Record(ctx, entries)
 	return nil
 }
 
+// UpdateSummary merges sk into the summary metric identified by its name
+func (s *InMemoryStorage) UpdateSummary(ctx context.Context, name string, sk sketch.Sketch, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	if err := sk.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.admit(ctx, []models.Metrics{{ID: key, MType: constants.MetricTypeSummary}}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	entries := s.auditEntries(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeSummary}})
+
+	s.summaries[key] = s.summaries[key].Merge(sk)
+	s.notifyUpdate(shouldNotify)
+	s.mu.Unlock()
+
+	s.audit.Record(ctx, entries)
+	return nil
+}
+
+// UpdateSet adds members to the sketch of the set metric identified by its name
+func (s *InMemoryStorage) UpdateSet(ctx context.Context, name string, members []string, shouldNotify bool) error {
+	key := tenant.Key(ctx, name)
+
+	s.mu.Lock()
+	if err := s.admit(ctx, []models.Metrics{{ID: key, MType: constants.MetricTypeSet}}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	entries := s.auditEntries(ctx, []models.Metrics{{ID: name, MType: constants.MetricTypeSet}})
+
+	s.addMembers(key, members)
+	s.notifyUpdate(shouldNotify)
+	s.mu.Unlock()
+
+	s.audit.Record(ctx, entries)
+	return nil
+}
+
+// addMembers adds members to a copy of the sketch of a set, the caller must hold the lock
+// the stored sketch is replaced rather than changed in place, like merged histograms and summaries,
+// since maps returned by GetSetsData are read without the lock
+func (s *InMemoryStorage) addMembers(name string, members []string) {
+	set := s.sets[name].Clone()
+	for _, member := range members {
+		set.Add(member)
+	}
+	s.sets[name] = set
+}
+
 // GetGauge fetches the current value of a gauge metric by its name from storage
 func (s *InMemoryStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	key := tenant.Key(ctx, name)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	value, ok := s.gauges[name]
+	value, ok := s.gauges[key]
 	if !ok {
-		return 0, fmt.Errorf("gauge %s not found", name)
+		return 0, fmt.Errorf("gauge %s: %w", name, models.ErrNotFound)
 	}
 
 	return value, nil
@@ -74,17 +352,99 @@ func (s *InMemoryStorage) GetGauge(ctx context.Context, name string) (float64, e
 
 // GetCounter fetches the current value of a counter metric by its name from storage
 func (s *InMemoryStorage) GetCounter(ctx context.Context, name string) (int64, error) {
+	key := tenant.Key(ctx, name)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	value, ok := s.counter[name]
+	value, ok := s.counter[key]
 	if !ok {
-		return 0, fmt.Errorf("counter %s not found", name)
+		return 0, fmt.Errorf("counter %s: %w", name, models.ErrNotFound)
 	}
 
 	return value, nil
 }
 
+// GetValues fetches a copy of the current values of all gauges or the totals of all counters of the tenant in ctx
+func (s *InMemoryStorage) GetValues(ctx context.Context, mtype string) (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var values map[string]float64
+	switch mtype {
+	case constants.MetricTypeGauge:
+		values = tenant.Filter(ctx, s.gauges)
+	case constants.MetricTypeCounter:
+		values = make(map[string]float64)
+		for name, value := range tenant.Filter(ctx, s.counter) {
+			values[name] = float64(value)
+		}
+	default:
+		return nil, fmt.Errorf("metric type %s has no single value", mtype)
+	}
+
+	return values, nil
+}
+
+// GetCounterRate computes the per-second increase of a counter over the window ending now
+func (s *InMemoryStorage) GetCounterRate(ctx context.Context, name string, window time.Duration) (float64, error) {
+	key := tenant.Key(ctx, name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.counter[key]; !ok {
+		return 0, fmt.Errorf("counter %s: %w", name, models.ErrNotFound)
+	}
+
+	return models.CounterRate(s.points[key], s.now(), window)
+}
+
+// GetHistogram fetches a copy of the current state of a histogram metric by its name from storage
+func (s *InMemoryStorage) GetHistogram(ctx context.Context, name string) (models.Histogram, error) {
+	key := tenant.Key(ctx, name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.histograms[key]
+	if !ok {
+		return models.Histogram{}, fmt.Errorf("histogram %s: %w", name, models.ErrNotFound)
+	}
+
+	return h.Clone(), nil
+}
+
+// GetSummary fetches a copy of the current sketch of a summary metric by its name from storage
+func (s *InMemoryStorage) GetSummary(ctx context.Context, name string) (sketch.Sketch, error) {
+	key := tenant.Key(ctx, name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sk, ok := s.summaries[key]
+	if !ok {
+		return sketch.Sketch{}, fmt.Errorf("summary %s: %w", name, models.ErrNotFound)
+	}
+
+	return sk.Clone(), nil
+}
+
+// GetSet fetches a copy of the current sketch of a set metric by its name from storage
+func (s *InMemoryStorage) GetSet(ctx context.Context, name string) (hll.Sketch, error) {
+	key := tenant.Key(ctx, name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, ok := s.sets[key]
+	if !ok {
+		return hll.Sketch{}, fmt.Errorf("set %s: %w", name, models.ErrNotFound)
+	}
+
+	return set.Clone(), nil
+}
+
 // GetMetricsData returns the stored gauges and counters metrics
 func (s *InMemoryStorage) GetMetricsData() (map[string]float64, map[string]int64) {
 	s.mu.Lock()
@@ -100,44 +460,144 @@ func (s *InMemoryStorage) SetMetricsData(gauges map[string]float64, counters map
 
 	s.gauges = gauges
 	s.counter = counters
+	s.recount()
+}
+
+// GetHistogramsData returns the stored histogram metrics
+func (s *InMemoryStorage) GetHistogramsData() map[string]models.Histogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.histograms
+}
+
+// SetHistogramsData sets the histogram metrics in the storage, a nil map clears them
+func (s *InMemoryStorage) SetHistogramsData(histograms map[string]models.Histogram) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if histograms == nil {
+		histograms = make(map[string]models.Histogram)
+	}
+	s.histograms = histograms
+	s.recount()
+}
+
+// GetSummariesData returns the stored summary metrics
+func (s *InMemoryStorage) GetSummariesData() map[string]sketch.Sketch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.summaries
+}
+
+// SetSummariesData sets the summary metrics in the storage, a nil map clears them
+func (s *InMemoryStorage) SetSummariesData(summaries map[string]sketch.Sketch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if summaries == nil {
+		summaries = make(map[string]sketch.Sketch)
+	}
+	s.summaries = summaries
+	s.recount()
+}
+
+// GetSetsData returns the stored set metrics
+func (s *InMemoryStorage) GetSetsData() map[string]hll.Sketch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sets
+}
+
+// SetSetsData sets the set metrics in the storage, a nil map clears them
+func (s *InMemoryStorage) SetSetsData(sets map[string]hll.Sketch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sets == nil {
+		sets = make(map[string]hll.Sketch)
+	}
+	s.sets = sets
+	s.recount()
 }
 
-// String provides a string representation of all the metrics in the storage
+// String provides a string representation of all the metrics of the tenant in ctx
 func (s *InMemoryStorage) String(ctx context.Context) string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	var result strings.Builder
 	result.WriteString("Counter values:\n")
-	result.WriteString(utils.FormatMapSortedKeys(s.counter))
+	result.WriteString(utils.FormatMapSortedKeys(tenant.Filter(ctx, s.counter)))
 	result.WriteString("\nGauge values:\n")
-	result.WriteString(utils.FormatMapSortedKeys(s.gauges))
+	result.WriteString(utils.FormatMapSortedKeys(tenant.Filter(ctx, s.gauges)))
+
+	if histograms := tenant.Filter(ctx, s.histograms); len(histograms) > 0 {
+		result.WriteString("\nHistogram values:\n")
+		for _, name := range sortedNames(histograms) {
+			result.WriteString(fmt.Sprintf("%s: %s\n", name, histograms[name]))
+		}
+	}
+
+	if summaries := tenant.Filter(ctx, s.summaries); len(summaries) > 0 {
+		result.WriteString("\nSummary values:\n")
+		for _, name := range sortedNames(summaries) {
+			result.WriteString(fmt.Sprintf("%s: %s\n", name, summaries[name]))
+		}
+	}
+
+	if sets := tenant.Filter(ctx, s.sets); len(sets) > 0 {
+		result.WriteString("\nSet values:\n")
+		for _, name := range sortedNames(sets) {
+			result.WriteString(fmt.Sprintf("%s: %s\n", name, sets[name]))
+		}
+	}
 
 	return result.String()
 }
 
+// SaveMetrics applies a batch of metrics, the whole batch is validated before anything is stored
 func (s *InMemoryStorage) SaveMetrics(ctx context.Context, metrics []models.Metrics, shouldNotify bool) error {
+	for _, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			return err
+		}
+	}
+	updates := metrics
+	metrics = tenant.Metrics(ctx, metrics)
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.admit(ctx, metrics); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	entries := s.auditEntries(ctx, updates)
 
+	now := s.now()
 	for _, metric := range metrics {
 		switch metric.MType {
-		case "gauge":
-			if metric.Value == nil {
-				return fmt.Errorf("value not provided for gauge: %s", metric.ID)
-			}
+		case constants.MetricTypeGauge:
 			s.gauges[metric.ID] = *metric.Value
-		case "counter":
-			if metric.Delta == nil {
-				return fmt.Errorf("delta not provided for counter: %s", metric.ID)
-			}
+			s.recordHistory(metric.MType, metric.ID, now, *metric.Value)
+		case constants.MetricTypeCounter:
 			s.counter[metric.ID] += *metric.Delta
-		default:
-			return fmt.Errorf("unknown metric type: %s", metric.MType)
+			s.recordPoint(metric.ID, now)
+			s.recordHistory(metric.MType, metric.ID, now, float64(s.counter[metric.ID]))
+		case constants.MetricTypeHistogram:
+			s.histograms[metric.ID] = s.histograms[metric.ID].Merge(metric.Histogram())
+		case constants.MetricTypeSummary:
+			s.summaries[metric.ID] = s.summaries[metric.ID].Merge(*metric.Sketch)
+		case constants.MetricTypeSet:
+			s.sets[metric.ID] = s.sets[metric.ID].Merge(metric.Set())
 		}
 	}
 
 	s.notifyUpdate(shouldNotify)
+	s.mu.Unlock()
+
+	s.audit.Record(ctx, entries)
 
 	return nil
 }
@@ -154,3 +614,21 @@ func (s *InMemoryStorage) notifyUpdate(shouldNotify bool) {
 		s.updateChan <- struct{}{}
 	}
 }
+
+// countKeys adds the number of keys of a metrics map to the counts of the tenants they belong to
+func countKeys[V any](counts map[string]int, m map[string]V) {
+	for key := range m {
+		counts[tenant.Owner(key)]++
+	}
+}
+
+// sortedNames returns the keys of a metrics map in alphabetical order
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -2,7 +2,21 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/constants"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/hll"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/audit"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/history"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/limits"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/tenant"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/sketch"
 )
 
 func TestInMemoryStorage(t *testing.T) {
@@ -91,3 +105,399 @@ func TestInMemoryStorage(t *testing.T) {
 		})
 	}
 }
+
+func TestSaveMetricsIsAtomic(t *testing.T) {
+	s := NewInMemoryStorage()
+	value := 1.5
+
+	err := s.SaveMetrics(context.TODO(), []models.Metrics{
+		{ID: "gauge1", MType: "gauge", Value: &value},
+		{ID: "counter1", MType: "counter"},
+	}, false)
+	if err == nil {
+		t.Fatalf("Expected an error for a counter without delta")
+	}
+
+	if _, err := s.GetGauge(context.TODO(), "gauge1"); err == nil {
+		t.Errorf("Expected gauge1 not to be stored after a rejected batch")
+	}
+}
+
+func TestInMemoryStorageHistograms(t *testing.T) {
+	s := NewInMemoryStorage()
+	ctx := context.TODO()
+
+	h := models.NewHistogram([]float64{1})
+	h.Observe(0.5)
+
+	if err := s.UpdateHistogram(ctx, "Latency", h, false); err != nil {
+		t.Fatalf("UpdateHistogram() error = %v", err)
+	}
+	if err := s.SaveMetrics(ctx, []models.Metrics{models.NewHistogramMetric("Latency", h)}, false); err != nil {
+		t.Fatalf("SaveMetrics() error = %v", err)
+	}
+
+	got, err := s.GetHistogram(ctx, "Latency")
+	if err != nil {
+		t.Fatalf("GetHistogram() error = %v", err)
+	}
+	if got.Count != 2 || got.Buckets[0] != 2 || got.Sum != 1 {
+		t.Errorf("GetHistogram() = %v, want two merged observations", got)
+	}
+
+	got.Buckets[0] = 100
+	if again, _ := s.GetHistogram(ctx, "Latency"); again.Buckets[0] != 2 {
+		t.Errorf("GetHistogram() returned the stored buckets instead of a copy")
+	}
+
+	if err := s.UpdateHistogram(ctx, "Latency", models.Histogram{Buckets: []int64{1}}, false); err == nil {
+		t.Errorf("UpdateHistogram() accepted a histogram whose count does not match its buckets")
+	}
+	if _, err := s.GetHistogram(ctx, "missing"); err == nil {
+		t.Errorf("GetHistogram() found a histogram that was never stored")
+	}
+}
+
+func TestInMemoryStorageSummaries(t *testing.T) {
+	s := NewInMemoryStorage()
+	ctx := context.TODO()
+
+	sk := sketch.New(sketch.DefaultAlpha)
+	sk.Add(10)
+
+	if err := s.UpdateSummary(ctx, "Latency", sk, false); err != nil {
+		t.Fatalf("UpdateSummary() error = %v", err)
+	}
+	if err := s.SaveMetrics(ctx, []models.Metrics{models.NewSummaryMetric("Latency", sk)}, false); err != nil {
+		t.Fatalf("SaveMetrics() error = %v", err)
+	}
+
+	got, err := s.GetSummary(ctx, "Latency")
+	if err != nil {
+		t.Fatalf("GetSummary() error = %v", err)
+	}
+	if got.Count != 2 || got.Sum != 20 {
+		t.Errorf("GetSummary() = %v, want two merged values", got)
+	}
+
+	got.Add(100)
+	if again, _ := s.GetSummary(ctx, "Latency"); again.Count != 2 {
+		t.Errorf("GetSummary() returned the stored bins instead of a copy")
+	}
+
+	if err := s.UpdateSummary(ctx, "Latency", sketch.Sketch{Alpha: 0.01, Count: 1}, false); err == nil {
+		t.Errorf("UpdateSummary() accepted a sketch whose count does not match its bins")
+	}
+	if _, err := s.GetSummary(ctx, "missing"); err == nil {
+		t.Errorf("GetSummary() found a summary that was never stored")
+	}
+}
+
+func TestInMemoryStorageSets(t *testing.T) {
+	s := NewInMemoryStorage()
+	ctx := context.TODO()
+
+	if err := s.UpdateSet(ctx, "Users", []string{"alice", "bob"}, false); err != nil {
+		t.Fatalf("UpdateSet() error = %v", err)
+	}
+	set := models.Metrics{ID: "Users", MType: constants.MetricTypeSet, Members: []string{"bob", "carol"}}
+	if err := s.SaveMetrics(ctx, []models.Metrics{set}, false); err != nil {
+		t.Fatalf("SaveMetrics() error = %v", err)
+	}
+
+	got, err := s.GetSet(ctx, "Users")
+	if err != nil {
+		t.Fatalf("GetSet() error = %v", err)
+	}
+	if got.Estimate() != 3 {
+		t.Errorf("GetSet().Estimate() = %d, want 3", got.Estimate())
+	}
+
+	got.Add("dave")
+	if again, _ := s.GetSet(ctx, "Users"); again.Estimate() != 3 {
+		t.Errorf("GetSet() returned the stored registers instead of a copy")
+	}
+
+	// agents send their sets as sketches
+	sketched := models.Metrics{ID: "Users", MType: constants.MetricTypeSet, Registers: models.Metrics{Members: []string{"erin", "alice"}}.Set().Registers}
+	if err := sketched.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if err := s.SaveMetrics(ctx, []models.Metrics{sketched}, false); err != nil {
+		t.Fatalf("SaveMetrics() error = %v", err)
+	}
+	if got, _ := s.GetSet(ctx, "Users"); got.Estimate() != 4 {
+		t.Errorf("GetSet().Estimate() = %d after merging a sketch, want 4", got.Estimate())
+	}
+	if err := (models.Metrics{ID: "Users", MType: constants.MetricTypeSet, Registers: []byte{1}}).Validate(); err == nil {
+		t.Errorf("Validate() accepted registers of the wrong length")
+	}
+
+	if _, err := s.GetSet(ctx, "missing"); err == nil {
+		t.Errorf("GetSet() found a set that was never stored")
+	}
+}
+
+func TestInMemoryStorageCounterRate(t *testing.T) {
+	s := NewInMemoryStorage()
+	s.SetRatePoints(3)
+	ctx := context.TODO()
+
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		if err := s.UpdateCounter(ctx, "Requests", 30, false); err != nil {
+			t.Fatalf("UpdateCounter() error = %v", err)
+		}
+		now = now.Add(30 * time.Second)
+	}
+	delta := int64(60)
+	if err := s.SaveMetrics(ctx, []models.Metrics{{ID: "Requests", MType: constants.MetricTypeCounter, Delta: &delta}}, false); err != nil {
+		t.Fatalf("SaveMetrics() error = %v", err)
+	}
+
+	if got := len(s.points["Requests"]); got != 3 {
+		t.Errorf("kept %d points, want 3", got)
+	}
+
+	now = now.Add(30 * time.Second)
+	rate, err := s.GetCounterRate(ctx, "Requests", time.Minute)
+	if err != nil {
+		t.Fatalf("GetCounterRate() error = %v", err)
+	}
+	if rate != 1 {
+		t.Errorf("GetCounterRate() = %v, want 1", rate)
+	}
+
+	if _, err := s.GetCounterRate(ctx, "missing", time.Minute); err == nil {
+		t.Errorf("GetCounterRate() computed a rate for a counter that was never stored")
+	}
+}
+
+func TestInMemoryStorageHistory(t *testing.T) {
+	s := NewInMemoryStorage()
+	ctx := context.TODO()
+
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	if _, _, err := s.GetHistory(ctx, constants.MetricTypeCounter, "Requests", now, now); err != history.ErrDisabled {
+		t.Errorf("GetHistory() error = %v, want %v", err, history.ErrDisabled)
+	}
+
+	tiers, err := history.ParseTiers("raw:1h")
+	if err != nil {
+		t.Fatalf("ParseTiers() error = %v", err)
+	}
+	s.SetHistoryTiers(tiers)
+
+	delta := int64(2)
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		if err := s.SaveMetrics(ctx, []models.Metrics{{ID: "Requests", MType: constants.MetricTypeCounter, Delta: &delta}}, false); err != nil {
+			t.Fatalf("SaveMetrics() error = %v", err)
+		}
+	}
+
+	_, points, err := s.GetHistory(ctx, constants.MetricTypeCounter, "Requests", now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatalf("GetHistory() error = %v", err)
+	}
+	var totals []float64
+	for _, p := range points {
+		totals = append(totals, p.Last)
+	}
+	if len(totals) != 3 || totals[0] != 2 || totals[2] != 6 {
+		t.Errorf("GetHistory() totals = %v, want [2 4 6]", totals)
+	}
+
+	if err := s.CompactHistory(ctx, now.Add(2*time.Hour)); err != nil {
+		t.Fatalf("CompactHistory() error = %v", err)
+	}
+	if _, points, _ := s.GetHistory(ctx, constants.MetricTypeCounter, "Requests", now.Add(-time.Minute), now); len(points) != 0 {
+		t.Errorf("GetHistory() after compaction = %v, want no points", points)
+	}
+}
+
+func TestInMemoryStorageTenants(t *testing.T) {
+	s := NewInMemoryStorage()
+	def := context.Background()
+	team := tenant.NewContext(def, "team")
+
+	if err := s.UpdateGauge(def, "Alloc", 1, false); err != nil {
+		t.Fatalf("UpdateGauge() error = %v", err)
+	}
+	value := 2.0
+	if err := s.SaveMetrics(team, []models.Metrics{{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &value}}, false); err != nil {
+		t.Fatalf("SaveMetrics() error = %v", err)
+	}
+	if err := s.UpdateCounter(team, "Requests", 3, false); err != nil {
+		t.Fatalf("UpdateCounter() error = %v", err)
+	}
+
+	if got, err := s.GetGauge(def, "Alloc"); err != nil || got != 1 {
+		t.Errorf("GetGauge() of the default tenant = %v, %v, want 1", got, err)
+	}
+	if got, err := s.GetGauge(team, "Alloc"); err != nil || got != 2 {
+		t.Errorf("GetGauge() of the team tenant = %v, %v, want 2", got, err)
+	}
+	if _, err := s.GetCounter(def, "Requests"); err == nil {
+		t.Errorf("GetCounter() of the default tenant found the counter of another tenant")
+	}
+
+	values, err := s.GetValues(team, constants.MetricTypeGauge)
+	if err != nil || len(values) != 1 || values["Alloc"] != 2 {
+		t.Errorf("GetValues() of the team tenant = %v, %v, want map[Alloc:2]", values, err)
+	}
+	if got := s.String(def); strings.Contains(got, "Requests") || strings.Contains(got, "2.0") {
+		t.Errorf("String() of the default tenant shows the metrics of another tenant:\n%s", got)
+	}
+	if got := s.String(team); !strings.Contains(got, "Requests") {
+		t.Errorf("String() of the team tenant = %q, want its counter", got)
+	}
+}
+
+func TestInMemoryStorageQuota(t *testing.T) {
+	s := NewInMemoryStorage()
+	s.SetQuota(limits.NewQuota(2))
+	team := tenant.NewContext(context.Background(), "team")
+
+	if err := s.UpdateGauge(team, "Alloc", 1, false); err != nil {
+		t.Fatalf("UpdateGauge() error = %v", err)
+	}
+	if err := s.UpdateGauge(context.Background(), "Alloc", 1, false); err != nil {
+		t.Fatalf("UpdateGauge() of another tenant error = %v", err)
+	}
+
+	value, delta := 2.0, int64(1)
+	batch := []models.Metrics{
+		{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &value},
+		{ID: "Frees", MType: constants.MetricTypeGauge, Value: &value},
+		{ID: "Frees", MType: constants.MetricTypeGauge, Value: &value},
+	}
+	if err := s.SaveMetrics(team, batch, false); err != nil {
+		t.Fatalf("SaveMetrics() within the quota error = %v", err)
+	}
+
+	value = 5
+	batch = append(batch, models.Metrics{ID: "Requests", MType: constants.MetricTypeCounter, Delta: &delta})
+	if err := s.SaveMetrics(team, batch, false); !errors.Is(err, limits.ErrQuotaExceeded) {
+		t.Errorf("SaveMetrics() over the quota error = %v, want %v", err, limits.ErrQuotaExceeded)
+	}
+	if got, err := s.GetGauge(team, "Alloc"); err != nil || got != 2 {
+		t.Errorf("GetGauge() after a rejected batch = %v, %v, want 2", got, err)
+	}
+	if err := s.UpdateCounter(team, "Requests", 1, false); !errors.Is(err, limits.ErrQuotaExceeded) {
+		t.Errorf("UpdateCounter() over the quota error = %v, want %v", err, limits.ErrQuotaExceeded)
+	}
+	if err := s.UpdateGauge(team, "Frees", 3, false); err != nil {
+		t.Errorf("UpdateGauge() of a stored gauge error = %v", err)
+	}
+}
+
+func TestInMemoryStorageQuotaAfterRestore(t *testing.T) {
+	s := NewInMemoryStorage()
+	s.SetQuota(limits.NewQuota(2))
+	team := tenant.NewContext(context.Background(), "team")
+
+	s.SetMetricsData(map[string]float64{tenant.Key(team, "Alloc"): 1, "Alloc": 1}, map[string]int64{})
+	s.SetSetsData(map[string]hll.Sketch{tenant.Key(team, "Users"): hll.New()})
+
+	if err := s.UpdateGauge(team, "Frees", 1, false); !errors.Is(err, limits.ErrQuotaExceeded) {
+		t.Errorf("UpdateGauge() over the quota of restored metrics error = %v, want %v", err, limits.ErrQuotaExceeded)
+	}
+	if err := s.UpdateGauge(context.Background(), "Frees", 1, false); err != nil {
+		t.Errorf("UpdateGauge() of another tenant error = %v", err)
+	}
+
+	s.SetSetsData(nil)
+	if err := s.UpdateGauge(team, "Frees", 1, false); err != nil {
+		t.Errorf("UpdateGauge() after the sets were cleared error = %v", err)
+	}
+}
+
+func TestInMemoryStorageAudit(t *testing.T) {
+	sink, err := audit.NewFileSink(t.TempDir()+"/audit.jsonl", 0, 0)
+	if err != nil {
+		t.Fatalf("NewFileSink() error = %v", err)
+	}
+	defer sink.Close()
+
+	s := NewInMemoryStorage()
+	s.SetQuota(limits.NewQuota(2))
+	s.SetAudit(audit.NewLog(zap.NewNop().Sugar(), sink))
+	team := tenant.NewContext(context.Background(), "team")
+
+	if err := s.UpdateGauge(team, "Alloc", 1, false); err != nil {
+		t.Fatalf("UpdateGauge() error = %v", err)
+	}
+	value, delta := 2.0, int64(3)
+	batch := []models.Metrics{
+		{ID: "Alloc", MType: constants.MetricTypeGauge, Value: &value},
+		{ID: "PollCount", MType: constants.MetricTypeCounter, Delta: &delta},
+	}
+	if err := s.SaveMetrics(team, batch, false); err != nil {
+		t.Fatalf("SaveMetrics() error = %v", err)
+	}
+	if err := s.UpdateGauge(team, "Frees", 1, false); !errors.Is(err, limits.ErrQuotaExceeded) {
+		t.Fatalf("UpdateGauge() over the quota error = %v, want %v", err, limits.ErrQuotaExceeded)
+	}
+
+	entries, err := sink.Read(context.Background(), audit.Filter{Tenant: "team"})
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Read() = %d entries, want 3 for the accepted updates", len(entries))
+	}
+	if e := entries[0]; e.Name != "Alloc" || e.Old != nil || *e.New != 1 {
+		t.Errorf("entry of a new gauge = %+v, want no old value and new value 1", e)
+	}
+	if e := entries[1]; e.Name != "Alloc" || *e.Old != 1 || *e.New != 2 {
+		t.Errorf("entry of an updated gauge = %+v, want old value 1 and new value 2", e)
+	}
+	if e := entries[2]; e.Name != "PollCount" || *e.Delta != 3 {
+		t.Errorf("entry of a counter = %+v, want delta 3", e)
+	}
+}
+
+// blockingSink is an audit sink whose writes wait until release is closed
+type blockingSink struct {
+	written chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSink) Write(ctx context.Context, entries []audit.Entry) error {
+	s.written <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *blockingSink) Read(ctx context.Context, f audit.Filter) ([]audit.Entry, error) {
+	return nil, nil
+}
+
+func (s *blockingSink) Close() error { return nil }
+
+func TestInMemoryStorageAuditOutsideLock(t *testing.T) {
+	sink := &blockingSink{written: make(chan struct{}), release: make(chan struct{})}
+	s := NewInMemoryStorage()
+	s.SetAudit(audit.NewLog(zap.NewNop().Sugar(), sink))
+
+	done := make(chan error)
+	go func() {
+		done <- s.UpdateGauge(context.Background(), "Alloc", 1, false)
+	}()
+	<-sink.written
+
+	// the update is applied while its audit entry is still being written
+	if value, err := s.GetGauge(context.Background(), "Alloc"); err != nil || value != 1 {
+		t.Errorf("GetGauge() while auditing = %v, %v, want 1", value, err)
+	}
+
+	close(sink.release)
+	if err := <-done; err != nil {
+		t.Errorf("UpdateGauge() error = %v", err)
+	}
+}
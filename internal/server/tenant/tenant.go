@@ -0,0 +1,92 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+// Separator joins a tenant and a metric name into the key the storages keep the metric under
+// the metrics of the default tenant, used when no tokens are configured, are kept under their plain names,
+// so enabling tenants leaves previously stored metrics to the default tenant
+const Separator = "\x1f"
+
+// ctxKey is the context key of the tenant
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx carrying tenant
+func NewContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, tenant)
+}
+
+// FromContext returns the tenant carried by ctx, empty for the default tenant
+func FromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(ctxKey{}).(string)
+	return tenant
+}
+
+// Scope returns a copy of ctx carrying the tenant that WithAuth stored in the context of r
+// handlers receive the server context when they are created, so the tenant has to be carried over per request
+func Scope(ctx context.Context, r *http.Request) context.Context {
+	return NewContext(ctx, FromContext(r.Context()))
+}
+
+// Prefix returns the key prefix of the tenant in ctx, empty for the default tenant
+func Prefix(ctx context.Context) string {
+	if tenant := FromContext(ctx); tenant != "" {
+		return tenant + Separator
+	}
+	return ""
+}
+
+// Key returns the storage key of a metric of the tenant in ctx
+func Key(ctx context.Context, name string) string {
+	return Prefix(ctx) + name
+}
+
+// Name returns the metric name of a storage key and whether the key belongs to the tenant in ctx
+func Name(ctx context.Context, key string) (string, bool) {
+	prefix := Prefix(ctx)
+	if prefix == "" {
+		return key, !strings.Contains(key, Separator)
+	}
+	return strings.CutPrefix(key, prefix)
+}
+
+// Owner returns the tenant a storage key belongs to, empty for the default tenant
+func Owner(key string) string {
+	tenant, _, found := strings.Cut(key, Separator)
+	if !found {
+		return ""
+	}
+	return tenant
+}
+
+// Filter returns the entries of m that belong to the tenant in ctx, keyed by metric name
+func Filter[V any](ctx context.Context, m map[string]V) map[string]V {
+	filtered := make(map[string]V)
+	for key, value := range m {
+		if name, ok := Name(ctx, key); ok {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
+
+// Metrics returns metrics with their IDs replaced by the storage keys of the tenant in ctx
+// the slice is copied unless the tenant is the default one
+func Metrics(ctx context.Context, metrics []models.Metrics) []models.Metrics {
+	prefix := Prefix(ctx)
+	if prefix == "" {
+		return metrics
+	}
+
+	scoped := make([]models.Metrics, len(metrics))
+	for i, metric := range metrics {
+		metric.ID = prefix + metric.ID
+		scoped[i] = metric
+	}
+	return scoped
+}
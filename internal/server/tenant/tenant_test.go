@@ -0,0 +1,117 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
+)
+
+func TestKeys(t *testing.T) {
+	team := NewContext(context.Background(), "team")
+	other := NewContext(context.Background(), "other")
+	def := context.Background()
+
+	assert.Equal(t, "Alloc", Key(def, "Alloc"))
+	assert.Equal(t, "team"+Separator+"Alloc", Key(team, "Alloc"))
+
+	tests := []struct {
+		ctx  context.Context
+		key  string
+		name string
+		ok   bool
+	}{
+		{def, "Alloc", "Alloc", true},
+		{def, Key(team, "Alloc"), "", false},
+		{team, Key(team, "Alloc"), "Alloc", true},
+		{team, "Alloc", "", false},
+		{other, Key(team, "Alloc"), "", false},
+	}
+	for _, tt := range tests {
+		name, ok := Name(tt.ctx, tt.key)
+		assert.Equal(t, tt.ok, ok, tt.key)
+		if tt.ok {
+			assert.Equal(t, tt.name, name)
+		}
+	}
+
+	assert.Equal(t, "", Owner("Alloc"))
+	assert.Equal(t, "team", Owner(Key(team, "Alloc")))
+
+	m := map[string]int{"Alloc": 1, Key(team, "Alloc"): 2, Key(team, "Frees"): 3, Key(other, "Alloc"): 4}
+	assert.Equal(t, map[string]int{"Alloc": 1}, Filter(def, m))
+	assert.Equal(t, map[string]int{"Alloc": 2, "Frees": 3}, Filter(team, m))
+
+	metrics := []models.Metrics{{ID: "Alloc", MType: "gauge"}}
+	assert.Equal(t, "team"+Separator+"Alloc", Metrics(team, metrics)[0].ID)
+	assert.Equal(t, "Alloc", metrics[0].ID, "the batch of the caller is left unchanged")
+	assert.Equal(t, metrics, Metrics(def, metrics))
+}
+
+func TestParseTokens(t *testing.T) {
+	file := "# team tokens\n\nteam:" + Hash("secret") + "\nteam: " + strings.ToUpper(Hash("rotated")) + "\nops.v2:" + Hash("ops") + "\n"
+	tokens, err := ParseTokens(strings.NewReader(file))
+	require.NoError(t, err)
+	assert.Len(t, tokens, 3)
+
+	for token, want := range map[string]string{"secret": "team", "rotated": "team", "ops": "ops.v2"} {
+		tenant, ok := tokens.Lookup(token)
+		assert.True(t, ok, token)
+		assert.Equal(t, want, tenant)
+	}
+	_, ok := tokens.Lookup("unknown")
+	assert.False(t, ok)
+
+	for _, invalid := range []string{
+		"team",
+		":" + Hash("secret"),
+		"team/a:" + Hash("secret"),
+		"team:secret",
+		"team:" + Hash("secret")[:10],
+		"team:" + Hash("secret") + "\nops:" + Hash("secret"),
+	} {
+		_, err := ParseTokens(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestWithAuth(t *testing.T) {
+	tokens := Tokens{Hash("secret"): "team"}
+	handler := WithAuth(zap.NewNop().Sugar(), tokens, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(FromContext(r.Context())))
+	}))
+
+	tests := []struct {
+		header string
+		status int
+		tenant string
+	}{
+		{"Bearer secret", http.StatusOK, "team"},
+		{"Bearer other", http.StatusUnauthorized, ""},
+		{"Basic secret", http.StatusUnauthorized, ""},
+		{"", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, tt.status, rec.Code, tt.header)
+		if tt.status == http.StatusOK {
+			assert.Equal(t, tt.tenant, rec.Body.String())
+		} else {
+			assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
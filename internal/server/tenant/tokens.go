@@ -0,0 +1,109 @@
+package tenant
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Tokens maps the hex SHA-256 hashes of bearer tokens to their tenants
+// only hashes are kept, so a leaked tokens file does not reveal the tokens
+type Tokens map[string]string
+
+// Hash returns the hex SHA-256 hash of a token as it is written to the tokens file
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadTokens reads the tokens file at path, see ParseTokens
+func LoadTokens(path string) (Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseTokens(f)
+}
+
+// ParseTokens parses one 'tenant:hash' pair per line, where hash is the output of Hash for the token;
+// blank lines and lines starting with '#' are ignored and a tenant may have several tokens;
+// tenant names consist of letters, digits, '_', '-' and '.'
+func ParseTokens(r io.Reader) (Tokens, error) {
+	tokens := make(Tokens)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		name, hash, ok := strings.Cut(entry, ":")
+		name, hash = strings.TrimSpace(name), strings.ToLower(strings.TrimSpace(hash))
+		if !ok || !validName(name) {
+			return nil, fmt.Errorf("line %d: expected 'tenant:hash' with a tenant of letters, digits, '_', '-' or '.'", line)
+		}
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("line %d: token hash of tenant %s is not a hex SHA-256 hash", line, name)
+		}
+		if other, dup := tokens[hash]; dup && other != name {
+			return nil, fmt.Errorf("line %d: token of tenant %s is already used by tenant %s", line, name, other)
+		}
+
+		tokens[hash] = name
+	}
+
+	return tokens, scanner.Err()
+}
+
+// validName reports whether name is a non-empty tenant name of letters, digits, '_', '-' and '.'
+func validName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Lookup returns the tenant of a bearer token
+func (t Tokens) Lookup(token string) (string, bool) {
+	tenant, ok := t[Hash(token)]
+	return tenant, ok
+}
+
+// WithAuth is a middleware that stores the tenant of the request's bearer token in its context
+// requests without a known token are rejected with 401 Unauthorized; guardRejected, if not nil,
+// wraps the rejection, so that the rejected requests can be rate limited before they are answered
+func WithAuth(sugar *zap.SugaredLogger, tokens Tokens, guardRejected func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	var reject http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sugar.Debugf("Rejected request to %s from %s without a known token", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+	if guardRejected != nil {
+		reject = guardRejected(reject)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			tenant, known := tokens.Lookup(strings.TrimSpace(token))
+			if !ok || !known {
+				reject.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), tenant)))
+		})
+	}
+}
@@ -5,27 +5,24 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/config"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/filestorage"
+	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/health"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/models"
 	"github.com/eutjeng/go-musthave-metrics-tpl/internal/server/storage"
 	"go.uber.org/zap"
 )
 
+// shutdownTimeout bounds how long the server waits for requests in flight when it shuts down
+const shutdownTimeout = 10 * time.Second
+
 // HandleSignals listens for termination signals to gracefully shut down the application
-// It saves data to a file before signaling the main routine to terminate the application
-func HandleSignals(signalChan <-chan os.Signal, quitChan chan<- struct{}, store models.GeneralStorageInterface, cfg *config.Config, sugar *zap.SugaredLogger) {
+// it signals the main routine to terminate the application, which drains the server and saves the data
+func HandleSignals(signalChan <-chan os.Signal, quitChan chan<- struct{}) {
 	<-signalChan
 
-	if s, ok := store.(storage.Interface); ok {
-		if err := filestorage.SaveToFile(cfg, s); err != nil {
-			sugar.Errorf("Error when saving data to file: %v", err)
-		}
-	} else {
-		sugar.Warn("SaveToFile method is not implemented for this storage type")
-	}
-
 	quitChan <- struct{}{}
 }
 
@@ -41,19 +38,39 @@ func HandleServerErrors(errChan chan error, sugar *zap.SugaredLogger, cfg *confi
 }
 
 // HandleShutdownServer waits for a signal to shutdown the server
-// It attempts to gracefully shutdown the HTTP server
-func HandleShutdownServer(ctx context.Context, quitChan chan struct{}, srv *http.Server, sugar *zap.SugaredLogger, wg *sync.WaitGroup, cancel context.CancelFunc) {
+// readiness checks fail for drainDelay first, so that load balancers stop sending requests while they are
+// still served; then it gracefully shuts down the HTTP server, waiting up to shutdownTimeout for the
+// requests in flight, cancels the application context and saves data to a file, so that updates accepted
+// while draining are saved as well
+func HandleShutdownServer(quitChan chan struct{}, srv *http.Server, store models.GeneralStorageInterface, checker *health.Checker, cfg *config.Config, sugar *zap.SugaredLogger, wg *sync.WaitGroup, cancel context.CancelFunc) {
 	<-quitChan
 	sugar.Info("Received quit signal")
 
-	cancel()
-	sugar.Info("Context cancelled")
+	checker.Drain()
+	if cfg.DrainDelay > 0 {
+		sugar.Infof("Draining for %s before shutting down", cfg.DrainDelay)
+		time.Sleep(cfg.DrainDelay)
+	}
 
-	if err := srv.Shutdown(ctx); err != nil {
+	// ctx stays live until the requests in flight are done, they use it for the storage, audit log and events
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		sugar.Errorf("Server Shutdown Failed:%v", err)
 	}
+	cancelShutdown()
 	sugar.Info("Server exited properly")
 
+	cancel()
+	sugar.Info("Context cancelled")
+
+	if s, ok := store.(storage.Interface); ok {
+		if err := filestorage.SaveToFile(cfg, s); err != nil {
+			sugar.Errorf("Error when saving data to file: %v", err)
+		}
+	} else {
+		sugar.Warn("SaveToFile method is not implemented for this storage type")
+	}
+
 	wg.Done()
 	sugar.Info("Done called in HandleShutdownServer")
 }
@@ -0,0 +1,264 @@
+package sketch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// DefaultAlpha is the relative accuracy used when none is configured
+	DefaultAlpha = 0.01
+	// MaxBins bounds the number of bins per sign; beyond it the bins closest to zero are collapsed,
+	// which only affects the accuracy of the lowest quantiles
+	MaxBins = 2048
+	// minIndexable is the smallest magnitude that gets its own bin, smaller values count as zero
+	minIndexable = 1e-9
+)
+
+// Sketch is a DDSketch, a mergeable quantile sketch with relative error guarantees
+// values are counted in logarithmically sized bins keyed by their index, separately for positive and
+// negative values; every quantile estimate is within Alpha of the true value relative to that value,
+// and two sketches with the same Alpha merge into exactly the sketch of the combined values
+type Sketch struct {
+	Positive map[int]int64 `json:"positive,omitempty"` // bin counts of positive values
+	Negative map[int]int64 `json:"negative,omitempty"` // bin counts of negative values by their magnitude
+	Alpha    float64       `json:"alpha"`              // relative accuracy
+	Sum      float64       `json:"sum"`                // sum of all values
+	Min      float64       `json:"min"`                // smallest value, meaningful when Count > 0
+	Max      float64       `json:"max"`                // largest value, meaningful when Count > 0
+	Count    int64         `json:"count"`              // number of values
+	Zero     int64         `json:"zero,omitempty"`     // number of values too close to zero to be indexed
+}
+
+// New creates an empty sketch with relative accuracy alpha
+func New(alpha float64) Sketch {
+	return Sketch{
+		Positive: make(map[int]int64),
+		Negative: make(map[int]int64),
+		Alpha:    alpha,
+	}
+}
+
+// gamma returns the ratio between the bounds of a bin
+func (s Sketch) gamma() float64 {
+	return (1 + s.Alpha) / (1 - s.Alpha)
+}
+
+// index returns the bin of a positive magnitude
+func (s Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / math.Log(s.gamma())))
+}
+
+// value returns the representative magnitude of a bin, whose relative distance
+// to any value in the bin is at most Alpha
+func (s Sketch) value(index int) float64 {
+	g := s.gamma()
+	return 2 * math.Pow(g, float64(index)) / (g + 1)
+}
+
+// Add records a single value, non finite values are ignored
+func (s *Sketch) Add(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	if s.Positive == nil {
+		s.Positive = make(map[int]int64)
+	}
+	if s.Negative == nil {
+		s.Negative = make(map[int]int64)
+	}
+
+	switch {
+	case v > minIndexable:
+		s.Positive[s.index(v)]++
+		collapse(s.Positive)
+	case v < -minIndexable:
+		s.Negative[s.index(-v)]++
+		collapse(s.Negative)
+	default:
+		s.Zero++
+	}
+
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+}
+
+// collapse merges the lowest bins into one until at most MaxBins are left
+func collapse(bins map[int]int64) {
+	if len(bins) <= MaxBins {
+		return
+	}
+
+	indexes := make([]int, 0, len(bins))
+	for i := range bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	excess := len(bins) - MaxBins
+	target := indexes[excess]
+	for _, i := range indexes[:excess] {
+		bins[target] += bins[i]
+		delete(bins, i)
+	}
+}
+
+// Merge returns the sketch of the values of both s and other
+// sketches with a different accuracy cannot be combined, in that case the configuration has changed
+// and other replaces s entirely; merging into an empty Sketch{} returns a copy of other
+func (s Sketch) Merge(other Sketch) Sketch {
+	if s.Alpha != other.Alpha {
+		return other.Clone()
+	}
+	if other.Count == 0 {
+		return s.Clone()
+	}
+
+	merged := s.Clone()
+	for i, n := range other.Positive {
+		merged.Positive[i] += n
+	}
+	for i, n := range other.Negative {
+		merged.Negative[i] += n
+	}
+	collapse(merged.Positive)
+	collapse(merged.Negative)
+
+	if merged.Count == 0 || other.Min < merged.Min {
+		merged.Min = other.Min
+	}
+	if merged.Count == 0 || other.Max > merged.Max {
+		merged.Max = other.Max
+	}
+	merged.Zero += other.Zero
+	merged.Count += other.Count
+	merged.Sum += other.Sum
+
+	return merged
+}
+
+// Clone returns a deep copy of s
+func (s Sketch) Clone() Sketch {
+	c := s
+	c.Positive = make(map[int]int64, len(s.Positive))
+	for i, n := range s.Positive {
+		c.Positive[i] = n
+	}
+	c.Negative = make(map[int]int64, len(s.Negative))
+	for i, n := range s.Negative {
+		c.Negative[i] = n
+	}
+	return c
+}
+
+// Quantile returns the estimated value at quantile q, which must be within [0, 1]
+func (s Sketch) Quantile(q float64) (float64, error) {
+	if q < 0 || q > 1 || math.IsNaN(q) {
+		return 0, fmt.Errorf("quantile %v is not within [0, 1]", q)
+	}
+	if s.Count == 0 {
+		return 0, errors.New("sketch is empty")
+	}
+
+	rank := q * float64(s.Count-1)
+	var seen int64
+
+	// negative values in ascending order, which is descending magnitude
+	for _, i := range sortedIndexes(s.Negative, true) {
+		seen += s.Negative[i]
+		if float64(seen) > rank {
+			return s.clamp(-s.value(i)), nil
+		}
+	}
+
+	seen += s.Zero
+	if float64(seen) > rank {
+		return s.clamp(0), nil
+	}
+
+	for _, i := range sortedIndexes(s.Positive, false) {
+		seen += s.Positive[i]
+		if float64(seen) > rank {
+			return s.clamp(s.value(i)), nil
+		}
+	}
+
+	return s.Max, nil
+}
+
+// clamp keeps an estimate within the observed range
+func (s Sketch) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+// sortedIndexes returns the bin indexes in ascending or descending order
+func sortedIndexes(bins map[int]int64, descending bool) []int {
+	indexes := make([]int, 0, len(bins))
+	for i := range bins {
+		indexes = append(indexes, i)
+	}
+	if descending {
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	} else {
+		sort.Ints(indexes)
+	}
+	return indexes
+}
+
+// Validate checks that the accuracy is within (0, 1), that the bins are bounded and not negative,
+// and that Count is the total of all bins
+func (s Sketch) Validate() error {
+	if !(s.Alpha > 0 && s.Alpha < 1) {
+		return fmt.Errorf("sketch accuracy %v is not within (0, 1)", s.Alpha)
+	}
+	if len(s.Positive) > MaxBins || len(s.Negative) > MaxBins {
+		return fmt.Errorf("sketch has more than %d bins", MaxBins)
+	}
+
+	total := s.Zero
+	if s.Zero < 0 {
+		return errors.New("sketch bin counts must not be negative")
+	}
+	for _, bins := range []map[int]int64{s.Positive, s.Negative} {
+		for _, n := range bins {
+			if n < 0 {
+				return errors.New("sketch bin counts must not be negative")
+			}
+			total += n
+		}
+	}
+	if total != s.Count {
+		return fmt.Errorf("sketch count %d does not match the bin total %d", s.Count, total)
+	}
+
+	for _, v := range []float64{s.Sum, s.Min, s.Max} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("sketch sum, min and max must be finite")
+		}
+	}
+	if s.Count > 0 && s.Min > s.Max {
+		return errors.New("sketch min is greater than its max")
+	}
+
+	return nil
+}
+
+// String formats the count, sum and the common quantiles of the sketch
+func (s Sketch) String() string {
+	if s.Count == 0 {
+		return "count=0"
+	}
+
+	p50, _ := s.Quantile(0.5)
+	p95, _ := s.Quantile(0.95)
+	p99, _ := s.Quantile(0.99)
+	return fmt.Sprintf("count=%d sum=%f min=%f p50=%f p95=%f p99=%f max=%f", s.Count, s.Sum, s.Min, p50, p95, p99, s.Max)
+}
@@ -0,0 +1,112 @@
+package sketch
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuantileAccuracy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	values := make([]float64, 10000)
+	s := New(DefaultAlpha)
+	for i := range values {
+		values[i] = rnd.ExpFloat64() * 100
+		s.Add(values[i])
+	}
+	sort.Float64s(values)
+
+	for _, q := range []float64{0, 0.5, 0.9, 0.95, 0.99, 1} {
+		expected := values[int(q*float64(len(values)-1))]
+		got, err := s.Quantile(q)
+		require.NoError(t, err)
+		assert.InEpsilon(t, expected, got, DefaultAlpha*1.01, "q=%v", q)
+	}
+}
+
+func TestNegativeAndZeroValues(t *testing.T) {
+	s := New(DefaultAlpha)
+	for _, v := range []float64{-10, -1, 0, 1, 10} {
+		s.Add(v)
+	}
+
+	expected := map[float64]float64{0: -10, 0.25: -1, 0.5: 0, 0.75: 1, 1: 10}
+	for q, v := range expected {
+		got, err := s.Quantile(q)
+		require.NoError(t, err)
+		assert.InDelta(t, v, got, math.Abs(v)*DefaultAlpha, "q=%v", q)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, all := New(DefaultAlpha), New(DefaultAlpha), New(DefaultAlpha)
+	for i := 1; i <= 1000; i++ {
+		v := float64(i)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+		all.Add(v)
+	}
+
+	merged := a.Merge(b)
+	assert.Equal(t, all, merged)
+	assert.Equal(t, int64(500), a.Count, "merge must not modify its operands")
+
+	assert.Equal(t, a, Sketch{}.Merge(a))
+	other := New(0.05)
+	other.Add(1)
+	assert.Equal(t, other, a.Merge(other), "a different accuracy replaces the sketch")
+}
+
+func TestCollapse(t *testing.T) {
+	s := New(DefaultAlpha)
+	n := MaxBins * 2
+	for i := 0; i < n; i++ {
+		s.Add(math.Pow(1.1, float64(i)))
+	}
+
+	assert.Len(t, s.Positive, MaxBins)
+	require.NoError(t, s.Validate())
+
+	// the highest quantiles keep their accuracy
+	p99, err := s.Quantile(0.99)
+	require.NoError(t, err)
+	assert.InEpsilon(t, math.Pow(1.1, float64(int(0.99*float64(n-1)))), p99, DefaultAlpha*1.01)
+}
+
+func TestValidateAndJSON(t *testing.T) {
+	s := New(DefaultAlpha)
+	s.Add(3)
+	s.Add(-2)
+
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+
+	var decoded Sketch
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.NoError(t, decoded.Validate())
+	assert.Equal(t, s, decoded)
+
+	invalid := []Sketch{
+		{Alpha: 0},
+		{Alpha: 0.01, Count: 1},
+		{Alpha: 0.01, Positive: map[int]int64{1: -1}, Count: -1},
+		{Alpha: 0.01, Positive: map[int]int64{1: 1}, Count: 1, Min: 2, Max: 1},
+	}
+	for _, sk := range invalid {
+		assert.Error(t, sk.Validate(), "%+v", sk)
+	}
+
+	_, err = New(DefaultAlpha).Quantile(0.5)
+	assert.Error(t, err)
+	_, err = s.Quantile(1.5)
+	assert.Error(t, err)
+}
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"reflect"
 	"sort"
 	"strconv"
@@ -20,13 +22,37 @@ func ParseInt(s string) (int64, error) {
 	return strconv.ParseInt(s, 10, 64)
 }
 
-func EnsureHTTPScheme(addr string) string {
+// SplitList splits a comma separated list, trimming spaces and skipping empty entries
+func SplitList(list string) []string {
+	var result []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// EnsureScheme prefixes addr with https:// if secure or http:// otherwise, unless it already has either scheme
+func EnsureScheme(addr string, secure bool) string {
 	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
 		return addr
 	}
+	if secure {
+		return "https://" + addr
+	}
 	return "http://" + addr
 }
 
+// RemoteIP returns the IP address of the client of r without its port, proxy headers are not trusted
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // getSortedKeys takes a map and returns its keys sorted as a slice of strings
 func getSortedKeys(m interface{}) []string {
 	var keys []string
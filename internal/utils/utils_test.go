@@ -65,21 +65,23 @@ func TestParseInt(t *testing.T) {
 	}
 }
 
-func TestEnsureHTTPScheme(t *testing.T) {
+func TestEnsureScheme(t *testing.T) {
 	tests := []struct {
 		input    string
+		secure   bool
 		expected string
 	}{
-		{"http://localhost", "http://localhost"},
-		{"https://localhost", "https://localhost"},
-		{"localhost", "http://localhost"},
-		{"ftp://localhost", "http://ftp://localhost"},
+		{"localhost:8080", true, "https://localhost:8080"},
+		{"localhost:8080", false, "http://localhost:8080"},
+		{"http://localhost", true, "http://localhost"},
+		{"https://localhost", false, "https://localhost"},
+		{"ftp://localhost", false, "http://ftp://localhost"},
 	}
 
 	for _, test := range tests {
-		result := EnsureHTTPScheme(test.input)
+		result := EnsureScheme(test.input, test.secure)
 		if result != test.expected {
-			t.Errorf("EnsureHTTPScheme(%s) = %s, want %s", test.input, result, test.expected)
+			t.Errorf("EnsureScheme(%s, %t) = %s, want %s", test.input, test.secure, result, test.expected)
 		}
 	}
 }